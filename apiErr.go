@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	log "github.com/Sirupsen/logrus"
 	"net/http"
+	"strings"
 )
 
 var (
@@ -18,6 +19,8 @@ var (
 	MobileUserBadCodeErr       *ApiError
 	MobileUserBadTokenErr      *ApiError
 	MobileUserAlreadyExistsErr *ApiError
+	TooManyRequestsErr         *ApiError
+	GoneErr                    *ApiError
 )
 
 const (
@@ -27,8 +30,12 @@ const (
 	ECodeUnauthorized                    = 40100
 	ECodeForbidden                       = 40300
 	ECodeNotFound                        = 40400
+	ECodeConflict                        = 40900
+	ECodeGone                            = 41000
+	ECodeTooManyRequests                 = 42900
 	ECodeInternal                        = 50000
 	ECode3rdPartyAuthFailed              = 50300
+	ECodeGatewayTimeout                  = 50400
 	ECodeInvalidUsername                 = 60001
 	ECodeInvalidNickname                 = 60002
 	ECodeInvalidPassword                 = 60003
@@ -40,6 +47,61 @@ const (
 
 type ErrCode int
 
+// Codes that can be declared by APIs, see IsKnownErrCode
+var knownErrCodes = map[ErrCode]bool{
+	ECodeOK: true, ECodeRedirect: true, ECodeBadRequest: true,
+	ECodeUnauthorized: true, ECodeForbidden: true, ECodeNotFound: true,
+	ECodeConflict: true, ECodeGone: true, ECodeTooManyRequests: true,
+	ECodeInternal: true, ECode3rdPartyAuthFailed: true,
+	ECodeGatewayTimeout:  true,
+	ECodeInvalidUsername: true,
+	ECodeInvalidNickname: true, ECodeInvalidPassword: true,
+	ECodeMobileUserNotFound: true, ECodeMobileUserBadCode: true,
+	ECodeMobileUserBadToken: true, ECodeMobileUserAlreadyExists: true,
+}
+
+// RegisterErrCode makes an app defined code known, so that APIs can
+// declare it.
+func RegisterErrCode(code ErrCode) {
+	knownErrCodes[code] = true
+}
+
+func IsKnownErrCode(code ErrCode) bool {
+	return knownErrCodes[code]
+}
+
+// Code => lang => message, see RegisterErrMessage
+var errMessages = make(map[ErrCode]map[string]string)
+
+// RegisterErrMessage registers the message of errors of code in lang,
+// e.g. "en" or "zh-CN", to localize the errors the framework replies.
+// Not safe to call once the server is serving.
+func RegisterErrMessage(code ErrCode, lang, msg string) {
+	lang = strings.ToLower(lang)
+	if errMessages[code] == nil {
+		errMessages[code] = make(map[string]string)
+	}
+	errMessages[code][lang] = msg
+}
+
+// ErrMessage returns the message registered for code in lang, lang
+// "zh-cn" falls back to "zh".
+func ErrMessage(code ErrCode, lang string) (string, bool) {
+	msgs := errMessages[code]
+	if msgs == nil {
+		return "", false
+	}
+	lang = strings.ToLower(lang)
+	if msg, ok := msgs[lang]; ok {
+		return msg, true
+	}
+	if i := strings.Index(lang, "-"); i > 0 {
+		msg, ok := msgs[lang[:i]]
+		return msg, ok
+	}
+	return "", false
+}
+
 func init() {
 	NotFoundErr = NewApiErr(ECodeNotFound, "NotFound error")
 	UnauthorizedErr = NewApiErr(ECodeUnauthorized, "Unauthorized error")
@@ -52,11 +114,21 @@ func init() {
 	MobileUserBadCodeErr = NewApiErr(ECodeMobileUserBadCode, "Mobile user bad code")
 	MobileUserBadTokenErr = NewApiErr(ECodeMobileUserBadToken, "Mobile user bad token")
 	MobileUserAlreadyExistsErr = NewApiErr(ECodeMobileUserAlreadyExists, "Mobile user already exists")
+	TooManyRequestsErr = NewApiErr(ECodeTooManyRequests, "Too many requests")
+	GoneErr = NewApiErr(ECodeGone, "API is no longer available")
 }
 
 type ApiError struct {
-	Code ErrCode `json:"errcode"`
-	Msg  string  `json:"errmsg"`
+	Code ErrCode `json:"errcode" xml:"errcode"`
+	Msg  string  `json:"errmsg" xml:"errmsg"`
+	// HTTP status overriding the one derived from Code if not 0
+	Status int `json:"status,omitempty" xml:"status,omitempty"`
+	// Bad fields of the request => why, e.g. "query.age"
+	Fields map[string]string `json:"fields,omitempty" xml:"-"`
+	// Anything else for clients to handle the error with
+	Details interface{} `json:"details,omitempty" xml:"-"`
+	// Of the request failed, for it to be found in logs
+	RequestId string `json:"request_id,omitempty" xml:"request_id,omitempty"`
 }
 
 func (e *ApiError) Error() string {
@@ -67,9 +139,26 @@ func (e *ApiError) HttpCode() int {
 	return int(e.Code) / 100
 }
 
+// HttpStatus returns Status if set, or else maps the error code to a
+// HTTP status code (Code/100), unknown statuses fall back to 500.
+func (e *ApiError) HttpStatus() int {
+	if e.Status != 0 {
+		return e.Status
+	}
+	status := int(e.Code) / 100
+	if status < 100 || http.StatusText(status) == "" {
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
 func (e *ApiError) HttpError(w http.ResponseWriter) {
-	code := 200 //int(e.Code) / 100
-	http.Error(w, "", code)
+	code := e.HttpStatus()
+	if Conf.AlwaysReturn200 {
+		code = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
 	encoder := json.NewEncoder(w)
 	err := encoder.Encode(e)
 	if err != nil {
@@ -81,15 +170,41 @@ func (e *ApiError) HttpError(w http.ResponseWriter) {
 }
 
 func NewApiErr(code ErrCode, msg string) *ApiError {
-	return &ApiError{code, msg}
+	return &ApiError{Code: code, Msg: msg}
+}
+
+// NewApiErrWithStatus makes an error replied with status regardless of
+// its code.
+func NewApiErrWithStatus(code ErrCode, status int, msg string) *ApiError {
+	return &ApiError{Code: code, Msg: msg, Status: status}
+}
+
+// NewApiErrWithFields makes an error naming the bad fields of a request.
+func NewApiErrWithFields(code ErrCode, msg string, fields map[string]string) *ApiError {
+	return &ApiError{Code: code, Msg: msg, Fields: fields}
+}
+
+// WithField adds a bad field to e, returning e.
+func (e *ApiError) WithField(field, why string) *ApiError {
+	if e.Fields == nil {
+		e.Fields = make(map[string]string)
+	}
+	e.Fields[field] = why
+	return e
+}
+
+// WithDetails sets Details of e, returning e.
+func (e *ApiError) WithDetails(details interface{}) *ApiError {
+	e.Details = details
+	return e
 }
 
 func NewApiErrWithCode(code ErrCode) *ApiError {
-	return &ApiError{code, "No extra info"}
+	return &ApiError{Code: code, Msg: "No extra info"}
 }
 
 func NewApiErrWithMsg(msg string) *ApiError {
-	return &ApiError{ECodeInternal, msg}
+	return &ApiError{Code: ECodeInternal, Msg: msg}
 }
 
 func ApiErrFromGoErr(err error) *ApiError {
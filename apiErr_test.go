@@ -0,0 +1,48 @@
+package appgo
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApiErrStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewApiErr(ECode3rdPartyAuthFailed, "upstream").HttpError(w)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotContains(t, w.Body.String(), "status")
+
+	w = httptest.NewRecorder()
+	aerr := NewApiErrWithStatus(ECode3rdPartyAuthFailed, http.StatusBadGateway, "upstream")
+	aerr.HttpError(w)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	var e ApiError
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &e))
+	assert.Equal(t, *aerr, e)
+
+	assert.Equal(t, http.StatusInternalServerError, NewApiErr(ErrCode(123), "").HttpStatus())
+	assert.Equal(t, http.StatusNotFound, NewApiErrWithCode(ECodeNotFound).HttpStatus())
+}
+
+func TestApiErrFields(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewApiErr(ECodeBadRequest, "bad").HttpError(w)
+	assert.NotContains(t, w.Body.String(), "fields")
+	assert.NotContains(t, w.Body.String(), "details")
+
+	w = httptest.NewRecorder()
+	NewApiErr(ECodeBadRequest, "bad").
+		WithField("body.email", "invalid").
+		WithField("body.age", "expected int").
+		WithDetails(map[string]int{"retry_in": 3}).
+		HttpError(w)
+	var e struct {
+		Fields  map[string]string `json:"fields"`
+		Details map[string]int    `json:"details"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &e))
+	assert.Equal(t, map[string]string{"body.email": "invalid", "body.age": "expected int"}, e.Fields)
+	assert.Equal(t, map[string]int{"retry_in": 3}, e.Details)
+}
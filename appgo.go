@@ -8,6 +8,9 @@ const AnonymousId = 6666
 
 const InternalTestId = 7777
 
+// User of requests authenticated by service tokens, unless configured
+const ServiceUserId = 8888
+
 const InternalTestToken = "sjadfjlksadfjkljfwoeifshgsdhgsldfjf"
 
 const CustomTokenHeaderName = "X-Appgo-Token"
@@ -16,10 +19,14 @@ const CustomVersionHeaderName = "X-Appgo-Api-Version"
 
 const CustomConfVerHeaderName = "X-Appgo-Conf-Version"
 
+const CustomVariantHeaderName = "X-Appgo-Variant"
+
 const (
 	RoleAppUser  Role = 100
 	RoleWebUser       = 101
 	RoleWebAdmin      = 200
+	// Of internal services calling with service tokens
+	RoleService = 900
 )
 
 type Role int
@@ -28,6 +28,8 @@ type LoginResult struct {
 	UserInfo interface{}
 	Banned   bool
 	BanInfo  interface{}
+	// Set if a RefreshTokenStore is
+	RefreshToken string
 }
 
 type UserSystem interface {
@@ -210,9 +212,15 @@ func checkIn(uid appgo.Id, role appgo.Role) (*LoginResult, error) {
 			BanInfo: info,
 		}, nil
 	}
-	return &LoginResult{
+	result := &LoginResult{
 		UserId:   uid,
 		Token:    token,
 		UserInfo: info,
-	}, nil
+	}
+	if refreshTokenStore != nil {
+		if result.RefreshToken, err = newRefreshToken(uid, role, ""); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
 }
@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Replaced in tests
+	jwtNow = time.Now
+
+	jwtKeysMu sync.Mutex
+	jwtKeys   map[string]*jwtKey
+	// Of Conf.Jwt the keys are loaded from
+	jwtKeysOf string
+)
+
+type jwtKey struct {
+	secret  []byte
+	private *rsa.PrivateKey
+	public  *rsa.PublicKey
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid,omitempty"`
+}
+
+type jwtClaims struct {
+	Sub  string     `json:"sub"`
+	Role appgo.Role `json:"role"`
+	Iss  string     `json:"iss,omitempty"`
+	Iat  int64      `json:"iat"`
+	Exp  int64      `json:"exp"`
+}
+
+// NewJwtToken signs a JWT of the user and role with Conf.Jwt.SigningKey,
+// which expires as tokens of NewToken do.
+func NewJwtToken(userId appgo.Id, role appgo.Role) Token {
+	now := jwtNow()
+	t, err := signJwt(&jwtClaims{
+		Sub:  userId.String(),
+		Role: role,
+		Iss:  appgo.Conf.Jwt.Issuer,
+		Iat:  now.Unix(),
+		Exp:  now.Add(time.Second * time.Duration(tokenLifetime(role))).Unix(),
+	})
+	if err != nil {
+		log.Errorln("failed to sign jwt: ", err)
+		return Token("")
+	}
+	return t
+}
+
+// RefreshJwtToken replies a new JWT for t, which may have expired within
+// Conf.Jwt.RefreshWindow.
+func RefreshJwtToken(t Token) (Token, error) {
+	claims, err := parseJwt(t)
+	if err != nil {
+		log.Infoln("refresh jwt failed: ", err)
+		return "", appgo.UnauthorizedErr
+	}
+	window := time.Second * time.Duration(appgo.Conf.Jwt.RefreshWindow)
+	if jwtNow().After(time.Unix(claims.Exp, 0).Add(window)) {
+		log.Infoln("refresh jwt failed: expired at ", time.Unix(claims.Exp, 0))
+		return "", appgo.UnauthorizedErr
+	}
+	if t = NewJwtToken(appgo.IdFromStr(claims.Sub), claims.Role); t == "" {
+		return "", appgo.InternalErr
+	}
+	return t, nil
+}
+
+// isJwt tells JWTs from encrypted tokens, which are in standard base64
+func (t Token) isJwt() bool {
+	return strings.Count(string(t), ".") == 2
+}
+
+func (t Token) validateJwt() (appgo.Id, appgo.Role) {
+	claims, err := parseJwt(t)
+	if err != nil {
+		log.Infoln("validate jwt failed: ", err)
+		return 0, 0
+	}
+	if expiry := time.Unix(claims.Exp, 0); !jwtNow().Before(expiry) {
+		log.Infoln("validate jwt failed: expired at ", expiry)
+		return 0, 0
+	}
+	return appgo.IdFromStr(claims.Sub), claims.Role
+}
+
+func signJwt(claims *jwtClaims) (Token, error) {
+	c := &appgo.Conf.Jwt
+	keys, err := loadJwtKeys()
+	if err != nil {
+		return "", err
+	}
+	kid := c.SigningKey
+	if kid == "" && len(c.Keys) > 0 {
+		kid = c.Keys[0].Id
+	}
+	key := keys[kid]
+	if key == nil {
+		return "", fmt.Errorf("no jwt key %q", kid)
+	}
+	header, _ := json.Marshal(&jwtHeader{Alg: jwtAlg(), Typ: "JWT", Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := jwtEncode(header) + "." + jwtEncode(payload)
+	sig, err := key.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return Token(signed + "." + jwtEncode(sig)), nil
+}
+
+// parseJwt verifies the signature and issuer of t, not the expiry.
+func parseJwt(t Token) (*jwtClaims, error) {
+	parts := strings.Split(string(t), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("bad jwt format")
+	}
+	var header jwtHeader
+	if err := jwtDecode(parts[0], &header); err != nil {
+		return nil, err
+	}
+	// Never what the token claims, e.g. "none"
+	if header.Alg != jwtAlg() {
+		return nil, fmt.Errorf("bad jwt alg %q", header.Alg)
+	}
+	keys, err := loadJwtKeys()
+	if err != nil {
+		return nil, err
+	}
+	key := keys[header.Kid]
+	if key == nil {
+		return nil, fmt.Errorf("unknown jwt key %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if err := key.verify([]byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var claims jwtClaims
+	if err := jwtDecode(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss := appgo.Conf.Jwt.Issuer; iss != "" && claims.Iss != iss {
+		return nil, fmt.Errorf("bad jwt issuer %q", claims.Iss)
+	}
+	return &claims, nil
+}
+
+func jwtAlg() string {
+	if appgo.Conf.Jwt.Algorithm == "" {
+		return "HS256"
+	}
+	return appgo.Conf.Jwt.Algorithm
+}
+
+func jwtEncode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func jwtDecode(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (k *jwtKey) sign(data []byte) ([]byte, error) {
+	if k.secret != nil {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	}
+	if k.private == nil {
+		return nil, errors.New("jwt key can only verify")
+	}
+	sum := sha256.Sum256(data)
+	return rsa.SignPKCS1v15(rand.Reader, k.private, crypto.SHA256, sum[:])
+}
+
+func (k *jwtKey) verify(data, sig []byte) error {
+	if k.secret != nil {
+		want, _ := k.sign(data)
+		if !hmac.Equal(sig, want) {
+			return errors.New("bad jwt signature")
+		}
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(k.public, crypto.SHA256, sum[:], sig)
+}
+
+// loadJwtKeys returns the keys of Conf.Jwt by id, reloaded once the
+// config has changed.
+func loadJwtKeys() (map[string]*jwtKey, error) {
+	c := &appgo.Conf.Jwt
+	of := fmt.Sprint(c.Algorithm, c.Keys)
+	jwtKeysMu.Lock()
+	defer jwtKeysMu.Unlock()
+	if jwtKeys != nil && jwtKeysOf == of {
+		return jwtKeys, nil
+	}
+	keys := make(map[string]*jwtKey)
+	for _, kc := range c.Keys {
+		key := &jwtKey{}
+		switch jwtAlg() {
+		case "HS256":
+			if kc.Secret == "" {
+				return nil, fmt.Errorf("no secret of jwt key %q", kc.Id)
+			}
+			key.secret = []byte(kc.Secret)
+		case "RS256":
+			var err error
+			if key.private, key.public, err = readRSAKey(kc.KeyFile); err != nil {
+				return nil, fmt.Errorf("bad jwt key %q: %v", kc.Id, err)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported jwt alg %q", c.Algorithm)
+		}
+		keys[kc.Id] = key
+	}
+	jwtKeys, jwtKeysOf = keys, of
+	return keys, nil
+}
+
+// readRSAKey reads a PEM file of a private key, or of a public key in
+// which case the private one is nil.
+func readRSAKey(path string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("no PEM data")
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unknown PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, &k.PublicKey, nil
+	case *rsa.PublicKey:
+		return nil, k, nil
+	}
+	return nil, nil, errors.New("not an RSA key")
+}
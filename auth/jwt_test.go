@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type jwtKeyConf struct {
+	Id      string
+	Secret  string
+	KeyFile string
+}
+
+func withJwt(alg string, keys ...jwtKeyConf) func() {
+	c := appgo.Conf.Jwt
+	lifetime := appgo.Conf.TokenLifetime.AppUser
+	appgo.Conf.Jwt.Enable = true
+	appgo.Conf.Jwt.Algorithm = alg
+	appgo.Conf.Jwt.Keys = nil
+	for _, k := range keys {
+		appgo.Conf.Jwt.Keys = append(appgo.Conf.Jwt.Keys, k)
+	}
+	appgo.Conf.TokenLifetime.AppUser = 3600
+	return func() {
+		appgo.Conf.Jwt = c
+		appgo.Conf.TokenLifetime.AppUser = lifetime
+		jwtNow = time.Now
+	}
+}
+
+func TestJwtHS256(t *testing.T) {
+	defer withJwt("", jwtKeyConf{Id: "k1", Secret: "secret1"})()
+	appgo.Conf.Jwt.Issuer = "appgo"
+	now := time.Now()
+	jwtNow = func() time.Time { return now }
+
+	token := NewToken(42, appgo.RoleAppUser)
+	assert.Equal(t, 2, strings.Count(string(token), "."))
+	user, role := token.Validate()
+	assert.Equal(t, appgo.Id(42), user)
+	assert.Equal(t, appgo.Role(appgo.RoleAppUser), role)
+
+	// Tampered
+	parts := strings.Split(string(token), ".")
+	forged := Token(jwtEncode([]byte(`{"alg":"none","typ":"JWT","kid":"k1"}`)) + "." +
+		jwtEncode([]byte(`{"sub":"1","role":200,"iss":"appgo","exp":9999999999}`)) + ".")
+	for _, bad := range []Token{
+		Token(parts[0] + "." + jwtEncode([]byte(`{"sub":"1","role":200}`)) + "." + parts[2]),
+		Token(parts[0] + "." + parts[1] + ".AAAA"),
+		forged,
+	} {
+		user, _ = bad.Validate()
+		assert.Equal(t, appgo.Id(0), user)
+	}
+	appgo.Conf.Jwt.Issuer = "other"
+	user, _ = token.Validate()
+	assert.Equal(t, appgo.Id(0), user)
+	appgo.Conf.Jwt.Issuer = "appgo"
+
+	// Rotated, old tokens stay valid while their key is kept
+	appgo.Conf.Jwt.Keys = append(appgo.Conf.Jwt.Keys, jwtKeyConf{Id: "k2", Secret: "secret2"})
+	appgo.Conf.Jwt.SigningKey = "k2"
+	newer := NewToken(43, appgo.RoleAppUser)
+	user, _ = newer.Validate()
+	assert.Equal(t, appgo.Id(43), user)
+	user, _ = token.Validate()
+	assert.Equal(t, appgo.Id(42), user)
+	appgo.Conf.Jwt.Keys = appgo.Conf.Jwt.Keys[1:]
+	user, _ = token.Validate()
+	assert.Equal(t, appgo.Id(0), user)
+
+	// Expired, refreshed within the window
+	now = now.Add(2 * time.Hour)
+	user, _ = newer.Validate()
+	assert.Equal(t, appgo.Id(0), user)
+	_, err := RefreshJwtToken(newer)
+	assert.Equal(t, appgo.UnauthorizedErr, err)
+	appgo.Conf.Jwt.RefreshWindow = 7200
+	refreshed, err := RefreshJwtToken(newer)
+	assert.NoError(t, err)
+	user, role = refreshed.Validate()
+	assert.Equal(t, appgo.Id(43), user)
+	assert.Equal(t, appgo.Role(appgo.RoleAppUser), role)
+}
+
+func TestJwtRS256(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	private := filepath.Join(dir, "private.pem")
+	public := filepath.Join(dir, "public.pem")
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	ioutil.WriteFile(private, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	ioutil.WriteFile(public, pem.EncodeToMemory(&pem.Block{
+		Type: "PUBLIC KEY", Bytes: pub}), 0600)
+
+	restore := withJwt("RS256", jwtKeyConf{Id: "rsa", KeyFile: private})
+	defer restore()
+	token := NewToken(42, appgo.RoleAppUser)
+	user, _ := token.Validate()
+	assert.Equal(t, appgo.Id(42), user)
+
+	// Verified by the public key only
+	appgo.Conf.Jwt.Keys[0].KeyFile = public
+	user, _ = token.Validate()
+	assert.Equal(t, appgo.Id(42), user)
+	assert.Equal(t, Token(""), NewToken(42, appgo.RoleAppUser))
+
+	// HS256 tokens are not accepted
+	withJwt("HS256", jwtKeyConf{Id: "rsa", Secret: "secret"})
+	hs := NewToken(42, appgo.RoleAppUser)
+	withJwt("RS256", jwtKeyConf{Id: "rsa", KeyFile: public})
+	user, _ = hs.Validate()
+	assert.Equal(t, appgo.Id(0), user)
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"sync"
+	"time"
+)
+
+const defaultRefreshLifetime = 30 * 24 * 3600
+
+var refreshTokenStore RefreshTokenStore
+
+// RefreshToken is a long-lived token traded for a new access token and a
+// new refresh token, after which it's used up. Tokens traded from the
+// same login are a family, which is revoked if a used one is traded again
+// as it might have been stolen.
+type RefreshToken struct {
+	// Hash of the token, which itself is not stored
+	Id      string
+	Family  string
+	UserId  appgo.Id
+	Role    appgo.Role
+	Expires time.Time
+	Used    bool
+}
+
+type RefreshTokenStore interface {
+	Save(rt *RefreshToken) error
+	// Use marks the token used, returning it as it was before, or nil
+	// if not found. It must be atomic for reuse to be detected.
+	Use(id string) (*RefreshToken, error)
+	RevokeFamily(family string) error
+}
+
+// TokenPair is the reply of a login or a refresh.
+type TokenPair struct {
+	AccessToken  Token  `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	// Seconds the access token lasts
+	ExpiresIn int `json:"expires_in"`
+}
+
+// SetRefreshTokenStore enables refresh tokens, issued along with access
+// tokens on login.
+func SetRefreshTokenStore(s RefreshTokenStore) {
+	refreshTokenStore = s
+}
+
+// IssueTokens issues an access token and a refresh token of a new family.
+func IssueTokens(userId appgo.Id, role appgo.Role) (*TokenPair, error) {
+	return issueTokens(userId, role, "")
+}
+
+// RefreshTokens trades refresh for new tokens. Trading a used one
+// revokes its family, both fail with UnauthorizedErr.
+func RefreshTokens(refresh string) (*TokenPair, error) {
+	if refreshTokenStore == nil {
+		return nil, appgo.UnauthorizedErr
+	}
+	rt, err := refreshTokenStore.Use(hashRefreshToken(refresh))
+	if err != nil {
+		return nil, err
+	}
+	if rt == nil {
+		return nil, appgo.UnauthorizedErr
+	}
+	// Before the expiry, as stolen ones may be reused after it
+	if rt.Used {
+		log.WithFields(log.Fields{
+			"user":   rt.UserId,
+			"family": rt.Family,
+		}).Warnln("Refresh token reused, revoking its family")
+		if err := refreshTokenStore.RevokeFamily(rt.Family); err != nil {
+			return nil, err
+		}
+		return nil, appgo.UnauthorizedErr
+	}
+	if !time.Now().Before(rt.Expires) {
+		return nil, appgo.UnauthorizedErr
+	}
+	return issueTokens(rt.UserId, rt.Role, rt.Family)
+}
+
+// RevokeRefreshToken revokes the family of refresh, e.g. on logout.
+func RevokeRefreshToken(refresh string) error {
+	if refreshTokenStore == nil {
+		return nil
+	}
+	rt, err := refreshTokenStore.Use(hashRefreshToken(refresh))
+	if err != nil || rt == nil {
+		return err
+	}
+	return refreshTokenStore.RevokeFamily(rt.Family)
+}
+
+func issueTokens(userId appgo.Id, role appgo.Role, family string) (*TokenPair, error) {
+	if refreshTokenStore == nil {
+		return nil, appgo.NewApiErr(appgo.ECodeInternal, "refresh tokens not supported")
+	}
+	access := NewToken(userId, role)
+	if access == "" {
+		return nil, appgo.InternalErr
+	}
+	refresh, err := newRefreshToken(userId, role, family)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    tokenLifetime(role),
+	}, nil
+}
+
+// newRefreshToken saves a refresh token of family, a new family if empty.
+func newRefreshToken(userId appgo.Id, role appgo.Role, family string) (string, error) {
+	refresh, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	if family == "" {
+		if family, err = randomToken(); err != nil {
+			return "", err
+		}
+	}
+	lifetime := appgo.Conf.TokenLifetime.Refresh
+	if lifetime <= 0 {
+		lifetime = defaultRefreshLifetime
+	}
+	err = refreshTokenStore.Save(&RefreshToken{
+		Id:      hashRefreshToken(refresh),
+		Family:  family,
+		UserId:  userId,
+		Role:    role,
+		Expires: time.Now().Add(time.Second * time.Duration(lifetime)),
+	})
+	if err != nil {
+		return "", err
+	}
+	return refresh, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashRefreshToken(refresh string) string {
+	sum := sha256.Sum256([]byte(refresh))
+	return hex.EncodeToString(sum[:])
+}
+
+// MemRefreshTokenStore keeps refresh tokens in memory, for tests and
+// single servers.
+type MemRefreshTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*RefreshToken
+	// Family => ids
+	families  map[string][]string
+	lastSweep time.Time
+}
+
+func NewMemRefreshTokenStore() *MemRefreshTokenStore {
+	return &MemRefreshTokenStore{
+		tokens:   make(map[string]*RefreshToken),
+		families: make(map[string][]string),
+	}
+}
+
+func (s *MemRefreshTokenStore) Save(rt *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	saved := *rt
+	s.tokens[rt.Id] = &saved
+	s.families[rt.Family] = append(s.families[rt.Family], rt.Id)
+	return nil
+}
+
+func (s *MemRefreshTokenStore) Use(id string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rt, ok := s.tokens[id]
+	if !ok {
+		return nil, nil
+	}
+	was := *rt
+	rt.Used = true
+	return &was, nil
+}
+
+func (s *MemRefreshTokenStore) RevokeFamily(family string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.families[family] {
+		delete(s.tokens, id)
+	}
+	delete(s.families, family)
+	return nil
+}
+
+// sweep drops the families whose tokens have all expired, at most once
+// an hour.
+func (s *MemRefreshTokenStore) sweep() {
+	now := time.Now()
+	if now.Sub(s.lastSweep) < time.Hour {
+		return
+	}
+	s.lastSweep = now
+	for family, ids := range s.families {
+		alive := false
+		for _, id := range ids {
+			if rt := s.tokens[id]; rt != nil && now.Before(rt.Expires) {
+				alive = true
+				break
+			}
+		}
+		if !alive {
+			for _, id := range ids {
+				delete(s.tokens, id)
+			}
+			delete(s.families, family)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokens(t *testing.T) {
+	defer withJwt("", jwtKeyConf{Id: "k1", Secret: "secret"})()
+	_, err := RefreshTokens("x")
+	assert.Equal(t, appgo.UnauthorizedErr, err)
+	SetRefreshTokenStore(NewMemRefreshTokenStore())
+	defer SetRefreshTokenStore(nil)
+
+	pair, err := IssueTokens(42, appgo.RoleAppUser)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 3600, pair.ExpiresIn)
+	user, _ := pair.AccessToken.Validate()
+	assert.Equal(t, appgo.Id(42), user)
+
+	// Rotated on use
+	next, err := RefreshTokens(pair.RefreshToken)
+	assert.NoError(t, err)
+	assert.NotEqual(t, pair.RefreshToken, next.RefreshToken)
+	user, role := next.AccessToken.Validate()
+	assert.Equal(t, appgo.Id(42), user)
+	assert.Equal(t, appgo.Role(appgo.RoleAppUser), role)
+
+	// Reused, the family is revoked
+	_, err = RefreshTokens(pair.RefreshToken)
+	assert.Equal(t, appgo.UnauthorizedErr, err)
+	_, err = RefreshTokens(next.RefreshToken)
+	assert.Equal(t, appgo.UnauthorizedErr, err)
+
+	// Others are not
+	other, _ := IssueTokens(42, appgo.RoleAppUser)
+	another, _ := IssueTokens(42, appgo.RoleAppUser)
+	assert.NoError(t, RevokeRefreshToken(other.RefreshToken))
+	_, err = RefreshTokens(other.RefreshToken)
+	assert.Equal(t, appgo.UnauthorizedErr, err)
+	_, err = RefreshTokens(another.RefreshToken)
+	assert.NoError(t, err)
+}
+
+func TestRefreshTokenReusedAfterExpiry(t *testing.T) {
+	defer withJwt("", jwtKeyConf{Id: "k1", Secret: "secret"})()
+	store := NewMemRefreshTokenStore()
+	SetRefreshTokenStore(store)
+	defer SetRefreshTokenStore(nil)
+
+	pair, err := IssueTokens(42, appgo.RoleAppUser)
+	if !assert.NoError(t, err) {
+		return
+	}
+	next, err := RefreshTokens(pair.RefreshToken)
+	assert.NoError(t, err)
+	store.tokens[hashRefreshToken(pair.RefreshToken)].Expires = time.Now().Add(-time.Second)
+
+	// Still revokes the family
+	_, err = RefreshTokens(pair.RefreshToken)
+	assert.Equal(t, appgo.UnauthorizedErr, err)
+	_, err = RefreshTokens(next.RefreshToken)
+	assert.Equal(t, appgo.UnauthorizedErr, err)
+}
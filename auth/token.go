@@ -12,7 +12,11 @@ import (
 
 type Token string
 
+// NewToken issues a token of the user, a JWT if Conf.Jwt.Enable.
 func NewToken(userId appgo.Id, role appgo.Role) Token {
+	if appgo.Conf.Jwt.Enable {
+		return NewJwtToken(userId, role)
+	}
 	lifetime := tokenLifetime(role)
 	key := appgo.Conf.RootKey
 	expires := appgo.Id(time.Now().Add(time.Second * time.Duration(lifetime)).UnixNano())
@@ -28,6 +32,9 @@ func NewToken(userId appgo.Id, role appgo.Role) Token {
 }
 
 func (t Token) Validate() (appgo.Id, appgo.Role) {
+	if t.isJwt() {
+		return t.validateJwt()
+	}
 	byteToken, err := base64.StdEncoding.DecodeString(string(t))
 	if err != nil {
 		log.Infoln("validate token failed: ", err)
@@ -64,6 +71,6 @@ func tokenLifetime(role appgo.Role) int {
 	case appgo.RoleWebAdmin:
 		return appgo.Conf.TokenLifetime.WebAdmin
 	default:
-		return 0
+		return appgo.Conf.TokenLifetime.Default
 	}
 }
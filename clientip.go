@@ -0,0 +1,65 @@
+package appgo
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the IP of the client, X-Forwarded-For and X-Real-IP
+// are only honored if sent by proxies in Conf.TrustedProxies. Of the
+// X-Forwarded-For hops, the client is the first untrusted one counting
+// from the nearest, so that hops forged by the client are skipped.
+func ClientIP(r *http.Request) string {
+	host := hostOf(r.RemoteAddr)
+	if !trustedProxy(host) {
+		return host
+	}
+	// Proxies may add a header line of their own rather than appending
+	// to that of the client, which then comes first
+	if xff := strings.Join(r.Header.Values("X-Forwarded-For"), ","); xff != "" {
+		// Each proxy appends the peer it got the request from
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := hostOf(strings.TrimSpace(hops[i]))
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			host = hop
+			if !trustedProxy(hop) {
+				break
+			}
+		}
+		return host
+	}
+	if ip := hostOf(strings.TrimSpace(r.Header.Get("X-Real-IP"))); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return host
+}
+
+// hostOf strips the port of addr if any, and the brackets of IPv6.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// trustedProxy tells if ip is in Conf.TrustedProxies, of IPs or CIDRs.
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, p := range Conf.TrustedProxies {
+		if strings.Contains(p, "/") {
+			if _, n, err := net.ParseCIDR(p); err == nil && n.Contains(parsed) {
+				return true
+			}
+		} else if other := net.ParseIP(p); other != nil && other.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
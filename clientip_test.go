@@ -0,0 +1,44 @@
+package appgo
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	Conf.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1"}
+	defer func() { Conf.TrustedProxies = nil }()
+	ip := func(remote, xff, realIP string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		if realIP != "" {
+			r.Header.Set("X-Real-IP", realIP)
+		}
+		return ClientIP(r)
+	}
+	// Direct clients
+	assert.Equal(t, "203.0.113.1", ip("203.0.113.1:80", "", ""))
+	assert.Equal(t, "2001:db8::9", ip("[2001:db8::9]:80", "", ""))
+	// Spoofed headers from untrusted peers
+	assert.Equal(t, "203.0.113.1", ip("203.0.113.1:80", "1.2.3.4", "1.2.3.4"))
+	// Behind trusted proxies
+	assert.Equal(t, "1.2.3.4", ip("10.0.0.1:80", "1.2.3.4", ""))
+	assert.Equal(t, "1.2.3.4", ip("10.0.0.1:80", "9.9.9.9, 1.2.3.4, 10.0.0.2", ""))
+	assert.Equal(t, "1.2.3.4", ip("10.0.0.1:80", "1.2.3.4:5678", ""))
+	assert.Equal(t, "1.2.3.4", ip("10.0.0.1:80", "", "1.2.3.4"))
+	assert.Equal(t, "2001:db8::2", ip("[2001:db8::1]:80", "2001:db8::2", ""))
+	assert.Equal(t, "2001:db8::2", ip("[2001:db8::1]:80", "[2001:db8::2]:443", ""))
+
+	// A forged line of the client, and the one added by the proxy
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:80"
+	r.Header.Add("X-Forwarded-For", "9.9.9.9")
+	r.Header.Add("X-Forwarded-For", "1.2.3.4")
+	assert.Equal(t, "1.2.3.4", ClientIP(r))
+	r.Header.Add("X-Forwarded-For", "10.0.0.2")
+	assert.Equal(t, "1.2.3.4", ClientIP(r))
+}
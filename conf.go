@@ -12,12 +12,28 @@ var (
 )
 
 var Conf struct {
-	DevMode      bool
-	LogLevel     log.Level
-	RootKey      string
-	TemplatePath string
-	CdnDomain    string
-	Pprof        struct {
+	DevMode         bool
+	AlwaysReturn200 bool
+	// Max bytes of request bodies, default 4MB if not set, unlimited if
+	// 0. Overridden by META tag maxBody
+	MaxBodyBytes *int64
+	// Also route APIs under /v{n} of their paths, which select the
+	// version as the version header does
+	PathVersioning bool
+	// Seconds API funcs may run before ECodeGatewayTimeout is replied,
+	// unlimited if 0. Overridden by META tag timeout
+	HandlerTimeout int
+	// Don't answer HEAD and OPTIONS of JSON APIs automatically
+	DisableAutoMethods bool
+	// Reject unknown fields in JSON bodies
+	StrictJSON bool
+	// IPs or CIDRs of proxies whose X-Forwarded-For is trusted
+	TrustedProxies []string
+	LogLevel       log.Level
+	RootKey        string
+	TemplatePath   string
+	CdnDomain      string
+	Pprof          struct {
 		Enable bool
 		Port   string
 	}
@@ -48,11 +64,34 @@ var Conf struct {
 		AllowedHeaders     string
 		OptionsPassthrough bool
 		Debug              bool
+		// Handle CORS in API handlers rather than the middleware,
+		// methods are those of the handlers if AllowedMethods is empty
+		Builtin bool
+		// Of builtin CORS, which then needs explicit AllowedOrigins
+		// rather than "*"
+		AllowCredentials bool
+		ExposedHeaders   string
+		// Seconds preflights can be cached for
+		MaxAge int
+	}
+	Auth struct {
+		// Headers to read the token from in order, e.g. Authorization
+		// with "Bearer " tokens, CustomTokenHeaderName if empty
+		TokenHeaders []string
+		// Cookie to read the token from when the header is absent,
+		// disabled if empty. Against CSRF, requests other than GET,
+		// HEAD and OPTIONS only use it if they are from the same origin
+		// or send X-Requested-With
+		CookieName string
 	}
 	TokenLifetime struct {
 		AppUser  int
 		WebUser  int
 		WebAdmin int
+		// Of the other roles
+		Default int
+		// Of refresh tokens, default 30 days
+		Refresh int
 	}
 	Weixin struct {
 		AppId  string
@@ -102,6 +141,212 @@ var Conf struct {
 	Prometheus struct {
 		Enable bool
 		Port   string
+		// Buckets of request latency in seconds, prometheus.DefBuckets
+		// if not set
+		LatencyBuckets []float64
+		// Also record the unlabeled request_duration_microseconds
+		// summary of older versions
+		LegacySummary bool
+	}
+	AccessLog struct {
+		// Log requests with logrus, unless server.SetAccessLogger is set
+		Enable bool
+		// Fraction of requests logged, 1 if 0. Replies of 5xx are always
+		// logged
+		SampleRate float64
+		// Query params whose values are not logged, default password,
+		// token, access_token and secret
+		RedactParams []string
+	}
+	Batch struct {
+		// Max sub-requests of a batch, default 20
+		MaxSize int
+	}
+	Canary struct {
+		// Version to route canary requests to, disabled if 0
+		Version int
+		// Percentage of users in the canary
+		Percent int
+		// Header with which admins force the canary version
+		Header string
+	}
+	Compression struct {
+		Enable bool
+		// Replies shorter than this are not compressed, default 1024
+		MinLength int
+		// Encodings in order of preference, of "br", "gzip" and
+		// "deflate", default all of them in this order
+		Encodings []string
+		// Prefixes of content types to compress, e.g. "application/json"
+		// or "text/", default all but those compressed already
+		Types []string
+	}
+	ContentNegotiation struct {
+		// Reply XML, or the media types of server.RegisterCodec, to
+		// clients preferring them in Accept
+		Enable bool
+	}
+	Deprecation struct {
+		// Reply ECodeGone once the sunset date of an API has passed
+		EnforceSunset bool
+	}
+	Health struct {
+		// Paths of the probes, /healthz and /readyz if not set
+		LivenessPath  string
+		ReadinessPath string
+		// Seconds to wait for readiness checks, default 5
+		Timeout int
+	}
+	HttpServer struct {
+		// Seconds to read the headers of a request, against slow
+		// clients holding connections, default 10, negative for none
+		ReadHeaderTimeout int
+		// Seconds to read a whole request and to write its reply, none
+		// if 0. Streams are cut by WriteTimeout
+		ReadTimeout  int
+		WriteTimeout int
+		// Seconds keep-alive connections may stay idle, default 120
+		IdleTimeout int
+		// Max bytes of request headers, default 1MB
+		MaxHeaderBytes int
+	}
+	Jwt struct {
+		// Issue JWTs by auth.NewToken rather than encrypted tokens,
+		// both are accepted once Keys are set
+		Enable bool
+		// "HS256"(default) or "RS256"
+		Algorithm string
+		// Tokens are verified by the key of their "kid", so keys can
+		// be rotated by adding the new one before signing with it
+		Keys []struct {
+			Id string
+			// Of HS256
+			Secret string
+			// PEM file of RS256, a private key to sign, or a public
+			// key to only verify
+			KeyFile string
+		}
+		// Id of the key to sign with, the first one if empty
+		SigningKey string
+		// "iss" of the tokens, checked if set
+		Issuer string
+		// Seconds an expired token can still be refreshed within
+		RefreshWindow int
+	}
+	Multipart struct {
+		// Memory used by ParseMultipartForm before spilling files
+		// to disk, default 32MB
+		MaxMemory int64
+		// Max bytes of each uploaded file, unlimited if 0
+		MaxFileSize int64
+	}
+	Pagination struct {
+		// Defaults of per_page and its max, 20 and 100 if not set
+		PerPage    int
+		MaxPerPage int
+		// Reply an error rather than clamping per_page to the max
+		RejectOverMax bool
+	}
+	Permissions struct {
+		// Permissions of roles by the names of `requireRole`, e.g.
+		// "article:write" or "article:*", see appgo.SetRolePermissions
+		Roles []struct {
+			Role  string
+			Perms []string
+		}
+	}
+	RateLimit struct {
+		// Requests per second of each client for the built-in limiter,
+		// disabled if 0 or a limiter is set by server.SetRateLimiter
+		Rate  float64
+		Burst int
+		// Buckets of the built-in limiters in "memory"(default), or in
+		// "redis" of Conf.Redis to be shared by servers
+		Store string
+		// Key of buckets, "user"(default) by the user if authenticated
+		// or else the IP, "ip", or "route" shared by all clients
+		KeyBy string
+		// "seconds"(default) or "http-date"
+		RetryAfterFormat string
+		// Send the quota status in headers, named X-RateLimit-Limit,
+		// X-RateLimit-Remaining and X-RateLimit-Reset unless set
+		Headers         bool
+		LimitHeader     string
+		RemainingHeader string
+		ResetHeader     string
+	}
+	RequestId struct {
+		// Header of the request id, default X-Request-ID
+		Header string
+	}
+	RequestTimeout struct {
+		// Header of the milliseconds the client waits for, e.g.
+		// X-Timeout-Ms, which shortens the timeout of the call
+		Header string
+		// Max of the header in milliseconds, default 60000
+		Max int
+	}
+	ServiceAuth struct {
+		// Header of service tokens, default X-Service-Token
+		Header string
+		// Tokens accepted, disabled if empty and no verifier is set by
+		// server.SetServiceTokenVerifier
+		Secrets []string
+		// User of the service calls, ServiceUserId if 0
+		UserId int64
+	}
+	Shutdown struct {
+		// Don't shut down gracefully on SIGTERM and SIGINT
+		DisableSignals bool
+		// Seconds to wait for in-flight requests, default 30
+		Timeout int
+	}
+	Sse struct {
+		// Seconds between heartbeats of idle streams, default 15, disabled
+		// if negative
+		Heartbeat int
+	}
+	TokenStore struct {
+		// "memory"(default), "redis" of Conf.Redis, or "sql", of
+		// server.NewConfTokenStore
+		Backend string
+		// Seconds tokens last unless refreshed, default 30 days
+		Ttl int
+		// Max tokens in memory, the oldest ones are evicted beyond,
+		// unlimited if 0
+		MaxTokens int
+		// Of "sql", default appgo_tokens
+		Table string
+	}
+	Trace struct {
+		// Headers to read the trace from, "w3c"(default), "b3" or
+		// "custom" which uses the headers below
+		Format        string
+		TraceIdHeader string
+		SpanIdHeader  string
+		SampledHeader string
+		Otel          struct {
+			// Record an OpenTelemetry span of each request, with the
+			// global TracerProvider, see server.SetupTracing
+			Enable      bool
+			ServiceName string
+			// Fraction of new traces sampled, 1 if 0. Sampled parents are
+			// always followed
+			SampleRatio float64
+		}
+	}
+	Validation struct {
+		// Validate inputs with `validate` tags before calling API funcs
+		Enable bool
+	}
+	WebSocket struct {
+		// Origins allowed to connect besides the host itself, "*" for any
+		AllowedOrigins []string
+		// Seconds between pings, default 30. Connections not answering
+		// in two pings are closed
+		PingInterval int
+		// Max bytes of received messages, default 64KB
+		MaxMessageSize int64
 	}
 }
 
@@ -0,0 +1,91 @@
+package appgo
+
+import (
+	"context"
+)
+
+type contextKey int
+
+const (
+	requestIdKey contextKey = iota
+	traceKey
+	txKey
+	versionKey
+	userKey
+	roleKey
+)
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey, id)
+}
+
+// RequestIDFromContext returns the id of the request being served, or
+// an empty string if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey).(string)
+	return id
+}
+
+// TraceContext is the trace the request being served is part of.
+type TraceContext struct {
+	TraceId string
+	SpanId  string
+	Sampled bool
+}
+
+func WithTrace(ctx context.Context, tc *TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey, tc)
+}
+
+// TraceFromContext returns nil if the request carries no trace.
+func TraceFromContext(ctx context.Context) *TraceContext {
+	tc, _ := ctx.Value(traceKey).(*TraceContext)
+	return tc
+}
+
+// Tx is a transaction opened for the request being served, see
+// server.SetTxManager.
+type Tx interface {
+	Commit() error
+	Rollback() error
+}
+
+func WithTx(ctx context.Context, tx Tx) context.Context {
+	return context.WithValue(ctx, txKey, tx)
+}
+
+// TxFromContext returns nil if no transaction is opened for the request.
+func TxFromContext(ctx context.Context) Tx {
+	tx, _ := ctx.Value(txKey).(Tx)
+	return tx
+}
+
+func WithVersion(ctx context.Context, ver int) context.Context {
+	return context.WithValue(ctx, versionKey, ver)
+}
+
+// VersionFromContext returns the API version the request is served by,
+// or 0 if there is none.
+func VersionFromContext(ctx context.Context) int {
+	ver, _ := ctx.Value(versionKey).(int)
+	return ver
+}
+
+func WithUser(ctx context.Context, user Id, role Role) context.Context {
+	return context.WithValue(context.WithValue(ctx, userKey, user), roleKey, role)
+}
+
+// UserIDFromContext returns the user authenticated for the request, or 0
+// if the API func doesn't require one or allows anonymous callers and
+// none is authenticated.
+func UserIDFromContext(ctx context.Context) Id {
+	user, _ := ctx.Value(userKey).(Id)
+	return user
+}
+
+// RoleFromContext returns the role of the user authenticated for the
+// request, or 0.
+func RoleFromContext(ctx context.Context) Role {
+	role, _ := ctx.Value(roleKey).(Role)
+	return role
+}
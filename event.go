@@ -0,0 +1,14 @@
+package appgo
+
+// EventSink sends Server-Sent Events to the client of an SSE API.
+type EventSink interface {
+	// Send sends an event, data other than strings is sent as JSON.
+	// It fails once the client has gone.
+	Send(event string, data interface{}) error
+	// SendId sends an event with an id, which a reconnecting client
+	// sends back as Last-Event-ID.
+	SendId(id, event string, data interface{}) error
+	// LastEventId is the id of the last event the client has seen, to
+	// resume a stream from. Empty on the first connection.
+	LastEventId() string
+}
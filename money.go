@@ -0,0 +1,216 @@
+package appgo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrCurrencyMismatch = errors.New("money: currency mismatch")
+	ErrBadCurrency      = errors.New("money: unknown currency")
+	ErrBadAmount        = errors.New("money: bad amount")
+	ErrMoneyOverflow    = errors.New("money: amount overflow")
+)
+
+// ISO 4217 currency code => digits of the minor unit
+var currencies = map[string]int{
+	"AED": 2, "ARS": 2, "AUD": 2, "BRL": 2, "CAD": 2, "CHF": 2,
+	"CLP": 0, "CNY": 2, "COP": 2, "CZK": 2, "DKK": 2, "EGP": 2,
+	"EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2,
+	"INR": 2, "ISK": 0, "JPY": 0, "KRW": 0, "KWD": 3, "MOP": 2,
+	"MXN": 2, "MYR": 2, "NOK": 2, "NZD": 2, "PHP": 2, "PKR": 2,
+	"PLN": 2, "RUB": 2, "SAR": 2, "SEK": 2, "SGD": 2, "THB": 2,
+	"TRY": 2, "TWD": 2, "UAH": 2, "USD": 2, "VND": 0, "ZAR": 2,
+}
+
+// Money is an amount in the minor unit (e.g. cents) of a currency,
+// it's serialized as {"amount":"12.34","currency":"USD"} to avoid floats.
+// The zero Money, of no currency, is serialized as null.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// Currency codes are case-insensitive, and kept in upper case
+func normCurrency(code string) string {
+	return strings.ToUpper(code)
+}
+
+func RegisterCurrency(code string, digits int) {
+	currencies[normCurrency(code)] = digits
+}
+
+func ValidCurrency(code string) bool {
+	_, ok := currencies[normCurrency(code)]
+	return ok
+}
+
+func NewMoney(amount int64, currency string) (Money, error) {
+	if !ValidCurrency(currency) {
+		return Money{}, ErrBadCurrency
+	}
+	return Money{amount, normCurrency(currency)}, nil
+}
+
+// ParseMoney parses a decimal amount like "12.34", more fractional digits
+// than the currency has are rejected rather than rounded.
+func ParseMoney(amount, currency string) (Money, error) {
+	currency = normCurrency(currency)
+	digits, ok := currencies[currency]
+	if !ok {
+		return Money{}, ErrBadCurrency
+	}
+	neg := strings.HasPrefix(amount, "-")
+	amount = strings.TrimPrefix(amount, "-")
+	intPart, fracPart := amount, ""
+	if i := strings.IndexByte(amount, '.'); i >= 0 {
+		intPart, fracPart = amount[:i], amount[i+1:]
+	}
+	if intPart == "" || len(fracPart) > digits ||
+		strings.ContainsAny(intPart+fracPart, "+-") {
+		return Money{}, ErrBadAmount
+	}
+	fracPart += strings.Repeat("0", digits-len(fracPart))
+	val, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if err != nil {
+		return Money{}, ErrBadAmount
+	}
+	if neg {
+		val = -val
+	}
+	return Money{val, currency}, nil
+}
+
+// Decimal returns the amount as a decimal string like "12.34".
+func (m Money) Decimal() string {
+	digits := currencies[m.Currency]
+	s := strconv.FormatInt(m.Amount, 10)
+	neg := m.Amount < 0
+	if neg {
+		s = s[1:]
+	}
+	if digits > 0 {
+		if len(s) <= digits {
+			s = strings.Repeat("0", digits-len(s)+1) + s
+		}
+		s = s[:len(s)-digits] + "." + s[len(s)-digits:]
+	}
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	if (o.Amount > 0 && m.Amount > math.MaxInt64-o.Amount) ||
+		(o.Amount < 0 && m.Amount < math.MinInt64-o.Amount) {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{m.Amount + o.Amount, m.Currency}, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	if (o.Amount < 0 && m.Amount > math.MaxInt64+o.Amount) ||
+		(o.Amount > 0 && m.Amount < math.MinInt64+o.Amount) {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{m.Amount - o.Amount, m.Currency}, nil
+}
+
+func (m Money) Mul(n int64) (Money, error) {
+	p := m.Amount * n
+	if m.Amount != 0 && (p/m.Amount != n || (m.Amount == -1 && n == math.MinInt64)) {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{p, m.Currency}, nil
+}
+
+func (m Money) Neg() Money {
+	return Money{-m.Amount, m.Currency}
+}
+
+// Cmp returns -1, 0 or 1 comparing m to o.
+func (m Money) Cmp(o Money) (int, error) {
+	if m.Currency != o.Currency {
+		return 0, ErrCurrencyMismatch
+	}
+	if m.Amount < o.Amount {
+		return -1, nil
+	} else if m.Amount > o.Amount {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+type moneyJSON struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	if m == (Money{}) {
+		return []byte("null"), nil
+	}
+	return json.Marshal(moneyJSON{m.Decimal(), m.Currency})
+}
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*m = Money{}
+		return nil
+	}
+	var v moneyJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	parsed, err := ParseMoney(v.Amount, v.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// MarshalText/UnmarshalText use the "12.34 USD" form, which is how Money
+// is passed in query params. The zero Money is empty.
+func (m Money) MarshalText() ([]byte, error) {
+	if m == (Money{}) {
+		return nil, nil
+	}
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*m = Money{}
+		return nil
+	}
+	parts := strings.Fields(string(b))
+	if len(parts) != 2 {
+		return fmt.Errorf("money: bad format %q", string(b))
+	}
+	parsed, err := ParseMoney(parts[0], parts[1])
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,155 @@
+package appgo
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount   string
+		currency string
+		want     Money
+		err      error
+	}{
+		{"12.34", "USD", Money{1234, "USD"}, nil},
+		{"12.3", "usd", Money{1230, "USD"}, nil},
+		{"12", "USD", Money{1200, "USD"}, nil},
+		{"-0.05", "EUR", Money{-5, "EUR"}, nil},
+		{"1000", "JPY", Money{1000, "JPY"}, nil},
+		{"1.234", "KWD", Money{1234, "KWD"}, nil},
+		{"1.234", "USD", Money{}, ErrBadAmount},
+		{"1.5", "JPY", Money{}, ErrBadAmount},
+		{".5", "USD", Money{}, ErrBadAmount},
+		{"", "USD", Money{}, ErrBadAmount},
+		{"-", "USD", Money{}, ErrBadAmount},
+		{"--1", "USD", Money{}, ErrBadAmount},
+		{"+1", "USD", Money{}, ErrBadAmount},
+		{"1.-5", "USD", Money{}, ErrBadAmount},
+		{"1e5", "USD", Money{}, ErrBadAmount},
+		{"99999999999999999999", "USD", Money{}, ErrBadAmount},
+		{"1", "XXX", Money{}, ErrBadCurrency},
+	}
+	for _, tt := range tests {
+		m, err := ParseMoney(tt.amount, tt.currency)
+		assert.Equal(t, tt.err, err, tt.amount)
+		assert.Equal(t, tt.want, m, tt.amount)
+	}
+}
+
+func TestMoneyDecimal(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{Money{1234, "USD"}, "12.34"},
+		{Money{-1234, "USD"}, "-12.34"},
+		{Money{5, "USD"}, "0.05"},
+		{Money{-5, "USD"}, "-0.05"},
+		{Money{0, "USD"}, "0.00"},
+		{Money{7, "KWD"}, "0.007"},
+		{Money{-1000, "JPY"}, "-1000"},
+		{Money{math.MinInt64, "USD"}, "-92233720368547758.08"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.m.Decimal())
+	}
+}
+
+func TestMoneyCurrencyCase(t *testing.T) {
+	m, err := NewMoney(100, "usd")
+	assert.Nil(t, err)
+	assert.Equal(t, Money{100, "USD"}, m)
+	assert.True(t, ValidCurrency("Eur"))
+	_, err = NewMoney(100, "xxx")
+	assert.Equal(t, ErrBadCurrency, err)
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	usd, eur := Money{100, "USD"}, Money{100, "EUR"}
+	max, min := Money{math.MaxInt64, "USD"}, Money{math.MinInt64, "USD"}
+	one := Money{1, "USD"}
+	tests := []struct {
+		name string
+		op   func() (Money, error)
+		want Money
+		err  error
+	}{
+		{"add", func() (Money, error) { return usd.Add(usd) }, Money{200, "USD"}, nil},
+		{"sub", func() (Money, error) { return usd.Sub(Money{150, "USD"}) }, Money{-50, "USD"}, nil},
+		{"mul", func() (Money, error) { return usd.Mul(-3) }, Money{-300, "USD"}, nil},
+		{"add mismatch", func() (Money, error) { return usd.Add(eur) }, Money{}, ErrCurrencyMismatch},
+		{"sub mismatch", func() (Money, error) { return usd.Sub(eur) }, Money{}, ErrCurrencyMismatch},
+		{"add overflow", func() (Money, error) { return max.Add(one) }, Money{}, ErrMoneyOverflow},
+		{"add underflow", func() (Money, error) { return min.Add(one.Neg()) }, Money{}, ErrMoneyOverflow},
+		{"sub overflow", func() (Money, error) { return max.Sub(one.Neg()) }, Money{}, ErrMoneyOverflow},
+		{"sub underflow", func() (Money, error) { return min.Sub(one) }, Money{}, ErrMoneyOverflow},
+		{"sub near max", func() (Money, error) { return max.Sub(one) }, Money{math.MaxInt64 - 1, "USD"}, nil},
+		{"mul overflow", func() (Money, error) { return max.Mul(2) }, Money{}, ErrMoneyOverflow},
+		{"mul min", func() (Money, error) { return min.Mul(-1) }, Money{}, ErrMoneyOverflow},
+		{"mul by min", func() (Money, error) { return one.Neg().Mul(math.MinInt64) }, Money{}, ErrMoneyOverflow},
+		{"mul zero", func() (Money, error) { return Money{0, "USD"}.Mul(math.MinInt64) }, Money{0, "USD"}, nil},
+	}
+	for _, tt := range tests {
+		m, err := tt.op()
+		assert.Equal(t, tt.err, err, tt.name)
+		assert.Equal(t, tt.want, m, tt.name)
+	}
+
+	for _, tt := range []struct {
+		o    Money
+		want int
+	}{{Money{99, "USD"}, 1}, {usd, 0}, {Money{101, "USD"}, -1}} {
+		c, err := usd.Cmp(tt.o)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.want, c, tt.o.String())
+	}
+	_, err := usd.Cmp(eur)
+	assert.Equal(t, ErrCurrencyMismatch, err)
+}
+
+func TestMoneyJSON(t *testing.T) {
+	type order struct {
+		Price Money  `json:"price"`
+		Tip   *Money `json:"tip"`
+	}
+	tests := []struct {
+		in   order
+		want string
+	}{
+		{order{Price: Money{1234, "USD"}}, `{"price":{"amount":"12.34","currency":"USD"},"tip":null}`},
+		{order{Price: Money{-5, "KWD"}, Tip: &Money{1, "KWD"}},
+			`{"price":{"amount":"-0.005","currency":"KWD"},"tip":{"amount":"0.001","currency":"KWD"}}`},
+		{order{}, `{"price":null,"tip":null}`},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(tt.in)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.want, string(b))
+		var out order
+		assert.Nil(t, json.Unmarshal(b, &out))
+		assert.Equal(t, tt.in, out)
+	}
+
+	var m Money
+	assert.Equal(t, ErrBadAmount, json.Unmarshal([]byte(`{"amount":"1.234","currency":"USD"}`), &m))
+	assert.Equal(t, ErrBadCurrency, json.Unmarshal([]byte(`{"amount":"1","currency":""}`), &m))
+}
+
+func TestMoneyText(t *testing.T) {
+	for _, m := range []Money{{1234, "USD"}, {-5, "USD"}, {1000, "JPY"}, {}} {
+		b, err := m.MarshalText()
+		assert.Nil(t, err)
+		var out Money
+		assert.Nil(t, out.UnmarshalText(b), string(b))
+		assert.Equal(t, m, out)
+	}
+	var m Money
+	assert.Nil(t, m.UnmarshalText([]byte("12.34 usd")))
+	assert.Equal(t, Money{1234, "USD"}, m)
+	for _, s := range []string{"12.34", "12.34 USD extra", "12.345 USD", "1 XXX"} {
+		assert.NotNil(t, m.UnmarshalText([]byte(s)), s)
+	}
+}
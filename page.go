@@ -0,0 +1,29 @@
+package appgo
+
+// Page is the reply envelope of a page of a list
+type Page struct {
+	Items   interface{} `json:"items"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Total   int64       `json:"total"`
+	HasMore bool        `json:"has_more"`
+}
+
+// NewPage wraps items of the page, total is the count of all the items.
+func NewPage(items interface{}, page, perPage int, total int64) *Page {
+	return &Page{
+		Items:   items,
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+		HasMore: int64(page)*int64(perPage) < total,
+	}
+}
+
+// Offset returns the count of items before the page, for SQL OFFSET.
+func Offset(page, perPage int) int {
+	if page < 1 {
+		return 0
+	}
+	return (page - 1) * perPage
+}
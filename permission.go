@@ -0,0 +1,64 @@
+package appgo
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Set by SetRolePermissions, see rolePermissions
+var (
+	rolePermsMu sync.RWMutex
+	rolePerms   = make(map[Role][]string)
+)
+
+// SetRolePermissions sets the permissions of role, e.g. loaded from a DB,
+// overriding Conf.Permissions, or back to it if perms is nil. It's safe to
+// call while serving, to reload them.
+func SetRolePermissions(role Role, perms []string) {
+	rolePermsMu.Lock()
+	defer rolePermsMu.Unlock()
+	if perms == nil {
+		delete(rolePerms, role)
+	} else {
+		rolePerms[role] = perms
+	}
+}
+
+// RoleHasPermission tells if role is granted perm like "article:write",
+// by the same permission or a wildcard like "article:*" or "*".
+func RoleHasPermission(role Role, perm string) bool {
+	for _, grant := range rolePermissions(role) {
+		if grant == "*" || grant == perm ||
+			strings.HasSuffix(grant, ":*") && strings.HasPrefix(perm, grant[:len(grant)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission tells if the role of the request of ctx is granted perm.
+func HasPermission(ctx context.Context, perm string) bool {
+	return RoleHasPermission(RoleFromContext(ctx), perm)
+}
+
+// rolePermissions returns those set by SetRolePermissions, or else those
+// of Conf.Permissions. RoleWebAdmin has all unless either sets it.
+func rolePermissions(role Role) []string {
+	rolePermsMu.RLock()
+	perms, ok := rolePerms[role]
+	rolePermsMu.RUnlock()
+	if ok {
+		return perms
+	}
+	// By names, as roles may be registered after the config is loaded
+	for _, rc := range Conf.Permissions.Roles {
+		if r, ok := RoleByName(rc.Role); ok && r == role {
+			return rc.Perms
+		}
+	}
+	if role == RoleWebAdmin {
+		return []string{"*"}
+	}
+	return nil
+}
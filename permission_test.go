@@ -0,0 +1,23 @@
+package appgo
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRoleHasPermission(t *testing.T) {
+	const role Role = 90
+	defer SetRolePermissions(role, nil)
+	assert.False(t, RoleHasPermission(role, "article:write"))
+	assert.True(t, RoleHasPermission(RoleWebAdmin, "article:write"))
+
+	SetRolePermissions(role, []string{"article:*", "user:read"})
+	assert.True(t, RoleHasPermission(role, "article:write"))
+	assert.True(t, RoleHasPermission(role, "article:publish"))
+	assert.True(t, RoleHasPermission(role, "user:read"))
+	assert.False(t, RoleHasPermission(role, "user:write"))
+	assert.False(t, RoleHasPermission(role, "articles:write"))
+
+	SetRolePermissions(role, []string{"*"})
+	assert.True(t, RoleHasPermission(role, "user:write"))
+}
@@ -43,6 +43,12 @@ func Do(cmd string, args ...interface{}) (reply interface{}, err error) {
 	return conn.Do(cmd, args...)
 }
 
+// Ping checks the connection to redis.
+func Ping() error {
+	_, err := Do("PING")
+	return err
+}
+
 func BeginTrans() *Trans {
 	conn := pool.Get()
 	conn.Send("MULTI")
@@ -0,0 +1,80 @@
+package appgo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+)
+
+// Precompressed is a reply compressed ahead of time, e.g. a cached config
+// blob. It's sent as is to clients accepting Encoding, and decompressed
+// for the others.
+type Precompressed struct {
+	Data []byte
+	// "br", "gzip" or "deflate"
+	Encoding string
+	// Defaults to JSON
+	ContentType string
+}
+
+// GzipJSON encodes v as JSON and gzips it, the result is meant to be
+// computed once and returned for many requests.
+func GzipJSON(v interface{}) (*Precompressed, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	gw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if _, err := gw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return &Precompressed{
+		Data:        buf.Bytes(),
+		Encoding:    "gzip",
+		ContentType: "application/json; charset=UTF-8",
+	}, nil
+}
+
+// Envelope wraps successful replies the way ApiError does errors.
+type Envelope struct {
+	Code ErrCode     `json:"errcode" xml:"errcode"`
+	Data interface{} `json:"data" xml:"data"`
+}
+
+// StreamResponse is a reply streamed to the client as Body is read, e.g.
+// a large export. Body is closed after if it's an io.Closer. API funcs
+// may return an io.Reader as well, which is sent as
+// application/octet-stream.
+type StreamResponse struct {
+	// Defaults to application/octet-stream
+	ContentType string
+	Body        io.Reader
+	// Bytes of Body, sent as Content-Length if known(> 0)
+	Size int64
+	// Sent as an attachment of the name if set, e.g. "export.csv"
+	Filename string
+}
+
+// Created is returned by API funcs having created a resource, Body is
+// replied as usual but with status 201 and the Location header.
+type Created struct {
+	// URL of the resource created
+	Location string
+	Body     interface{}
+}
+
+// NoContent is returned by API funcs to reply 204 with an empty body,
+// funcs returning only an error do so with META tag `noContent:"true"`.
+type NoContent struct{}
+
+// StatusReply is returned by API funcs to reply Body with a status other
+// than 200, e.g. as the data of an HTML func.
+type StatusReply struct {
+	Status int
+	Body   interface{}
+}
@@ -0,0 +1,21 @@
+package appgo
+
+// Names of roles used in `requireRole` and `visibility` tags
+var roleNames = map[string]Role{
+	"appUser":  RoleAppUser,
+	"webUser":  RoleWebUser,
+	"webAdmin": RoleWebAdmin,
+	"admin":    RoleWebAdmin,
+	"service":  RoleService,
+}
+
+// RegisterRole names a role for `requireRole` and `visibility` tags, it should be called
+// before the APIs using it are added.
+func RegisterRole(name string, role Role) {
+	roleNames[name] = role
+}
+
+func RoleByName(name string) (Role, bool) {
+	role, ok := roleNames[name]
+	return role, ok
+}
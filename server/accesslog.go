@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type AccessLogEntry struct {
+	Method string
+	// With the query, whose sensitive params are redacted
+	Path string
+	// Path template of the route, e.g. /users/{id}
+	Route   string
+	Version int
+	Status  int
+	// Code of the ApiError replied, ECodeOK if none
+	ErrCode   appgo.ErrCode
+	Duration  time.Duration
+	UserId    appgo.Id
+	RequestId string
+	RemoteIp  string
+	UserAgent string
+}
+
+var accessLogger func(AccessLogEntry)
+
+// SetAccessLogger sets the sink of access logs, which is called after
+// each request served by API handlers.
+func SetAccessLogger(l func(AccessLogEntry)) {
+	accessLogger = l
+}
+
+// accessWriter records the status, the ApiError code and the size of
+// the reply.
+type accessWriter struct {
+	http.ResponseWriter
+	status  int
+	errCode appgo.ErrCode
+	// Bytes of the body written
+	size int64
+	// Copy of the body if not nil, see idempotentReq
+	capture *bytes.Buffer
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	if w.capture != nil {
+		w.capture.Write(b[:n])
+	}
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket APIs take over the connection.
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// setErrCode is called by renderError with the code being replied.
+func setErrCode(w http.ResponseWriter, code appgo.ErrCode) {
+	if aw, ok := w.(*accessWriter); ok {
+		aw.errCode = code
+	}
+}
+
+func logAccess(r *http.Request, w *accessWriter, ver int, user appgo.Id,
+	begin time.Time) {
+	logger := accessLogger
+	if logger == nil && appgo.Conf.AccessLog.Enable {
+		logger = logrusAccess(r)
+	}
+	if logger == nil {
+		return
+	}
+	if ver < 1 {
+		ver = 1
+	}
+	code := w.errCode
+	if code == 0 {
+		code = appgo.ECodeOK
+	}
+	logger(AccessLogEntry{
+		Method:    r.Method,
+		Path:      redactedPath(r.URL),
+		Route:     routeOf(r),
+		Version:   ver,
+		Status:    w.status,
+		ErrCode:   code,
+		Duration:  time.Since(begin),
+		UserId:    user,
+		RequestId: appgo.RequestIDFromContext(r.Context()),
+		RemoteIp:  appgo.ClientIP(r),
+		UserAgent: r.UserAgent(),
+	})
+}
+
+var defaultRedactParams = []string{"password", "token", "access_token", "secret"}
+
+// redactedPath returns the path and query of u, values of the params of
+// Conf.AccessLog.RedactParams replaced.
+func redactedPath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	redact := appgo.Conf.AccessLog.RedactParams
+	if len(redact) == 0 {
+		redact = defaultRedactParams
+	}
+	query := u.Query()
+	for key, vals := range query {
+		for _, p := range redact {
+			if strings.EqualFold(key, p) {
+				for i := range vals {
+					vals[i] = "REDACTED"
+				}
+			}
+		}
+	}
+	return u.Path + "?" + query.Encode()
+}
+
+// logrusAccess returns the logger of Conf.AccessLog, sampled by its
+// SampleRate.
+func logrusAccess(r *http.Request) func(AccessLogEntry) {
+	return func(e AccessLogEntry) {
+		rate := appgo.Conf.AccessLog.SampleRate
+		if rate > 0 && e.Status < 500 && rand.Float64() >= rate {
+			return
+		}
+		logEntry(r).WithFields(log.Fields{
+			"method":     e.Method,
+			"path":       e.Path,
+			"route":      e.Route,
+			"version":    e.Version,
+			"status":     e.Status,
+			"errcode":    e.ErrCode,
+			"latency_ms": float64(e.Duration) / float64(time.Millisecond),
+			"user":       e.UserId,
+			"remote_ip":  e.RemoteIp,
+			"user_agent": e.UserAgent,
+		}).Info("access")
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type itemApi struct {
+	META struct{} `path:"/items/{id}"`
+}
+
+func (itemApi) GET(in *userInput) (appgo.Id, error) {
+	return appgo.Id(in.ResourceId__), nil
+}
+
+func (itemApi) DELETE(in *userInput) error {
+	return appgo.NewApiErr(appgo.ECodeForbidden, "nope")
+}
+
+func (itemApi) PUT(in *userInput) error {
+	return appgo.NewApiErr(appgo.ECodeInternal, "down")
+}
+
+func TestAccessLog(t *testing.T) {
+	defer withTestTokens()()
+	var entries []AccessLogEntry
+	SetAccessLogger(func(e AccessLogEntry) {
+		entries = append(entries, e)
+	})
+	defer SetAccessLogger(nil)
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&itemApi{}, &meApi{}})
+
+	r := httptest.NewRequest("GET", "/api/items/7", nil)
+	r.Header.Set("X-Request-ID", "req-1")
+	serveTest(s, r)
+	r = httptest.NewRequest("DELETE", "/api/items/7", nil)
+	serveTest(s, r)
+	r = httptest.NewRequest("GET", "/api/me", nil)
+	r.Header.Set(appgo.CustomTokenHeaderName, string(newTestToken(42)))
+	serveTest(s, r)
+
+	assert.Len(t, entries, 3)
+	e := entries[0]
+	assert.Equal(t, "GET", e.Method)
+	assert.Equal(t, "/api/items/{id}", e.Route)
+	assert.Equal(t, 1, e.Version)
+	assert.Equal(t, http.StatusOK, e.Status)
+	assert.Equal(t, appgo.ECodeOK, e.ErrCode)
+	assert.Equal(t, "req-1", e.RequestId)
+	assert.True(t, e.Duration > 0)
+
+	e = entries[1]
+	assert.Equal(t, "DELETE", e.Method)
+	assert.Equal(t, http.StatusForbidden, e.Status)
+	assert.Equal(t, appgo.ErrCode(appgo.ECodeForbidden), e.ErrCode)
+	assert.NotEmpty(t, e.RequestId)
+
+	assert.Equal(t, appgo.Id(42), entries[2].UserId)
+}
+
+// accessHook keeps the access logs of logrus
+type accessHook struct {
+	mu      sync.Mutex
+	entries []*log.Entry
+}
+
+func (h *accessHook) Levels() []log.Level {
+	return []log.Level{log.InfoLevel}
+}
+
+func (h *accessHook) Fire(e *log.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e.Message == "access" {
+		h.entries = append(h.entries, e)
+	}
+	return nil
+}
+
+func TestLogrusAccessLog(t *testing.T) {
+	hook := &accessHook{}
+	log.AddHook(hook)
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.InfoLevel)
+	appgo.Conf.AccessLog.Enable = true
+	defer func() { appgo.Conf.AccessLog.Enable = false }()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&itemApi{}})
+	accessLogs := func() []*log.Entry {
+		hook.mu.Lock()
+		defer hook.mu.Unlock()
+		entries := hook.entries
+		hook.entries = nil
+		return entries
+	}
+
+	r := httptest.NewRequest("GET", "/api/items/7?token=abc&page=2", nil)
+	r.Header.Set("X-Request-ID", "req-2")
+	r.Header.Set("User-Agent", "tests")
+	serveTest(s, r)
+	entries := accessLogs()
+	if assert.Len(t, entries, 1) {
+		e := entries[0].Data
+		assert.Equal(t, "/api/items/7?page=2&token=REDACTED", e["path"])
+		assert.Equal(t, "/api/items/{id}", e["route"])
+		assert.Equal(t, http.StatusOK, e["status"])
+		assert.Equal(t, "req-2", e["request_id"])
+		assert.Equal(t, "tests", e["user_agent"])
+		assert.Equal(t, "192.0.2.1", e["remote_ip"])
+	}
+
+	// Sampled, but not of failures
+	appgo.Conf.AccessLog.SampleRate = 0.000001
+	defer func() { appgo.Conf.AccessLog.SampleRate = 0 }()
+	serveTest(s, httptest.NewRequest("GET", "/api/items/7", nil))
+	assert.Len(t, accessLogs(), 0)
+	appgo.Conf.AccessLog.RedactParams = []string{"Code"}
+	defer func() { appgo.Conf.AccessLog.RedactParams = nil }()
+	serveTest(s, httptest.NewRequest("DELETE", "/api/items/7", nil))
+	serveTest(s, httptest.NewRequest("PUT", "/api/items/7?code=1", nil))
+	entries = accessLogs()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, http.StatusInternalServerError, entries[0].Data["status"])
+		assert.Equal(t, "/api/items/7?code=REDACTED", entries[0].Data["path"])
+	}
+}
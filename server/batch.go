@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"strings"
+)
+
+const defaultBatchMaxSize = 20
+
+// BatchRequest is a sub-request of a batch, Body is sent as JSON.
+type BatchRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// BatchResponse is the reply of a sub-request, Body is the JSON replied
+// or else a string.
+type BatchResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    interface{}       `json:"body"`
+}
+
+// AddBatch serves POST at path which takes an array of BatchRequests,
+// calls them one by one through the router and replies the array of
+// their BatchResponses. Sub-requests act as the user of the batch
+// request, whose token they get and which is authenticated once for
+// them all, and are rate limited and deduplicated by their own
+// Idempotency-Key as separate requests. The batch body is limited by
+// Conf.MaxBodyBytes.
+func (s *Server) AddBatch(path string) {
+	s.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		maxSize := appgo.Conf.Batch.MaxSize
+		if maxSize <= 0 {
+			maxSize = defaultBatchMaxSize
+		}
+		if limit := maxBodyBytes(appgo.Conf.MaxBodyBytes); limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		var reqs []*BatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				bodyErr(err).HttpError(w)
+			} else {
+				appgo.NewApiErr(appgo.ECodeBadRequest, "bad batch: "+err.Error()).HttpError(w)
+			}
+			return
+		} else if len(reqs) > maxSize {
+			appgo.NewApiErr(appgo.ECodeBadRequest,
+				fmt.Sprintf("batch larger than %d", maxSize)).HttpError(w)
+			return
+		}
+		// Sub-requests share the user, resolved once
+		r = withAuthCache(r)
+		resps := make([]*BatchResponse, len(reqs))
+		for i, sub := range reqs {
+			resps[i] = s.serveBatched(r, path, sub)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(w).Encode(resps)
+	}).Methods("POST")
+}
+
+func (s *Server) serveBatched(outer *http.Request, batchPath string,
+	sub *BatchRequest) *BatchResponse {
+	if sub == nil || sub.Path == "" || !strings.HasPrefix(sub.Path, "/") ||
+		strings.HasPrefix(sub.Path, batchPath) {
+		return batchError(appgo.NewApiErr(appgo.ECodeBadRequest, "bad sub-request path"))
+	}
+	method := strings.ToUpper(sub.Method)
+	if method == "" {
+		method = "GET"
+	}
+	r, err := http.NewRequest(method, sub.Path, bytes.NewReader(sub.Body))
+	if err != nil {
+		return batchError(appgo.NewApiErr(appgo.ECodeBadRequest, err.Error()))
+	}
+	r = r.WithContext(outer.Context())
+	r.RemoteAddr = outer.RemoteAddr
+	r.Host = outer.Host
+	for k, v := range sub.Headers {
+		r.Header.Set(k, v)
+	}
+	if len(sub.Body) > 0 && r.Header.Get("Content-Type") == "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	// Of the user of the batch only
+	for _, name := range tokenHeaders() {
+		r.Header.Del(name)
+	}
+	r.Header.Del("Cookie")
+	if token := tokenFromRequest(outer); token != "" {
+		r.Header.Set(tokenHeaders()[0], string(token))
+	}
+	if token := outer.Header.Get(serviceTokenHeader()); token != "" {
+		r.Header.Set(serviceTokenHeader(), token)
+	} else {
+		r.Header.Del(serviceTokenHeader())
+	}
+	for _, name := range []string{"X-Forwarded-For", "X-Real-IP"} {
+		if v := outer.Header.Get(name); v != "" {
+			r.Header.Set(name, v)
+		} else {
+			r.Header.Del(name)
+		}
+	}
+
+	w := &batchWriter{header: make(http.Header)}
+	s.ServeHTTP(w, r)
+	resp := &BatchResponse{Status: w.status, Headers: make(map[string]string)}
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	for k := range w.header {
+		resp.Headers[k] = w.header.Get(k)
+	}
+	body := bytes.TrimSpace(w.body.Bytes())
+	if strings.Contains(w.header.Get("Content-Type"), "json") && json.Valid(body) {
+		resp.Body = json.RawMessage(body)
+	} else {
+		resp.Body = string(body)
+	}
+	return resp
+}
+
+func batchError(aerr *appgo.ApiError) *BatchResponse {
+	return &BatchResponse{Status: aerr.HttpStatus(), Body: aerr}
+}
+
+// batchWriter buffers the reply of a sub-request.
+type batchWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *batchWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	defer withTestTokens()()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&meApi{}, &bodyApi{}, &missingApi{}})
+	s.AddBatch("/batch")
+	batch := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+		r.Header.Set(appgo.CustomTokenHeaderName, string(auth.NewToken(42, appgo.RoleAppUser)))
+		return serveTest(s, r)
+	}
+
+	w := batch(`[
+		{"method":"GET","path":"/api/me"},
+		{"method":"POST","path":"/api/body","body":{"Text":"hi"}},
+		{"method":"GET","path":"/api/missing"},
+		{"method":"POST","path":"/api/body","body":{"Text":1}},
+		{"method":"GET","path":"/api/me","headers":{"X-Appgo-Token":"forged"}},
+		{"method":"POST","path":"/batch","body":[]}
+	]`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resps []struct {
+		Status  int
+		Headers map[string]string
+		Body    json.RawMessage
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resps))
+	if !assert.Len(t, resps, 6) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, resps[0].Status)
+	assert.Equal(t, `"42"`, string(resps[0].Body))
+	assert.Equal(t, http.StatusOK, resps[1].Status)
+	assert.Equal(t, `"hi"`, string(resps[1].Body))
+	assert.Equal(t, http.StatusNotFound, resps[2].Status)
+	assert.Contains(t, string(resps[2].Body), "no such thing")
+	assert.Equal(t, http.StatusBadRequest, resps[3].Status)
+	// Acts as the batch's user only
+	assert.Equal(t, `"42"`, string(resps[4].Body))
+	assert.Equal(t, http.StatusBadRequest, resps[5].Status)
+
+	appgo.Conf.Batch.MaxSize = 1
+	defer func() { appgo.Conf.Batch.MaxSize = 0 }()
+	w = batch(`[{"path":"/api/me"},{"path":"/api/me"}]`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = batch(`{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestBatchAuthOnce(t *testing.T) {
+	defer withTestTokens()()
+	ts := &countingTokenStore{}
+	s := NewServer(ts, nil, nil)
+	s.AddRest("/api", []interface{}{&meApi{}, &bodyApi{}})
+	s.AddBatch("/batch")
+	r := httptest.NewRequest("POST", "/batch", strings.NewReader(`[
+		{"path":"/api/me"},
+		{"method":"POST","path":"/api/body","body":{"Text":"hi"}},
+		{"path":"/api/me"}
+	]`))
+	r.Header.Set(appgo.CustomTokenHeaderName, string(newTestToken(42)))
+	w := serveTest(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2, strings.Count(w.Body.String(), `"body":"42"`))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ts.n))
+}
+
+func TestBatchBodyLimit(t *testing.T) {
+	defer withMaxBody(64)()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&bodyApi{}})
+	s.AddBatch("/batch")
+	batch := func(text string) *httptest.ResponseRecorder {
+		body := `[{"method":"POST","path":"/api/body","body":{"Text":"` + text + `"}}]`
+		return serveTest(s, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+	}
+	assert.Equal(t, http.StatusOK, batch("hi").Code)
+	w := batch(strings.Repeat("x", 100))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "request body too large")
+}
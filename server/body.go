@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/gorilla/schema"
+	"github.com/oxfeeefeee/appgo"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultMaxBodyBytes = 4 << 20
+
+// BodyTransformer rewrites a raw request body before it's decoded into
+// Content__, e.g. to adapt payloads of legacy clients.
+type BodyTransformer func(r *http.Request, body []byte) ([]byte, error)
+
+// Content type => transformer
+var bodyTransformers = make(map[string]BodyTransformer)
+
+// SetBodyTransformer sets the transformer of bodies of the content type,
+// a nil t removes it. Not safe to call once the server is serving.
+func SetBodyTransformer(contentType string, t BodyTransformer) {
+	if t == nil {
+		delete(bodyTransformers, contentType)
+	} else {
+		bodyTransformers[contentType] = t
+	}
+}
+
+// setBodyLimit reads META tag `maxBody:"1048576"`, which overrides
+// Conf.MaxBodyBytes for the handler, "0" for unlimited.
+func (h *handler) setBodyLimit(meta reflect.StructTag) error {
+	if s := meta.Get("maxBody"); s != "" {
+		limit, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("Bad maxBody of %s: %s", h.path, s)
+		}
+		h.maxBody = &limit
+	}
+	return nil
+}
+
+// bodyLimit returns the max request body size in bytes, 0 if unlimited.
+// It's the default 4MB if neither the handler nor Conf.MaxBodyBytes
+// sets it.
+func (h *handler) bodyLimit() int64 {
+	if h.maxBody != nil {
+		return maxBodyBytes(h.maxBody)
+	}
+	return maxBodyBytes(appgo.Conf.MaxBodyBytes)
+}
+
+// maxBodyBytes is the limit set as Conf.MaxBodyBytes, 0 if unlimited.
+func maxBodyBytes(limit *int64) int64 {
+	if limit == nil {
+		return defaultMaxBodyBytes
+	} else if *limit < 0 {
+		return 0
+	}
+	return *limit
+}
+
+// decodeContent decodes the body by its Content-Type, JSON if not given.
+func (h *handler) decodeContent(r *http.Request, f *httpFunc) (reflect.Value, *appgo.ApiError) {
+	content := reflect.New(f.contentType.Elem())
+	ct := "application/json"
+	if s := r.Header.Get("Content-Type"); s != "" {
+		var err error
+		if ct, _, err = mime.ParseMediaType(s); err != nil {
+			return content, appgo.NewApiErr(appgo.ECodeBadRequest, "bad Content-Type")
+		}
+	}
+	if aerr := h.transformBody(r, ct); aerr != nil {
+		return content, aerr
+	}
+	var err error
+	switch ct {
+	case "application/json":
+		dec := json.NewDecoder(r.Body)
+		if h.strict() {
+			dec.DisallowUnknownFields()
+		}
+		err = dec.Decode(content.Interface())
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		// A multipart form has been parsed by formValues already
+		if err = r.ParseForm(); err == nil {
+			err = decoder.Decode(content.Interface(), r.PostForm)
+		}
+	case "application/xml", "text/xml":
+		err = xml.NewDecoder(r.Body).Decode(content.Interface())
+	default:
+		return content, appgo.NewApiErr(appgo.ECodeBadRequest,
+			"unsupported Content-Type: "+ct)
+	}
+	if err != nil {
+		return content, bodyErr(err)
+	}
+	return content, nil
+}
+
+// decompressBody unwraps a gzipped body, the decompressed size is
+// limited as the raw body is, against zip bombs.
+func (h *handler) decompressBody(w http.ResponseWriter, r *http.Request) *appgo.ApiError {
+	enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if enc != "gzip" && enc != "x-gzip" {
+		return nil
+	}
+	gr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		if err == io.EOF {
+			// Empty body
+			return nil
+		}
+		return bodyErr(err)
+	}
+	var rd io.ReadCloser = gr
+	if limit := h.bodyLimit(); limit > 0 {
+		rd = http.MaxBytesReader(w, gr, limit)
+	}
+	// Read it all for the checksum to be verified before decoding
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return bodyErr(err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	r.Header.Del("Content-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	r.ContentLength = int64(len(data))
+	return nil
+}
+
+// transformBody applies the transformer of ct if any, the transformed
+// body is limited as the raw one is.
+func (h *handler) transformBody(r *http.Request, ct string) *appgo.ApiError {
+	t, ok := bodyTransformers[ct]
+	if !ok {
+		return nil
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return bodyErr(err)
+	}
+	if data, err = t(r, data); err != nil {
+		if aerr, ok := err.(*appgo.ApiError); ok {
+			return aerr
+		}
+		return appgo.NewApiErr(appgo.ECodeBadRequest, err.Error())
+	}
+	if limit := h.bodyLimit(); limit > 0 && int64(len(data)) > limit {
+		return appgo.NewApiErr(appgo.ECodeBadRequest, "request body too large")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	return nil
+}
+
+// strict tells if unknown fields of JSON bodies are rejected.
+func (h *handler) strict() bool {
+	switch h.strictJSON {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return appgo.Conf.StrictJSON
+}
+
+func bodyErr(err error) *appgo.ApiError {
+	if aerr := fieldErr("body", err); aerr != nil {
+		return aerr
+	}
+	var maxErr *http.MaxBytesError
+	var flateErr flate.CorruptInputError
+	var netErr net.Error
+	if errors.As(err, &maxErr) {
+		return appgo.NewApiErr(appgo.ECodeBadRequest, "request body too large")
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		// Of Conf.HttpServer.ReadTimeout
+		return appgo.NewApiErr(appgo.ECodeBadRequest, "timeout reading request body")
+	} else if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) ||
+		errors.As(err, &flateErr) {
+		return appgo.NewApiErr(appgo.ECodeBadRequest, "corrupt gzip body")
+	} else if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return appgo.NewApiErr(appgo.ECodeBadRequest, "unknown field: "+strings.Trim(field, `"`))
+	}
+	return appgo.NewApiErr(appgo.ECodeBadRequest, err.Error())
+}
+
+// fieldErr names the fields failing to decode, prefixed by source which
+// is "query" or "body". It returns nil if err is not about fields.
+func fieldErr(source string, err error) *appgo.ApiError {
+	fields := make(map[string]string)
+	var typeErr *json.UnmarshalTypeError
+	var multiErr schema.MultiError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		fields[source+"."+typeErr.Field] = fmt.Sprintf("expected %s, got %s",
+			typeErr.Type, typeErr.Value)
+	} else if errors.As(err, &multiErr) {
+		for key, e := range multiErr {
+			fields[source+"."+key] = schemaErrReason(e)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fieldsErr(fields)
+}
+
+// fieldsErr reports the bad fields, field => why.
+func fieldsErr(fields map[string]string) *appgo.ApiError {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msg := fmt.Sprintf("bad field %s: %s", names[0], fields[names[0]])
+	if len(names) > 1 {
+		msg = "bad fields: " + strings.Join(names, ", ")
+	}
+	return appgo.NewApiErrWithFields(appgo.ECodeBadRequest, msg, fields)
+}
+
+func schemaErrReason(err error) string {
+	switch e := err.(type) {
+	case schema.ConversionError:
+		if e.Type != nil {
+			return "expected " + e.Type.String()
+		}
+		return "invalid value"
+	case schema.EmptyFieldError:
+		return "required"
+	}
+	return err.Error()
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/toolkit/strutil"
+	"hash/fnv"
+	"net/http"
+)
+
+// VersionOverride may change the API version resolved from a request,
+// e.g. to route part of the traffic to a newer version.
+type VersionOverride func(r *http.Request, user appgo.Id, role appgo.Role, ver int) int
+
+var versionOverride VersionOverride
+
+func SetVersionOverride(o VersionOverride) {
+	versionOverride = o
+}
+
+// resolveVersion applies the version override, the overridden version is
+// dropped if the handler doesn't support it.
+func (h *handler) resolveVersion(r *http.Request, ver int) int {
+	o := versionOverride
+	if o == nil {
+		if appgo.Conf.Canary.Version == 0 {
+			return ver
+		}
+		o = canaryOverride
+	}
+	// Cached for the auth of the func, see requestAuth
+	user, role := h.authByRequest(r)
+	v := o(r, user, role, ver)
+	if v == ver {
+		return ver
+	}
+	method := h.funcMethod(r)
+	if v > 1 {
+		method += strutil.FromInt(v)
+	}
+	if _, ok := h.funcs[method]; !ok {
+		return ver
+	}
+	return v
+}
+
+// canaryOverride bumps the version to Conf.Canary.Version for users in
+// the canary bucket, or for admins sending the Conf.Canary.Header.
+func canaryOverride(r *http.Request, user appgo.Id, role appgo.Role, ver int) int {
+	c := &appgo.Conf.Canary
+	if ver >= c.Version || user == 0 {
+		return ver
+	}
+	forced := c.Header != "" && r.Header.Get(c.Header) != "" &&
+		role == appgo.RoleWebAdmin
+	if forced || bucketOf("canary:"+user.String()) < c.Percent {
+		return c.Version
+	}
+	return ver
+}
+
+// bucketOf hashes key into one of 100 stable buckets.
+func bucketOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % 100)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/unrolled/render"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func withCanary(version, percent int) func() {
+	c := appgo.Conf.Canary
+	appgo.Conf.Canary.Version = version
+	appgo.Conf.Canary.Percent = percent
+	appgo.Conf.Canary.Header = "X-Canary"
+	return func() { appgo.Conf.Canary = c }
+}
+
+func TestBucketOf(t *testing.T) {
+	// Stable across processes, as it's fnv rather than a seeded hash
+	assert.Equal(t, 83, bucketOf("canary:42"))
+	assert.Equal(t, 64, bucketOf("canary:43"))
+	counts := make([]int, 100)
+	for i := 0; i < 10000; i++ {
+		b := bucketOf("canary:" + appgo.Id(i).String())
+		assert.True(t, b >= 0 && b < 100)
+		counts[b]++
+	}
+	for b, n := range counts {
+		assert.True(t, n > 50 && n < 150, "bucket %d of %d", b, n)
+	}
+}
+
+func TestCanaryOverride(t *testing.T) {
+	defer withCanary(2, 84)()
+	r := httptest.NewRequest("GET", "/", nil)
+	// Bucket 83
+	assert.Equal(t, 2, canaryOverride(r, 42, appgo.RoleAppUser, 1))
+	appgo.Conf.Canary.Percent = 83
+	assert.Equal(t, 1, canaryOverride(r, 42, appgo.RoleAppUser, 1))
+	// Anonymous and newer clients stay
+	assert.Equal(t, 1, canaryOverride(r, 0, 0, 1))
+	assert.Equal(t, 3, canaryOverride(r, 42, appgo.RoleAppUser, 3))
+
+	r.Header.Set("X-Canary", "1")
+	assert.Equal(t, 2, canaryOverride(r, 42, appgo.RoleWebAdmin, 1))
+	assert.Equal(t, 1, canaryOverride(r, 42, appgo.RoleAppUser, 1), "admins only")
+}
+
+func TestCanaryVersion(t *testing.T) {
+	defer withTestTokens()()
+	defer withCanary(2, 100)()
+	ts := &countingTokenStore{}
+	renderer := render.New(render.Options{Directory: "N/A"})
+	get := func(api interface{}, path string, user appgo.Id) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if user != 0 {
+			r.Header.Set(appgo.CustomTokenHeaderName, string(newTestToken(user)))
+		}
+		return serveTest(newHandler(api, HandlerTypeJson, ts, renderer), r)
+	}
+
+	w := get(&versionedApi{}, "/versioned", 42)
+	assert.Equal(t, `"v2"`, w.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ts.n))
+	assert.Equal(t, `"v1"`, get(&versionedApi{}, "/versioned", 0).Body.String())
+
+	// Dropped as /me has no version 2, and auth is still looked up once
+	atomic.StoreInt32(&ts.n, 0)
+	w = get(&meApi{}, "/me", 42)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"42"`, w.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ts.n))
+
+	appgo.Conf.Canary.Version = 4
+	assert.Equal(t, `"v1"`, get(&versionedApi{}, "/versioned", 42).Body.String())
+
+	// Overrides replace the canary
+	var seen appgo.Id
+	SetVersionOverride(func(r *http.Request, user appgo.Id, role appgo.Role, ver int) int {
+		seen = user
+		return 2
+	})
+	defer SetVersionOverride(nil)
+	assert.Equal(t, `"v2"`, get(&versionedApi{}, "/versioned", 43).Body.String())
+	assert.Equal(t, appgo.Id(43), seen)
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/andybalholm/brotli"
+	"github.com/oxfeeefeee/appgo"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const defaultCompressMinLength = 1024
+
+var defaultCompressEncodings = []string{"br", "gzip", "deflate"}
+
+// Content types which are compressed already
+var compressedTypes = []string{
+	"image/", "video/", "audio/",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-compress", "application/x-7z-compressed",
+	"application/x-rar-compressed", "application/pdf",
+}
+
+// compressEncoding picks the encoding to compress a reply with, an
+// empty string means leave it as is.
+func compressEncoding(w http.ResponseWriter, r *http.Request,
+	contentType string, length int) string {
+	minLen := appgo.Conf.Compression.MinLength
+	if minLen <= 0 {
+		minLen = defaultCompressMinLength
+	}
+	if length < minLen || w.Header().Get("Content-Encoding") != "" {
+		return ""
+	}
+	if !compressibleType(contentType) {
+		return ""
+	}
+	encodings := appgo.Conf.Compression.Encodings
+	if len(encodings) == 0 {
+		encodings = defaultCompressEncodings
+	}
+	accepted := acceptedEncodings(r)
+	for _, enc := range encodings {
+		switch enc {
+		case "br", "gzip", "deflate":
+			if accepted[enc] {
+				return enc
+			}
+		}
+	}
+	return ""
+}
+
+// compressibleType matches contentType against Conf.Compression.Types,
+// or if empty, tells if it's not compressed already.
+func compressibleType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if types := appgo.Conf.Compression.Types; len(types) > 0 {
+		for _, t := range types {
+			if strings.HasPrefix(contentType, strings.ToLower(t)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, t := range compressedTypes {
+		if strings.HasPrefix(contentType, t) && contentType != "image/svg+xml" {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptedEncodings parses Accept-Encoding, encodings with q=0 are left out.
+func acceptedEncodings(r *http.Request) map[string]bool {
+	ret := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		enc := strings.ToLower(strings.TrimSpace(params[0]))
+		if enc == "" {
+			continue
+		}
+		ok := true
+		for _, p := range params[1:] {
+			p = strings.Replace(p, " ", "", -1)
+			if strings.HasPrefix(p, "q=") && strings.Trim(p[2:], "0.") == "" {
+				ok = false
+			}
+		}
+		ret[enc] = ok
+	}
+	return ret
+}
+
+func compress(enc string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	cw := compressWriter(enc, &buf)
+	if _, err := cw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func compressWriter(enc string, w io.Writer) io.WriteCloser {
+	switch enc {
+	case "br":
+		// Level 4 is about as fast as gzip's best speed and smaller
+		return brotli.NewWriterLevel(w, 4)
+	case "gzip":
+		cw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+		return cw
+	}
+	// HTTP "deflate" is actually the zlib format
+	cw, _ := zlib.NewWriterLevel(w, zlib.BestSpeed)
+	return cw
+}
+
+func decompress(enc string, data []byte) ([]byte, error) {
+	var rd io.ReadCloser
+	var err error
+	if enc == "br" {
+		rd = ioutil.NopCloser(brotli.NewReader(bytes.NewReader(data)))
+	} else if enc == "gzip" {
+		rd, err = gzip.NewReader(bytes.NewReader(data))
+	} else if enc == "deflate" {
+		rd, err = zlib.NewReader(bytes.NewReader(data))
+	} else {
+		return nil, fmt.Errorf("unknown encoding: %s", enc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+// renderPrecompressed sends p as is if the client accepts its encoding,
+// otherwise decompresses it, failing that replies an internal error.
+func (h *handler) renderPrecompressed(w http.ResponseWriter, r *http.Request,
+	p *appgo.Precompressed) {
+	ctype := p.ContentType
+	if ctype == "" {
+		ctype = "application/json; charset=UTF-8"
+	}
+	if acceptedEncodings(r)[p.Encoding] {
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("Content-Encoding", p.Encoding)
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(p.Data); err != nil {
+			logEntry(r).WithField("error", err).Info("Error writing reply")
+		}
+		return
+	}
+	data, err := decompress(p.Encoding, p.Data)
+	if err != nil {
+		logEntry(r).WithFields(log.Fields{
+			"error":    err,
+			"encoding": p.Encoding,
+		}).Error("Error decompressing precompressed reply")
+		h.renderError(w, r, appgo.NewApiErr(appgo.ECodeInternal, "Failed to encode reply"))
+		return
+	}
+	if !appgo.Conf.Compression.Enable {
+		// Otherwise added by writeData
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	h.writeData(w, r, http.StatusOK, ctype, data)
+}
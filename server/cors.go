@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Headers allowed and exposed besides Conf.Cors.AllowedHeaders and
+// Conf.Cors.ExposedHeaders
+var (
+	corsAllowedHeaders = []string{"Content-Type", appgo.CustomTokenHeaderName,
+		appgo.CustomVersionHeaderName, appgo.CustomConfVerHeaderName, CsrfHeaderName}
+	corsExposedHeaders = []string{appgo.CustomTokenHeaderName,
+		appgo.CustomVersionHeaderName}
+)
+
+// corsMeta overrides Conf.Cors for a func set, from META tags
+// corsOrigins, corsMethods, corsHeaders, corsCredentials and corsMaxAge.
+type corsMeta struct {
+	origins     string
+	methods     string
+	headers     string
+	credentials string
+	maxAge      int
+}
+
+// setCors reads the CORS tags, which only take effect with
+// Conf.Cors.Builtin.
+func (h *handler) setCors(meta reflect.StructTag) error {
+	m := &corsMeta{
+		origins:     meta.Get("corsOrigins"),
+		methods:     meta.Get("corsMethods"),
+		headers:     meta.Get("corsHeaders"),
+		credentials: meta.Get("corsCredentials"),
+	}
+	switch m.credentials {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("Bad corsCredentials of %s: %s", h.path, m.credentials)
+	}
+	if s := meta.Get("corsMaxAge"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return fmt.Errorf("Bad corsMaxAge of %s: %s", h.path, s)
+		}
+		m.maxAge = n
+	}
+	if *m != (corsMeta{}) {
+		if !appgo.Conf.Cors.Builtin {
+			log.WithField("path", h.path).Warnln("CORS tags are ignored without Conf.Cors.Builtin")
+		}
+		h.corsMeta = m
+	}
+	// Any site could read replies of its users otherwise
+	if origins, _, _, credentials, _ := h.corsConf(); h.builtinCors() && credentials &&
+		!corsExplicitOrigins(origins) {
+		return fmt.Errorf("CORS credentials of %s need explicit origins, not *", h.path)
+	}
+	return nil
+}
+
+// corsConf returns the CORS settings of h.
+func (h *handler) corsConf() (origins, methods, headers string, credentials bool, maxAge int) {
+	c := &appgo.Conf.Cors
+	origins, methods, headers = c.AllowedOrigins, c.AllowedMethods, c.AllowedHeaders
+	credentials, maxAge = c.AllowCredentials, c.MaxAge
+	if m := h.corsMeta; m != nil {
+		if m.origins != "" {
+			origins = m.origins
+		}
+		if m.methods != "" {
+			methods = m.methods
+		}
+		if m.headers != "" {
+			headers = m.headers
+		}
+		if m.credentials != "" {
+			credentials = m.credentials == "true"
+		}
+		if m.maxAge > 0 {
+			maxAge = m.maxAge
+		}
+	}
+	return
+}
+
+// builtinCors tells if CORS is handled by API handlers rather than the
+// middleware of Serve.
+func (h *handler) builtinCors() bool {
+	return h.htype == HandlerTypeJson && appgo.Conf.Cors.Builtin
+}
+
+// cors adds the CORS headers for requests of allowed origins, it returns
+// true if r is a preflight, which has been replied.
+func (h *handler) cors(w http.ResponseWriter, r *http.Request) bool {
+	origins, allowedMethods, allowedHeaders, credentials, maxAge := h.corsConf()
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+	w.Header().Add("Vary", "Origin")
+	if origin == "" || !corsAllowsOrigin(origins, origin, credentials) {
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return preflight
+	}
+	if credentials {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	} else if corsOrigins(origins)[0] == "*" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if !preflight {
+		exposed := append(splitList(appgo.Conf.Cors.ExposedHeaders), corsExposedHeaders...)
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+		return false
+	}
+	methods := splitList(allowedMethods)
+	if len(methods) == 0 {
+		methods = h.allowedMethods()
+	}
+	headers := append(splitList(allowedHeaders), corsAllowedHeaders...)
+	for _, name := range tokenHeaders() {
+		if name != appgo.CustomTokenHeaderName {
+			headers = append(headers, name)
+		}
+	}
+	if name := appgo.Conf.RequestTimeout.Header; name != "" {
+		headers = append(headers, name)
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// corsOrigins splits the allowed origins, all if empty.
+func corsOrigins(allowed string) []string {
+	origins := splitList(allowed)
+	if len(origins) == 0 {
+		return []string{"*"}
+	}
+	return origins
+}
+
+// corsExplicitOrigins tells if the allowed origins are set and none of
+// them is "*".
+func corsExplicitOrigins(allowed string) bool {
+	origins := splitList(allowed)
+	for _, o := range origins {
+		if o == "*" {
+			return false
+		}
+	}
+	return len(origins) > 0
+}
+
+// corsAllowsOrigin matches origin against the allowed origins, which may
+// have a wildcard like "https://*.example.com". With credentials "*" and
+// the default of all origins match none.
+func corsAllowsOrigin(allowed, origin string, credentials bool) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range corsOrigins(allowed) {
+		o = strings.ToLower(o)
+		if o == "*" {
+			if !credentials {
+				return true
+			}
+		} else if i := strings.Index(o, "*"); i < 0 {
+			if o == origin {
+				return true
+			}
+		} else if len(origin) >= len(o)-1 && strings.HasPrefix(origin, o[:i]) &&
+			strings.HasSuffix(origin, o[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
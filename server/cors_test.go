@@ -0,0 +1,143 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func withCors() func() {
+	c := appgo.Conf.Cors
+	appgo.Conf.Cors.Builtin = true
+	appgo.Conf.Cors.AllowedOrigins = "https://app.example.com, https://*.example.org"
+	appgo.Conf.Cors.MaxAge = 600
+	return func() { appgo.Conf.Cors = c }
+}
+
+func TestCorsPreflight(t *testing.T) {
+	defer withCors()()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&dupApi2{}})
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("OPTIONS", "/api/dup", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		return serveTest(s, r)
+	}
+
+	w := preflight("https://app.example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, POST, HEAD, OPTIONS", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), appgo.CustomTokenHeaderName)
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), appgo.CustomVersionHeaderName)
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+	assert.Empty(t, w.Body.String())
+
+	w = preflight("https://a.b.example.org")
+	assert.Equal(t, "https://a.b.example.org", w.Header().Get("Access-Control-Allow-Origin"))
+	w = preflight("https://evil.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Not a preflight
+	w = serveTest(s, httptest.NewRequest("OPTIONS", "/api/dup", nil))
+	assert.Equal(t, "GET, POST, HEAD, OPTIONS", w.Header().Get("Allow"))
+}
+
+func TestCorsHeaders(t *testing.T) {
+	defer withCors()()
+	h := newTestHandler(&mwApi{})
+	get := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/mw", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return serveTest(h, r)
+	}
+
+	w := get("https://app.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), appgo.CustomTokenHeaderName)
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+	assert.Empty(t, get("").Header().Get("Access-Control-Allow-Origin"))
+
+	appgo.Conf.Cors.AllowedOrigins = "*"
+	assert.Equal(t, "*", get("https://x.com").Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCorsCredentials(t *testing.T) {
+	defer withCors()()
+	appgo.Conf.Cors.AllowCredentials = true
+	h := newTestHandler(&mwApi{})
+	get := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/mw", nil)
+		r.Header.Set("Origin", origin)
+		return serveTest(h, r)
+	}
+
+	w := get("https://app.example.com")
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	w = get("https://evil.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+
+	// Changed after the handler was made
+	for _, origins := range []string{"*", "", "https://app.example.com, *"} {
+		appgo.Conf.Cors.AllowedOrigins = origins
+		w = get("https://evil.com")
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), origins)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"), origins)
+	}
+
+	assert.Panics(t, func() { newTestHandler(&mwApi{}) })
+	appgo.Conf.Cors.AllowedOrigins = "https://app.example.com"
+	assert.Panics(t, func() {
+		newTestHandler(&struct {
+			META struct{} `path:"/any" corsOrigins:"*" corsCredentials:"true"`
+			corsApi
+		}{})
+	})
+	assert.NotPanics(t, func() { newTestHandler(&corsApi{}) })
+}
+
+type corsApi struct {
+	META struct{} `path:"/public" corsOrigins:"*" corsMethods:"GET" corsCredentials:"false" corsMaxAge:"60"`
+}
+
+func (corsApi) GET(in *appgo.DummyInput) (string, error) {
+	return "ok", nil
+}
+
+func TestCorsMeta(t *testing.T) {
+	defer withCors()()
+	appgo.Conf.Cors.AllowCredentials = true
+	h := newTestHandler(&corsApi{})
+	r := httptest.NewRequest("OPTIONS", "/public", nil)
+	r.Header.Set("Origin", "https://x.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	w := serveTest(h, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "60", w.Header().Get("Access-Control-Max-Age"))
+
+	// Others keep Conf.Cors
+	h = newTestHandler(&mwApi{})
+	r = httptest.NewRequest("GET", "/mw", nil)
+	r.Header.Set("Origin", "https://x.com")
+	assert.Empty(t, serveTest(h, r).Header().Get("Access-Control-Allow-Origin"))
+
+	assert.Panics(t, func() {
+		newTestHandler(&struct {
+			META struct{} `path:"/bad" corsMaxAge:"-1"`
+			corsApi
+		}{})
+	})
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CsrfHeaderName is a header cross-site forms can't send, and scripts of
+// other sites only can after a CORS preflight, see csrfSafe.
+const CsrfHeaderName = "X-Requested-With"
+
+// csrfSafe tells if r can't have been forged by another site, to which
+// browsers attach the cookies of the server as well. Safe methods are,
+// and so are requests with CsrfHeaderName, and those from the origin of
+// the server or from one allowed by Conf.Cors with credentials.
+func csrfSafe(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	if r.Header.Get(CsrfHeaderName) != "" {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		ref, err := url.Parse(r.Referer())
+		if err != nil || ref.Host == "" {
+			return false
+		}
+		origin = ref.Scheme + "://" + ref.Host
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	c := &appgo.Conf.Cors
+	return c.Builtin && c.AllowCredentials && corsAllowsOrigin(c.AllowedOrigins, origin, true)
+}
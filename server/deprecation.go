@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// setDeprecation reads META tags like
+// `deprecated:"true" sunset:"2017-06-30"`, a sunset implies deprecated.
+func (h *handler) setDeprecation(meta reflect.StructTag) error {
+	h.deprecated = meta.Get("deprecated") == "true"
+	if s := meta.Get("sunset"); s != "" {
+		t, err := parseSunset(s)
+		if err != nil {
+			return fmt.Errorf("Bad sunset date of %s: %s", h.path, s)
+		}
+		h.deprecated = true
+		h.sunset = t
+	}
+	return nil
+}
+
+// checkDeprecation sets the Deprecation/Sunset headers and counts the
+// usage, it returns false if the API has been retired.
+func (h *handler) checkDeprecation(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Deprecation", "true")
+	if !h.sunset.IsZero() {
+		w.Header().Set("Sunset", h.sunset.UTC().Format(http.TimeFormat))
+	}
+	if appgo.Conf.Prometheus.Enable {
+		metrics_deprecated_count.With("path", h.path).Add(1)
+	}
+	if appgo.Conf.Deprecation.EnforceSunset &&
+		!h.sunset.IsZero() && time.Now().After(h.sunset) {
+		h.renderError(w, r, appgo.GoneErr)
+		return false
+	}
+	return true
+}
+
+func parseSunset(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+)
+
+var (
+	responseEnvelope func(data interface{}) interface{}
+	errorEnvelope    func(err *appgo.ApiError) interface{}
+)
+
+// SetResponseEnvelope sets the func wrapping what JSON API funcs return,
+// nil means replying the raw values. Handlers with META tag `raw:"true"`
+// always reply raw values.
+func SetResponseEnvelope(e func(data interface{}) interface{}) {
+	responseEnvelope = e
+}
+
+// SetErrorEnvelope sets the func shaping errors replied by JSON API
+// funcs, e.g. as {"code":40000,"msg":"...","data":null}, nil means
+// replying the ApiError as is. The HTTP status is still of the error,
+// and handlers with META tag `raw:"true"` reply it as is.
+func SetErrorEnvelope(e func(err *appgo.ApiError) interface{}) {
+	errorEnvelope = e
+}
+
+// CodeEnvelope is a response envelope, which wraps data with ECodeOK as
+// {"errcode":20000,"data":...}.
+func CodeEnvelope(data interface{}) interface{} {
+	return &appgo.Envelope{Code: appgo.ECodeOK, Data: data}
+}
+
+func (h *handler) envelope(v interface{}) interface{} {
+	if responseEnvelope == nil || h.raw {
+		return v
+	}
+	switch v.(type) {
+	case appgo.Envelope, *appgo.Envelope:
+		return v
+	}
+	return responseEnvelope(v)
+}
+
+func (h *handler) errEnvelope(err *appgo.ApiError) interface{} {
+	if errorEnvelope == nil || h.raw {
+		return err
+	}
+	return errorEnvelope(err)
+}
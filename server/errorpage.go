@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Status like "404" or class like "4xx" => template
+var errorTemplates = make(map[string]string)
+
+// SetErrorTemplate sets the template HTML handlers render errors of the
+// status with, status being a code like "404" or a class like "5xx".
+// The template gets the *appgo.ApiError. An empty template removes it,
+// errors without a template are replied as plain text.
+func SetErrorTemplate(status, template string) {
+	if template == "" {
+		delete(errorTemplates, status)
+	} else {
+		errorTemplates[status] = template
+	}
+}
+
+func errorTemplate(status int) string {
+	s := strconv.Itoa(status)
+	if tpl, ok := errorTemplates[s]; ok {
+		return tpl
+	}
+	if len(s) == 3 {
+		return errorTemplates[s[:1]+"xx"]
+	}
+	return ""
+}
+
+// errorPage renders the error template of status, it returns nil if
+// there is none or it fails to render.
+func (h *handler) errorPage(r *http.Request, status int, data interface{}) []byte {
+	tpl := errorTemplate(status)
+	if tpl == "" {
+		return nil
+	}
+	page, err := h.executeHtml(tpl, data)
+	if err != nil {
+		logEntry(r).WithField("error", err).Error("Error rendering error page")
+		return nil
+	}
+	return page
+}
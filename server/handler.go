@@ -1,22 +1,20 @@
 package server
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	gkmetrics "github.com/go-kit/kit/metrics"
-	gkprometheus "github.com/go-kit/kit/metrics/prometheus"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	"github.com/oxfeeefeee/appgo"
-	"github.com/oxfeeefeee/appgo/auth"
 	"github.com/oxfeeefeee/appgo/toolkit/strutil"
-	stdprometheus "github.com/prometheus/client_golang/prometheus"
 	"github.com/unrolled/render"
+	"mime/multipart"
 	"net/http"
 	"reflect"
-	"strings"
+	"runtime/debug"
+	"sync"
 	"time"
 )
 
@@ -27,22 +25,34 @@ const (
 	ContentFieldName     = "Content__"
 	RequestFieldName     = "Request__"
 	ConfVerFieldName     = "ConfVer__"
+	ContextFieldName     = "Context__"
+	LogFieldName         = "Log__"
+	FilesFieldName       = "Files__"
+	PageFieldName        = "Page__"
+	PerPageFieldName     = "PerPage__"
+	HeadersFieldName     = "Headers__"
+	EventsFieldName      = "Events__"
+	SocketFieldName      = "Socket__"
+	RequestIdFieldName   = "RequestId__"
 
 	maxVersion = 99
+
+	// Route var of the version in path, see Conf.PathVersioning
+	apiVersionVar = "apiVersion"
 )
 
 const (
 	_ HandlerType = iota
 	HandlerTypeJson
 	HandlerTypeHtml
+	// Server-Sent Events, see AddSSE
+	HandlerTypeSSE
+	// WebSocket, see AddWebSocket
+	HandlerTypeWebSocket
 )
 
 var decoder = schema.NewDecoder()
 
-var metrics_req_dur gkmetrics.Histogram
-
-var metrics_query_count map[string]gkmetrics.Counter
-
 type HandlerType int
 
 type httpFunc struct {
@@ -52,11 +62,28 @@ type httpFunc struct {
 	hasContent     bool
 	hasRequest     bool
 	hasConfVer     bool
+	hasContext     bool
+	hasLog         bool
+	hasFiles       bool
+	hasPage        bool
+	hasPerPage     bool
+	hasHeaders     bool
+	hasEvents      bool
+	hasSocket      bool
+	hasRequestId   bool
 	dummyInput     bool
+	validate       bool
 	allowAnonymous bool
+	roles          []appgo.Role
+	perms          []string
+	headerFields   []headerField
+	rangeFields    []rangeField
+	files          *fileRules
 	inputType      reflect.Type
 	contentType    reflect.Type
 	funcValue      reflect.Value
+	// Calls the func without reflection if set, see RegisterJSON
+	direct func(input reflect.Value) []reflect.Value
 }
 
 type handler struct {
@@ -67,87 +94,206 @@ type handler struct {
 	supports []string
 	ts       TokenStore
 	renderer *render.Render
+	// Deprecation info from META, "deprecated" and "sunset" tags
+	deprecated bool
+	sunset     time.Time
+	// Max request body size, see bodyLimit
+	maxBody *int64
+	// From META tag "requireHeaders"
+	requiredHeaders []string
+	// Error codes the API declares to reply, from META tag "errCodes"
+	errCodes []appgo.ErrCode
+	// A/B variants of template, from META tag "variants"
+	variants []templateVariant
+	// Of calling the API func, see callTimeout
+	timeout time.Duration
+	// Reply ETags and 304s, from META tag "etag"
+	etag bool
+	// Reply raw values without the envelope, from META tag "raw"
+	raw bool
+	// Replay replies for retries, from META tag "idempotent"
+	idempotent bool
+	// META tag "strictJSON", "true" or "false" overrides Conf.StrictJSON
+	strictJSON string
+	// Reply 204 rather than {} to empty returns, from META tag "noContent"
+	noContent bool
+	// From META tag "middleware", see RegisterMiddleware
+	middlewares []Middleware
+	// Reply XML regardless of Accept, from META tag `reply:"xml"`
+	replyXML bool
+	// Overrides of Conf.Cors, see setCors
+	corsMeta *corsMeta
+	// Of the handler's own, see setRateLimit
+	limiter RateLimiter
+	limitBy string
+	// Of Page__ and PerPage__, see pageParams
+	perPage    int
+	maxPerPage int
 }
 
 func init() {
 	decoder.IgnoreUnknownKeys(true)
 
 	if appgo.Conf.Prometheus.Enable {
-		metrics_req_dur = gkprometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
-			Namespace: "appgo",
-			Subsystem: "http",
-			Name:      "request_duration_microseconds",
-			Help:      "Total time spent serving requests.",
-		}, []string{})
-		metrics_query_count = map[string]gkmetrics.Counter{
-			"all": gkprometheus.NewCounterFrom(stdprometheus.CounterOpts{
-				Namespace: "appgo",
-				Subsystem: "http",
-				Name:      "request_counter",
-				Help:      "Total served requests count.",
-			}, []string{})}
+		initMetrics()
 	}
 }
 
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defer addMetrics(r, time.Now())
+func (h *handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	auto := h.autoMethods()
+	if auto && r.Method == "HEAD" {
+		hw := &headWriter{ResponseWriter: rw}
+		defer hw.finish()
+		rw = hw
+	}
+	w := &accessWriter{ResponseWriter: rw}
+	var ver int
+	var user appgo.Id
+	reqSize := r.ContentLength
+	r, span := startSpan(r)
+	r = withAuthCache(r)
+	addInFlight(1)
+	defer func(begin time.Time) {
+		addInFlight(-1)
+		addMetrics(r, w, reqSize, begin)
+		logAccess(r, w, ver, user, begin)
+		endSpan(span, w, user)
+	}(time.Now())
 
-	method := r.Method
-	ver := apiVersionFromHeader(r)
+	if h.builtinCors() && h.cors(w, r) {
+		return
+	}
+	if auto && r.Method == "OPTIONS" && !h.hasFunc("OPTIONS") {
+		h.renderOptions(w)
+		return
+	}
+	method := h.funcMethod(r)
+	ver = h.resolveVersion(r, apiVersion(r))
 	if ver > 1 && ver <= maxVersion {
 		method += strutil.FromInt(ver)
+		r = r.WithContext(appgo.WithVersion(r.Context(), ver))
+	} else {
+		r = r.WithContext(appgo.WithVersion(r.Context(), 1))
 	}
 	f, ok := h.funcs[method]
+	// Resolved for the rate limit keyed by it, which comes before the
+	// rejections below so that bad tokens and versions are limited too
+	var role appgo.Role
+	if ok && (f.requireAuth || f.requireAdmin) {
+		user, role = h.authByRequest(r)
+	}
+	if !h.checkRateLimit(w, r, user) {
+		return
+	}
+	if h.deprecated && !h.checkDeprecation(w, r) {
+		return
+	}
 	if !ok {
-		h.renderError(w, appgo.NewApiErr(
+		h.renderError(w, r, appgo.NewApiErr(
 			appgo.ECodeNotFound,
 			"Bad API version"))
 		return
 	}
-	var input reflect.Value
-	if f.dummyInput {
-		input = reflect.ValueOf((*appgo.DummyInput)(nil))
-	} else {
-		input = reflect.New(f.inputType)
-		if err := decoder.Decode(input.Interface(), r.URL.Query()); err != nil {
-			h.renderError(w, appgo.NewApiErr(appgo.ECodeBadRequest, err.Error()))
-			return
-		}
-	}
 	if f.requireAuth {
-		user, _ := h.authByHeader(r)
-		s := input.Elem()
-		field := s.FieldByName(UserIdFieldName)
 		if user == 0 {
-			if f.allowAnonymous {
-				field.SetInt(appgo.AnonymousId)
-			} else {
-				h.renderError(w, appgo.NewApiErr(
+			if !f.allowAnonymous {
+				h.renderError(w, r, appgo.NewApiErr(
 					appgo.ECodeUnauthorized,
 					"either remove UserId__ in your input define, or add allowAnonymous tag",
 				))
 				return
 			}
-		} else {
-			field.SetInt(int64(user))
+		} else if !f.allowsRole(role) {
+			h.renderError(w, r, appgo.NewApiErr(
+				appgo.ECodeForbidden,
+				"role not allowed"))
+			return
+		} else if perm := f.missingPerm(role); perm != "" {
+			h.renderError(w, r, appgo.NewApiErr(
+				appgo.ECodeForbidden,
+				"permission required: "+perm).WithDetails(map[string]string{"permission": perm}))
+			return
 		}
 	} else if f.requireAdmin {
-		user, role := h.authByHeader(r)
-		s := input.Elem()
-		f := s.FieldByName(AdminUserIdFieldName)
 		if user == 0 || role != appgo.RoleWebAdmin {
-			h.renderError(w, appgo.NewApiErr(
+			h.renderError(w, r, appgo.NewApiErr(
 				appgo.ECodeUnauthorized,
 				"admin role required, you could remove AdminUserId__ in your input define"))
 			return
 		}
-		f.SetInt(int64(user))
+	}
+	if user != 0 {
+		r = r.WithContext(appgo.WithUser(r.Context(), user, role))
+	}
+	if aerr := h.checkRequiredHeaders(r); aerr != nil {
+		h.renderError(w, r, aerr)
+		return
+	}
+	if limit := h.bodyLimit(); limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	if aerr := h.decompressBody(w, r); aerr != nil {
+		h.renderError(w, r, aerr)
+		return
+	}
+	idem, aerr := h.idempotentRequest(r)
+	if aerr != nil {
+		h.renderError(w, r, aerr)
+		return
+	}
+	var input reflect.Value
+	if f.dummyInput {
+		input = reflect.ValueOf((*appgo.DummyInput)(nil))
+	} else {
+		input = reflect.New(f.inputType)
+		values, aerr := h.formValues(r, f)
+		if r.MultipartForm != nil {
+			// net/http only removes the temp files of the original
+			// request, not of those made by WithContext
+			defer r.MultipartForm.RemoveAll()
+		}
+		if aerr != nil {
+			h.renderError(w, r, aerr)
+			return
+		}
+		if aerr := checkFiles(r, f.files); aerr != nil {
+			h.renderError(w, r, aerr)
+			return
+		}
+		if err := decoder.Decode(input.Interface(), values); err != nil {
+			aerr := fieldErr("query", err)
+			if aerr == nil {
+				aerr = appgo.NewApiErr(appgo.ECodeBadRequest, err.Error())
+			}
+			h.renderError(w, r, aerr)
+			return
+		}
+		if aerr := setHeaderFields(input, f.headerFields, r); aerr != nil {
+			h.renderError(w, r, aerr)
+			return
+		}
+	}
+	if f.requireAuth {
+		// Only the field is of AnonymousId, the context has no user
+		id := user
+		if id == 0 {
+			id = appgo.AnonymousId
+		}
+		input.Elem().FieldByName(UserIdFieldName).SetInt(int64(id))
+	} else if f.requireAdmin {
+		input.Elem().FieldByName(AdminUserIdFieldName).SetInt(int64(user))
+	}
+	if idem != nil {
+		if idem.replay(h, w, r, user) {
+			return
+		}
+		defer idem.store(w, r)
 	}
 	if f.hasResId {
 		vars := mux.Vars(r)
 		id := appgo.IdFromStr(vars["id"])
 		if id == 0 {
-			h.renderError(w, appgo.NewApiErr(
+			h.renderError(w, r, appgo.NewApiErr(
 				appgo.ECodeNotFound,
 				"ResourceId ('{id}' in url) required, you could remove ResourceId__ in your input define"))
 			return
@@ -156,32 +302,141 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		f := s.FieldByName(ResIdFieldName)
 		f.SetInt(int64(id))
 	}
+	if f.hasPage || f.hasPerPage {
+		page, perPage, aerr := h.pageParams(r)
+		if aerr != nil {
+			h.renderError(w, r, aerr)
+			return
+		}
+		s := input.Elem()
+		if f.hasPage {
+			s.FieldByName(PageFieldName).SetInt(int64(page))
+		}
+		if f.hasPerPage {
+			s.FieldByName(PerPageFieldName).SetInt(int64(perPage))
+		}
+	}
 	if f.hasContent {
-		content := reflect.New(f.contentType.Elem())
-		if err := json.NewDecoder(r.Body).Decode(content.Interface()); err != nil {
-			h.renderError(w, appgo.NewApiErr(appgo.ECodeBadRequest, err.Error()))
+		content, aerr := h.decodeContent(r, f)
+		if aerr != nil {
+			h.renderError(w, r, aerr)
 			return
 		}
 		s := input.Elem()
 		f := s.FieldByName(ContentFieldName)
 		f.Set(content)
 	}
+	if len(f.rangeFields) > 0 {
+		if aerr := checkRanges(input, f.rangeFields); aerr != nil {
+			h.renderError(w, r, aerr)
+			return
+		}
+	}
+	if f.validate && appgo.Conf.Validation.Enable {
+		if aerr := validateInput(input); aerr != nil {
+			h.renderError(w, r, aerr)
+			return
+		}
+	}
+	if h.htype == HandlerTypeSSE {
+		var cancel context.CancelFunc
+		r, cancel = cancelOnDrain(r)
+		defer cancel()
+	}
+	if d := h.callTimeout(r); d > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	var sock *socket
+	if f.hasSocket {
+		if sock, r = upgradeSocket(w, r); sock == nil {
+			return
+		}
+	}
+	// Nothing fails between opening the transaction and the call
+	tx, r, aerr := beginTx(r)
+	if aerr != nil {
+		h.renderError(w, r, aerr)
+		return
+	}
 	if f.hasRequest {
 		s := input.Elem()
 		f := s.FieldByName(RequestFieldName)
 		f.Set(reflect.ValueOf(r))
 	}
+	if f.hasRequestId {
+		s := input.Elem()
+		f := s.FieldByName(RequestIdFieldName)
+		f.SetString(appgo.RequestIDFromContext(r.Context()))
+	}
 	if f.hasConfVer {
 		ver := confVersionFromHeader(r)
 		s := input.Elem()
 		f := s.FieldByName(ConfVerFieldName)
 		f.Set(reflect.ValueOf(ver))
 	}
-	argsIn := []reflect.Value{input}
-	returns := f.funcValue.Call(argsIn)
+	if f.hasContext {
+		s := input.Elem()
+		f := s.FieldByName(ContextFieldName)
+		f.Set(reflect.ValueOf(r.Context()))
+	}
+	if f.hasFiles {
+		s := input.Elem()
+		f := s.FieldByName(FilesFieldName)
+		f.Set(reflect.ValueOf(uploadedFiles(r)))
+	}
+	if f.hasLog {
+		entry := logEntry(r).WithFields(log.Fields{
+			"route":  routeOf(r),
+			"method": method,
+			"user":   user,
+		})
+		s := input.Elem()
+		f := s.FieldByName(LogFieldName)
+		f.Set(reflect.ValueOf(entry))
+	}
+	var headers http.Header
+	if f.hasHeaders {
+		headers = make(http.Header)
+		s := input.Elem()
+		f := s.FieldByName(HeadersFieldName)
+		f.Set(reflect.ValueOf(headers))
+	}
+	var sink *eventSink
+	if f.hasEvents {
+		sink = newEventSink(w, r)
+		defer sink.close()
+		s := input.Elem()
+		f := s.FieldByName(EventsFieldName)
+		f.Set(reflect.ValueOf(sink))
+	}
+	if sock != nil {
+		s := input.Elem()
+		f := s.FieldByName(SocketFieldName)
+		f.Set(reflect.ValueOf(sock))
+	}
+	returns, perr := h.invoke(f, input, r, tx)
+	if sock != nil {
+		h.endSocket(sock, returns, perr)
+		return
+	}
+	if perr != nil {
+		h.renderError(w, r, perr)
+		return
+	}
+	if h.htype == HandlerTypeSSE {
+		h.endEvents(w, r, sink, returns)
+		return
+	}
+	// Set before rendering, so headers of the reply itself such as
+	// Content-Type and Content-Encoding can't be overridden
+	for k, v := range headers {
+		w.Header()[k] = v
+	}
 	rl := len(returns)
 	if !(rl == 1 || rl == 2 || (rl == 3 && h.htype == HandlerTypeHtml)) {
-		h.renderError(w, appgo.NewApiErr(appgo.ECodeInternal, "Bad api-func format"))
+		h.renderError(w, r, appgo.NewApiErr(appgo.ECodeInternal, "Bad api-func format"))
 		return
 	}
 	// returns (reply, template-name, error) or (reply, error) or returns (error)
@@ -190,52 +445,106 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if retErr.IsNil() {
 		if rl == 3 {
 			template := returns[1].Interface().(string)
-			h.renderHtml(w, template, returns[0].Interface())
+			h.renderHtml(w, r, template, returns[0].Interface())
 		} else if rl == 2 {
-			h.renderData(w, returns[0].Interface())
-		} else { // Empty return
-			h.renderData(w, map[string]string{})
+			h.renderData(w, r, returns[0].Interface())
+		} else if h.noContent { // Empty return
+			h.renderData(w, r, appgo.NoContent{})
+		} else {
+			h.renderData(w, r, map[string]string{})
 		}
 	} else {
-		if aerr, ok := retErr.Interface().(*appgo.ApiError); !ok {
-			aerr = appgo.NewApiErr(appgo.ECodeInternal, "Bad api-func format")
-		} else {
-			if h.htype == HandlerTypeHtml && aerr.Code == appgo.ECodeRedirect {
-				http.Redirect(w, r, aerr.Msg, http.StatusFound)
-				return
+		aerr, ok := retErr.Interface().(*appgo.ApiError)
+		if !ok {
+			h.renderError(w, r, appgo.NewApiErr(appgo.ECodeInternal, "Bad api-func format"))
+			return
+		} else if h.htype == HandlerTypeHtml && aerr.Code == appgo.ECodeRedirect {
+			http.Redirect(w, r, aerr.Msg, http.StatusFound)
+			return
+		}
+		h.writeError(w, r, aerr)
+	}
+}
+
+// call invokes the API func, a panic in it is logged with the stack,
+// reported and turned into an internal ApiError.
+func (h *handler) call(f *httpFunc, input reflect.Value,
+	r *http.Request) (returns []reflect.Value, aerr *appgo.ApiError) {
+	defer func() {
+		if p := recover(); p != nil {
+			stack := debug.Stack()
+			logEntry(r).WithFields(log.Fields{
+				"panic": p,
+				"path":  r.URL.Path,
+				"stack": string(stack),
+			}).Errorln("API func panicked")
+			addPanicMetrics(r)
+			if rep := panicReporter; rep != nil {
+				rep(r, p, stack)
+			}
+			msg := "Internal error"
+			if appgo.Conf.DevMode {
+				msg = fmt.Sprint("panic: ", p)
 			}
-			h.renderError(w, aerr)
+			aerr = appgo.NewApiErr(appgo.ECodeInternal, msg)
 		}
+	}()
+	if f.direct != nil {
+		return f.direct(input), nil
 	}
+	return f.funcValue.Call([]reflect.Value{input}), nil
 }
 
-func addMetrics(r *http.Request, begin time.Time) {
-	if !appgo.Conf.Prometheus.Enable {
-		return
+// routeOf returns the path template of the matched route, falls back
+// to the raw path when not routed by mux.
+func routeOf(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
 	}
-	metrics_req_dur.Observe(float64(time.Since(begin) / time.Microsecond))
+	return r.URL.Path
+}
+
+type authCacheKey struct{}
+
+// requestAuth is the user of a request, authenticated once however many
+// times authByRequest is called, as token stores may be remote.
+type requestAuth struct {
+	once sync.Once
+	user appgo.Id
+	role appgo.Role
+}
 
-	path := r.RequestURI
-	if i := strings.IndexByte(path, '?'); i > 0 {
-		path = path[:i]
-	}
-	path = strings.Replace(path, "/", "_", -1)
-	key := r.Method + path
-	if _, ok := metrics_query_count[key]; !ok {
-		metrics_query_count[key] = gkprometheus.NewCounterFrom(stdprometheus.CounterOpts{
-			Namespace: "appgo",
-			Subsystem: "http",
-			Name:      "request_counter_" + key,
-			Help:      fmt.Sprintf("Total served %s requests count.", key),
-		}, []string{})
-	}
-	metrics_query_count["all"].Add(1)
-	metrics_query_count[key].Add(1)
+// withAuthCache adds the cache of the user to r, unless it has the one
+// of the batch it's a sub-request of.
+func withAuthCache(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(authCacheKey{}).(*requestAuth); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), authCacheKey{}, &requestAuth{}))
+}
 
+// authByRequest authenticates the user token, or failing that the
+// service token of the request.
+func (h *handler) authByRequest(r *http.Request) (appgo.Id, appgo.Role) {
+	a, ok := r.Context().Value(authCacheKey{}).(*requestAuth)
+	if !ok {
+		return h.authenticate(r)
+	}
+	a.once.Do(func() { a.user, a.role = h.authenticate(r) })
+	return a.user, a.role
+}
+
+func (h *handler) authenticate(r *http.Request) (appgo.Id, appgo.Role) {
+	if user, role := h.authByToken(r); user != 0 {
+		return user, role
+	}
+	return authService(r)
 }
 
-func (h *handler) authByHeader(r *http.Request) (appgo.Id, appgo.Role) {
-	token := auth.Token(r.Header.Get(appgo.CustomTokenHeaderName))
+func (h *handler) authByToken(r *http.Request) (appgo.Id, appgo.Role) {
+	token := tokenFromRequest(r)
 	user, role := token.Validate()
 	if user == 0 {
 		return 0, 0
@@ -246,6 +555,15 @@ func (h *handler) authByHeader(r *http.Request) (appgo.Id, appgo.Role) {
 	return user, role
 }
 
+// apiVersion reads the version from path like /v2/users, falls back
+// to the version header.
+func apiVersion(r *http.Request) int {
+	if v := mux.Vars(r)[apiVersionVar]; v != "" {
+		return strutil.ToInt(v)
+	}
+	return apiVersionFromHeader(r)
+}
+
 func apiVersionFromHeader(r *http.Request) int {
 	v := r.Header.Get(appgo.CustomVersionHeaderName)
 	return strutil.ToInt(v)
@@ -262,34 +580,37 @@ func newHandler(funcSet interface{}, htype HandlerType,
 	// Let if panic if funSet's type is not right
 	path := ""
 	template := ""
+	var meta reflect.StructTag
 	t := reflect.TypeOf(funcSet).Elem()
 	if field, ok := t.FieldByName("META"); !ok {
 		log.Panicln("Bad META setting (path, template)")
 	} else {
-		if p := field.Tag.Get("path"); p == "" {
+		meta = field.Tag
+		if p := meta.Get("path"); p == "" {
 			log.Panicln("Empty API path")
 		} else {
 			path = p
 		}
 		if htype == HandlerTypeHtml {
-			t := field.Tag.Get("template")
+			t := meta.Get("template")
 			template = t
 		}
 	}
 	structVal := reflect.Indirect(reflect.ValueOf(funcSet))
 	supports := make([]string, 0, 4)
 	if htype == HandlerTypeJson {
-		methods := []string{"GET", "POST", "PUT", "DELETE"}
+		methods := []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
 		for _, m := range methods {
 			for i := 1; i <= maxVersion; i++ { //versions
+				vm := m
 				if i > 1 {
-					m += strutil.FromInt(i)
+					vm += strutil.FromInt(i)
 				}
-				if fun, err := newHttpFunc(structVal, m); err != nil {
+				if fun, err := newHttpFunc(structVal, vm); err != nil {
 					log.Panicln(err)
 				} else if fun != nil {
-					funcs[m] = fun
-					supports = append(supports, m)
+					funcs[vm] = fun
+					supports = append(supports, vm)
 				}
 			}
 		}
@@ -304,10 +625,80 @@ func newHandler(funcSet interface{}, htype HandlerType,
 		} else {
 			funcs["GET"] = fun
 		}
+	} else if htype == HandlerTypeSSE {
+		if fun, err := newHttpFunc(structVal, "SSE"); err != nil {
+			log.Panicln(err)
+		} else if fun == nil {
+			log.Panicln("No SSE function for sse")
+		} else if !fun.hasEvents || fun.funcValue.Type().NumOut() != 1 {
+			log.Panicln("SSE func needs Events__ and to return only an error")
+		} else {
+			funcs["GET"] = fun
+			supports = append(supports, "GET")
+		}
+	} else if htype == HandlerTypeWebSocket {
+		if fun, err := newHttpFunc(structVal, "WS"); err != nil {
+			log.Panicln(err)
+		} else if fun == nil {
+			log.Panicln("No WS function for websocket")
+		} else if !fun.hasSocket || fun.funcValue.Type().NumOut() != 1 {
+			log.Panicln("WS func needs Socket__ and to return only an error")
+		} else {
+			funcs["GET"] = fun
+			supports = append(supports, "GET")
+		}
 	} else {
 		log.Panicln("Bad handler type")
 	}
-	return &handler{htype, path, template, funcs, supports, ts, renderer}
+	h := &handler{
+		htype:    htype,
+		path:     path,
+		template: template,
+		funcs:    funcs,
+		supports: supports,
+		ts:       ts,
+		renderer: renderer,
+	}
+	h.setMeta(meta)
+	return h
+}
+
+// setMeta applies the META tags other than path and template.
+func (h *handler) setMeta(meta reflect.StructTag) {
+	if err := h.setDeprecation(meta); err != nil {
+		log.Panicln(err)
+	}
+	if err := h.setBodyLimit(meta); err != nil {
+		log.Panicln(err)
+	}
+	h.setRequiredHeaders(meta)
+	if err := h.setErrCodes(meta); err != nil {
+		log.Panicln(err)
+	}
+	if err := h.setVariants(meta.Get("variants")); err != nil {
+		log.Panicln(err)
+	}
+	if err := h.setTimeout(meta); err != nil {
+		log.Panicln(err)
+	}
+	h.etag = meta.Get("etag") == "true"
+	h.raw = meta.Get("raw") == "true"
+	h.idempotent = meta.Get("idempotent") == "true"
+	h.strictJSON = meta.Get("strictJSON")
+	h.noContent = meta.Get("noContent") == "true"
+	h.replyXML = meta.Get("reply") == "xml"
+	if err := h.setPagination(meta); err != nil {
+		log.Panicln(err)
+	}
+	if err := h.setRateLimit(meta); err != nil {
+		log.Panicln(err)
+	}
+	if err := h.setCors(meta); err != nil {
+		log.Panicln(err)
+	}
+	if err := h.setMiddlewares(meta.Get("middleware")); err != nil {
+		log.Panicln(err)
+	}
 }
 
 func newHttpFunc(structVal reflect.Value, fieldName string) (*httpFunc, error) {
@@ -315,6 +706,11 @@ func newHttpFunc(structVal reflect.Value, fieldName string) (*httpFunc, error) {
 	if !fieldVal.IsValid() {
 		return nil, nil
 	}
+	return httpFuncOf(fieldVal)
+}
+
+// httpFuncOf checks the input of API func fieldVal.
+func httpFuncOf(fieldVal reflect.Value) (*httpFunc, error) {
 	ftype := fieldVal.Type()
 	inNum := ftype.NumIn()
 	if inNum != 1 {
@@ -331,6 +727,8 @@ func newHttpFunc(structVal reflect.Value, fieldName string) (*httpFunc, error) {
 	inputType = inputType.Elem()
 	requireAuth := false
 	allowAnonymous := false
+	var roles []appgo.Role
+	var perms []string
 	if fromIdField, ok := inputType.FieldByName(UserIdFieldName); ok {
 		requireAuth = true
 		if fromIdField.Type.Kind() != reflect.Int64 {
@@ -338,6 +736,19 @@ func newHttpFunc(structVal reflect.Value, fieldName string) (*httpFunc, error) {
 		}
 		aa := fromIdField.Tag.Get("allowAnonymous")
 		allowAnonymous = (aa == "true")
+		var err error
+		if roles, err = parseRoles(fromIdField.Tag.Get("requireRole")); err != nil {
+			return nil, err
+		}
+		if allowAnonymous && len(roles) > 0 {
+			return nil, errors.New("allowAnonymous conflicts with requireRole")
+		}
+		if perms, err = parsePerms(fromIdField.Tag.Get("perm")); err != nil {
+			return nil, err
+		}
+		if allowAnonymous && len(perms) > 0 {
+			return nil, errors.New("allowAnonymous conflicts with perm")
+		}
 	}
 	requireAdmin := false
 	if fromIdType, ok := inputType.FieldByName(AdminUserIdFieldName); ok {
@@ -379,7 +790,118 @@ func newHttpFunc(structVal reflect.Value, fieldName string) (*httpFunc, error) {
 			return nil, errors.New("ConfVer needs to be Int64")
 		}
 	}
-	return &httpFunc{requireAuth, requireAdmin,
-		hasResId, hasContent, hasRequest, hasConfVer,
-		dummyInput, allowAnonymous, inputType, contentType, fieldVal}, nil
+	hasContext := false
+	if ctxType, ok := inputType.FieldByName(ContextFieldName); ok {
+		hasContext = true
+		if ctxType.Type != reflect.TypeOf((*context.Context)(nil)).Elem() {
+			return nil, errors.New("Context needs to be context.Context")
+		}
+	}
+	hasLog := false
+	if logType, ok := inputType.FieldByName(LogFieldName); ok {
+		hasLog = true
+		if logType.Type != reflect.TypeOf((*log.Entry)(nil)) {
+			return nil, errors.New("Log needs to be a pointer to logrus.Entry")
+		}
+	}
+	hasFiles := false
+	var files *fileRules
+	if filesType, ok := inputType.FieldByName(FilesFieldName); ok {
+		hasFiles = true
+		if filesType.Type != reflect.TypeOf(map[string][]*multipart.FileHeader(nil)) {
+			return nil, errors.New("Files needs to be map[string][]*multipart.FileHeader")
+		}
+		var err error
+		if files, err = parseFileRules(filesType.Tag); err != nil {
+			return nil, err
+		}
+	}
+	hasHeaders := false
+	if headersType, ok := inputType.FieldByName(HeadersFieldName); ok {
+		hasHeaders = true
+		if headersType.Type != reflect.TypeOf(http.Header(nil)) {
+			return nil, errors.New("Headers needs to be http.Header")
+		}
+	}
+	hasEvents := false
+	if eventsType, ok := inputType.FieldByName(EventsFieldName); ok {
+		hasEvents = true
+		if eventsType.Type != reflect.TypeOf((*appgo.EventSink)(nil)).Elem() {
+			return nil, errors.New("Events needs to be appgo.EventSink")
+		}
+	}
+	hasSocket := false
+	if socketType, ok := inputType.FieldByName(SocketFieldName); ok {
+		hasSocket = true
+		if socketType.Type != reflect.TypeOf((*appgo.Socket)(nil)).Elem() {
+			return nil, errors.New("Socket needs to be appgo.Socket")
+		}
+	}
+	hasRequestId := false
+	if idType, ok := inputType.FieldByName(RequestIdFieldName); ok {
+		hasRequestId = true
+		if idType.Type.Kind() != reflect.String {
+			return nil, errors.New("RequestId needs to be string")
+		}
+	}
+	hasPage := false
+	if pageType, ok := inputType.FieldByName(PageFieldName); ok {
+		hasPage = true
+		if pageType.Type.Kind() != reflect.Int {
+			return nil, errors.New("Page needs to be int")
+		}
+	}
+	hasPerPage := false
+	if perPageType, ok := inputType.FieldByName(PerPageFieldName); ok {
+		hasPerPage = true
+		if perPageType.Type.Kind() != reflect.Int {
+			return nil, errors.New("PerPage needs to be int")
+		}
+	}
+	var headerFields []headerField
+	var rangeFields []rangeField
+	if !dummyInput {
+		var err error
+		if headerFields, err = parseHeaderFields(inputType); err != nil {
+			return nil, err
+		}
+		if rangeFields, err = parseRangeFields(inputType, false); err != nil {
+			return nil, err
+		}
+		if hasContent && contentType.Elem().Kind() == reflect.Struct {
+			cfields, err := parseRangeFields(contentType.Elem(), true)
+			if err != nil {
+				return nil, err
+			}
+			rangeFields = append(rangeFields, cfields...)
+		}
+	}
+	return &httpFunc{
+		requireAuth:    requireAuth,
+		requireAdmin:   requireAdmin,
+		hasResId:       hasResId,
+		hasContent:     hasContent,
+		hasRequest:     hasRequest,
+		hasConfVer:     hasConfVer,
+		hasContext:     hasContext,
+		hasLog:         hasLog,
+		hasFiles:       hasFiles,
+		files:          files,
+		hasPage:        hasPage,
+		hasPerPage:     hasPerPage,
+		hasHeaders:     hasHeaders,
+		hasEvents:      hasEvents,
+		hasSocket:      hasSocket,
+		hasRequestId:   hasRequestId,
+		dummyInput:     dummyInput,
+		validate:       !dummyInput && hasValidateTags(inputType),
+		allowAnonymous: allowAnonymous,
+		roles:          roles,
+		perms:          perms,
+		headerFields:   headerFields,
+		rangeFields:    rangeFields,
+		inputType:      inputType,
+		contentType:    contentType,
+		funcValue:      fieldVal,
+	}, nil
 }
@@ -0,0 +1,1246 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/unrolled/render"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testTokenStore struct{}
+
+func (testTokenStore) Validate(token auth.Token) bool {
+	return true
+}
+
+func newTestHandler(api interface{}) *handler {
+	renderer := render.New(render.Options{Directory: "N/A"})
+	return newHandler(api, HandlerTypeJson, testTokenStore{}, renderer)
+}
+
+func serveTest(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAddMetricsConcurrent(t *testing.T) {
+	appgo.Conf.Prometheus.Enable = true
+	defer func() { appgo.Conf.Prometheus.Enable = false }()
+	initMetrics()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/race/"+strconv.Itoa(i), nil)
+			addMetrics(r, &accessWriter{}, r.ContentLength, time.Now())
+		}(i)
+	}
+	wg.Wait()
+	c := metrics_req_count_vec.WithLabelValues("GET", "/race/0", "200")
+	assert.Equal(t, float64(1), testutil.ToFloat64(c))
+}
+
+func TestMetricsByRoute(t *testing.T) {
+	appgo.Conf.Prometheus.Enable = true
+	defer func() { appgo.Conf.Prometheus.Enable = false }()
+	initMetrics()
+
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&userApi{}})
+	c := metrics_req_count_vec.WithLabelValues("GET", "/api/users/{id}", "200")
+	notFound := metrics_req_count_vec.WithLabelValues("GET", "/api/users/{id}", "404")
+	before, notFoundBefore := testutil.ToFloat64(c), testutil.ToFloat64(notFound)
+	serveTest(s, httptest.NewRequest("GET", "/api/users/1", nil))
+	serveTest(s, httptest.NewRequest("GET", "/api/users/2", nil))
+	serveTest(s, httptest.NewRequest("GET", "/api/users/0", nil))
+	assert.Equal(t, before+2, testutil.ToFloat64(c))
+	assert.Equal(t, notFoundBefore+1, testutil.ToFloat64(notFound))
+}
+
+func TestInFlightMetric(t *testing.T) {
+	appgo.Conf.Prometheus.Enable = true
+	defer func() { appgo.Conf.Prometheus.Enable = false }()
+	initMetrics()
+	inFlight := func() float64 {
+		mfs, err := stdprometheus.DefaultGatherer.Gather()
+		assert.NoError(t, err)
+		for _, mf := range mfs {
+			if mf.GetName() == "appgo_http_requests_in_flight" {
+				return mf.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return -1
+	}
+	drainStarted, drainRelease = make(chan struct{}), make(chan struct{})
+
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&drainApi{}})
+	done := make(chan struct{})
+	go func() {
+		serveTest(s, httptest.NewRequest("GET", "/api/drain", nil))
+		close(done)
+	}()
+	<-drainStarted
+	assert.Equal(t, float64(1), inFlight())
+	close(drainRelease)
+	<-done
+	assert.Equal(t, float64(0), inFlight())
+}
+
+type userApi struct {
+	META struct{} `path:"/users/{id}"`
+}
+
+func (userApi) GET(in *userInput) (appgo.Id, error) {
+	return appgo.Id(in.ResourceId__), nil
+}
+
+type userInput struct {
+	ResourceId__ int64
+}
+
+type versionedApi struct {
+	META struct{} `path:"/versioned"`
+}
+
+func (a versionedApi) GET(in *appgo.DummyInput) (string, error) {
+	return "v1", nil
+}
+
+func (a versionedApi) GET2(in *appgo.DummyInput) (string, error) {
+	return "v2", nil
+}
+
+func (a versionedApi) GET3(in *appgo.DummyInput) (string, error) {
+	return "v3", nil
+}
+
+func TestVersionedMethods(t *testing.T) {
+	h := newTestHandler(&versionedApi{})
+	for _, v := range []string{"", "2", "3"} {
+		r := httptest.NewRequest("GET", "/versioned", nil)
+		r.Header.Set(appgo.CustomVersionHeaderName, v)
+		w := serveTest(h, r)
+		if v == "" {
+			v = "1"
+		}
+		assert.Equal(t, `"v`+v+`"`, strings.TrimSpace(w.Body.String()))
+	}
+}
+
+type ctxApi struct {
+	META struct{} `path:"/ctx"`
+}
+
+type ctxInput struct {
+	Context__ context.Context
+}
+
+var ctxStarted = make(chan struct{}, 1)
+var ctxDone = make(chan error, 1)
+
+func (ctxApi) GET(in *ctxInput) (string, error) {
+	ctxStarted <- struct{}{}
+	select {
+	case <-in.Context__.Done():
+		ctxDone <- in.Context__.Err()
+	case <-time.After(5 * time.Second):
+		ctxDone <- nil
+	}
+	return "", nil
+}
+
+func TestContextCancelledOnDisconnect(t *testing.T) {
+	srv := httptest.NewServer(newTestHandler(&ctxApi{}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, _ := http.NewRequest("GET", srv.URL+"/ctx", nil)
+	go http.DefaultClient.Do(r.WithContext(ctx))
+	<-ctxStarted
+	cancel()
+	assert.Equal(t, context.Canceled, <-ctxDone)
+}
+
+type panicApi struct {
+	META struct{} `path:"/panic" template:"panic"`
+}
+
+func (panicApi) GET(in *appgo.DummyInput) (string, error) {
+	var m map[string]int
+	m["boom"] = 1
+	return "", nil
+}
+
+func (panicApi) HTML(in *appgo.DummyInput) (string, error) {
+	panic("boom")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	h := newTestHandler(&panicApi{})
+	w := serveTest(h, httptest.NewRequest("GET", "/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	var aerr appgo.ApiError
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &aerr))
+	assert.Equal(t, appgo.ErrCode(appgo.ECodeInternal), aerr.Code)
+	assert.Equal(t, "Internal error", aerr.Msg)
+
+	renderer := render.New(render.Options{Directory: "N/A"})
+	h = newHandler(&panicApi{}, HandlerTypeHtml, testTokenStore{}, renderer)
+	w = serveTest(h, httptest.NewRequest("GET", "/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestPanicReporter(t *testing.T) {
+	appgo.Conf.Prometheus.Enable = true
+	defer func() { appgo.Conf.Prometheus.Enable = false }()
+	initMetrics()
+	var reported []interface{}
+	var stack string
+	SetPanicReporter(func(r *http.Request, p interface{}, s []byte) {
+		reported = append(reported, p)
+		stack = string(s)
+	})
+	defer SetPanicReporter(nil)
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&panicApi{}})
+	c := metrics_req_count_vec.WithLabelValues("GET", "/api/panic", "500")
+	before := testutil.ToFloat64(c)
+
+	w := serveTest(s, httptest.NewRequest("GET", "/api/panic", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	if assert.Len(t, reported, 1) {
+		assert.Contains(t, fmt.Sprint(reported[0]), "nil map")
+		assert.Contains(t, stack, "panicApi.GET")
+	}
+	assert.Equal(t, before+1, testutil.ToFloat64(c))
+	mfs, err := stdprometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	panics := 0.0
+	for _, mf := range mfs {
+		if mf.GetName() == "appgo_http_panic_counter" {
+			panics = mf.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	assert.True(t, panics >= 1)
+}
+
+type badReplyApi struct {
+	META struct{} `path:"/bad"`
+}
+
+func (badReplyApi) GET(in *appgo.DummyInput) (interface{}, error) {
+	return map[string]interface{}{"ch": make(chan int)}, nil
+}
+
+func TestReplyEncodeError(t *testing.T) {
+	w := serveTest(newTestHandler(&badReplyApi{}), httptest.NewRequest("GET", "/bad", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	var aerr appgo.ApiError
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &aerr))
+	assert.Equal(t, appgo.ErrCode(appgo.ECodeInternal), aerr.Code)
+}
+
+type bodyContent struct {
+	Text string
+}
+
+type bodyInput struct {
+	Content__ *bodyContent
+}
+
+type bodyApi struct {
+	META struct{} `path:"/body"`
+}
+
+func (bodyApi) POST(in *bodyInput) (string, error) {
+	return in.Content__.Text, nil
+}
+
+type smallBodyApi struct {
+	META struct{} `path:"/body" maxBody:"16"`
+}
+
+func (smallBodyApi) POST(in *bodyInput) (string, error) {
+	return in.Content__.Text, nil
+}
+
+func postJSON(h http.Handler, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return serveTest(h, r)
+}
+
+type bigBodyApi struct {
+	META struct{} `path:"/body" maxBody:"0"`
+}
+
+func (bigBodyApi) POST(in *bodyInput) (string, error) {
+	return in.Content__.Text, nil
+}
+
+func withMaxBody(limit int64) func() {
+	c := appgo.Conf.MaxBodyBytes
+	appgo.Conf.MaxBodyBytes = &limit
+	return func() { appgo.Conf.MaxBodyBytes = c }
+}
+
+func TestBodyLimit(t *testing.T) {
+	huge := `{"Text":"` + strings.Repeat("x", defaultMaxBodyBytes) + `"}`
+	w := postJSON(newTestHandler(&bodyApi{}), "/body", huge)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "default")
+	assert.Contains(t, w.Body.String(), "request body too large")
+	defer withMaxBody(0)()
+	w = postJSON(newTestHandler(&bodyApi{}), "/body", huge)
+	assert.Equal(t, http.StatusOK, w.Code, "unlimited")
+
+	*appgo.Conf.MaxBodyBytes = 64
+	body := `{"Text":"` + strings.Repeat("x", 30) + `"}`
+	w = postJSON(newTestHandler(&bodyApi{}), "/body", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = postJSON(newTestHandler(&bodyApi{}), "/body", `{"Text":"`+strings.Repeat("x", 100)+`"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "request body too large")
+
+	w = postJSON(newTestHandler(&smallBodyApi{}), "/body", body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "request body too large")
+	w = postJSON(newTestHandler(&bigBodyApi{}), "/body", huge)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Panics(t, func() {
+		newTestHandler(&struct {
+			META struct{} `path:"/body" maxBody:"-1"`
+			bodyApi
+		}{})
+	})
+}
+
+type uploadInput struct {
+	Title   string
+	Files__ map[string][]*multipart.FileHeader
+}
+
+type uploadApi struct {
+	META struct{} `path:"/upload"`
+}
+
+func (uploadApi) POST(in *uploadInput) (map[string]string, error) {
+	fh := in.Files__["file"][0]
+	f, err := fh.Open()
+	if err != nil {
+		return nil, appgo.NewApiErr(appgo.ECodeInternal, err.Error())
+	}
+	defer f.Close()
+	data, _ := ioutil.ReadAll(f)
+	return map[string]string{
+		"title":    in.Title,
+		"filename": fh.Filename,
+		"data":     string(data),
+	}, nil
+}
+
+func TestMultipartUpload(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("Title", "hello")
+	fw, _ := mw.CreateFormFile("file", "a.txt")
+	fw.Write([]byte("file content"))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := serveTest(newTestHandler(&uploadApi{}), r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reply map[string]string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &reply))
+	assert.Equal(t, "hello", reply["title"])
+	assert.Equal(t, "a.txt", reply["filename"])
+	assert.Equal(t, "file content", reply["data"])
+
+	r = httptest.NewRequest("POST", "/upload", strings.NewReader("broken"))
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=xxx")
+	w = serveTest(newTestHandler(&uploadApi{}), r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+type spillInput struct {
+	Files__ map[string][]*multipart.FileHeader `maxMemory:"1"`
+}
+
+type spillApi struct {
+	META struct{} `path:"/spill"`
+}
+
+func (spillApi) POST(in *spillInput) (int, error) {
+	files, err := ioutil.ReadDir(os.TempDir())
+	return len(files), err
+}
+
+func TestMultipartTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "a.bin")
+	fw.Write(bytes.Repeat([]byte("x"), 1<<20))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/spill", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := serveTest(newTestHandler(&spillApi{}), r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// Saved to a temp file while serving
+	assert.Equal(t, "1", w.Body.String())
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+type imageInput struct {
+	Files__ map[string][]*multipart.FileHeader `maxFileSize:"64" fileTypes:"image/*"`
+}
+
+type imageApi struct {
+	META struct{} `path:"/image"`
+}
+
+func (imageApi) POST(in *imageInput) (int, error) {
+	return len(in.Files__["image"]), nil
+}
+
+func TestUploadRules(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n"
+	upload := func(data string) (*httptest.ResponseRecorder, *appgo.ApiError) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("image", "a.png")
+		fw.Write([]byte(data))
+		mw.Close()
+		r := httptest.NewRequest("POST", "/image", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := serveTest(newTestHandler(&imageApi{}), r)
+		var aerr appgo.ApiError
+		json.Unmarshal(w.Body.Bytes(), &aerr)
+		return w, &aerr
+	}
+	w, _ := upload(png + "pixels")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Body.String())
+
+	w, aerr := upload("just text")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, map[string]string{"files.image": "type not allowed: text/plain"}, aerr.Fields)
+
+	w, aerr = upload(png + strings.Repeat("x", 64))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, map[string]string{"files.image": "larger than 64 bytes"}, aerr.Fields)
+}
+
+type formInput struct {
+	Title string
+	Count int
+}
+
+type formApi struct {
+	META struct{} `path:"/form"`
+}
+
+func (formApi) POST(in *formInput) (string, error) {
+	return fmt.Sprintf("%s:%d", in.Title, in.Count), nil
+}
+
+func TestUrlencodedForm(t *testing.T) {
+	r := httptest.NewRequest("POST", "/form?Count=1", strings.NewReader("Title=hello&Count=2"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := serveTest(newTestHandler(&formApi{}), r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"hello:2"`, w.Body.String())
+
+	r = httptest.NewRequest("POST", "/form", strings.NewReader("Count=many"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = serveTest(newTestHandler(&formApi{}), r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDecodeContent(t *testing.T) {
+	cases := []struct {
+		ctype string
+		body  string
+	}{
+		{"", `{"Text":"hi"}`},
+		{"application/json; charset=UTF-8", `{"Text":"hi"}`},
+		{"application/x-www-form-urlencoded", `Text=hi`},
+		{"text/xml", `<bodyContent><Text>hi</Text></bodyContent>`},
+		{"application/xml", `<bodyContent><Text>hi</Text></bodyContent>`},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/body", strings.NewReader(c.body))
+		if c.ctype != "" {
+			r.Header.Set("Content-Type", c.ctype)
+		}
+		w := serveTest(newTestHandler(&bodyApi{}), r)
+		assert.Equal(t, http.StatusOK, w.Code, c.ctype)
+		assert.Equal(t, `"hi"`, w.Body.String(), c.ctype)
+	}
+
+	r := httptest.NewRequest("POST", "/body", strings.NewReader("hi"))
+	r.Header.Set("Content-Type", "text/plain")
+	w := serveTest(newTestHandler(&bodyApi{}), r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+type headerInput struct {
+	Device string `header:"X-Device-Id,required"`
+	Lang   string `header:"Accept-Language"`
+}
+
+type headerApi struct {
+	META struct{} `path:"/headers" requireHeaders:"X-Signature"`
+}
+
+func (headerApi) GET(in *headerInput) (string, error) {
+	return in.Device + "," + in.Lang, nil
+}
+
+func TestRequiredHeaders(t *testing.T) {
+	h := newTestHandler(&headerApi{})
+	newReq := func(headers ...string) *http.Request {
+		r := httptest.NewRequest("GET", "/headers?Device=spoofed", nil)
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		return r
+	}
+
+	w := serveTest(h, newReq("X-Signature", "sig", "X-Device-Id", "d1", "Accept-Language", "en"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"d1,en"`, w.Body.String())
+
+	w = serveTest(h, newReq("X-Signature", "sig", "X-Device-Id", "d1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"d1,"`, w.Body.String())
+
+	w = serveTest(h, newReq("X-Device-Id", "d1"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "missing header: X-Signature")
+
+	w = serveTest(h, newReq("X-Signature", "sig"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "missing header: X-Device-Id")
+}
+
+type signupContent struct {
+	Email string `validate:"required,email"`
+}
+
+type signupInput struct {
+	Name      string `validate:"required"`
+	Age       int    `validate:"min=18"`
+	Content__ *signupContent
+}
+
+type signupApi struct {
+	META struct{} `path:"/signup"`
+}
+
+func (signupApi) POST(in *signupInput) (string, error) {
+	return in.Name, nil
+}
+
+func TestValidation(t *testing.T) {
+	h := newTestHandler(&signupApi{})
+	w := postJSON(h, "/signup?Age=3", `{}`)
+	assert.Equal(t, http.StatusOK, w.Code, "validation is opt-in")
+
+	appgo.Conf.Validation.Enable = true
+	defer func() { appgo.Conf.Validation.Enable = false }()
+
+	w = postJSON(h, "/signup?Name=tom&Age=20", `{"Email":"tom@example.com"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"tom"`, w.Body.String())
+
+	w = postJSON(h, "/signup?Age=3", `{"Email":"tom"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, "Name(required)")
+	assert.Contains(t, body, "Age(min)")
+	assert.Contains(t, body, "Content__.Email(email)")
+	var aerr appgo.ApiError
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &aerr))
+	assert.Equal(t, "required", aerr.Fields["Name"])
+	assert.Equal(t, "email", aerr.Fields["Content__.Email"])
+	assert.Contains(t, aerr.Fields["Age"], "min=")
+
+	w = postJSON(h, "/signup?Name=tom&Age=20", `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Content__.Email(required)")
+}
+
+func postGzip(h http.Handler, path string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "gzip")
+	return serveTest(h, r)
+}
+
+func gzipData(s string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(s))
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestGzipBody(t *testing.T) {
+	defer withMaxBody(1024)()
+	h := newTestHandler(&bodyApi{})
+
+	w := postGzip(h, "/body", gzipData(`{"Text":"hi"}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"hi"`, w.Body.String())
+
+	// Compresses to far less than the limit
+	bomb := gzipData(`{"Text":"` + strings.Repeat("x", 4096) + `"}`)
+	assert.True(t, len(bomb) < 1024)
+	w = postGzip(h, "/body", bomb)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "request body too large")
+
+	w = postGzip(h, "/body", []byte("not gzip at all"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "corrupt gzip body")
+
+	corrupt := gzipData(`{"Text":"hi"}`)
+	corrupt[len(corrupt)-5]++ // checksum
+	w = postGzip(h, "/body", corrupt)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "corrupt gzip body")
+}
+
+func TestBodyTransformer(t *testing.T) {
+	SetBodyTransformer("application/json", func(r *http.Request, body []byte) ([]byte, error) {
+		if bytes.Contains(body, []byte("fail")) {
+			return nil, errors.New("legacy body not supported")
+		}
+		return bytes.Replace(body, []byte(`"text"`), []byte(`"Text"`), 1), nil
+	})
+	defer SetBodyTransformer("application/json", nil)
+	h := newTestHandler(&bodyApi{})
+
+	w := postJSON(h, "/body", `{"text":"legacy"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"legacy"`, w.Body.String())
+
+	w = postJSON(h, "/body", `{"text":"fail"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "legacy body not supported")
+
+	r := httptest.NewRequest("POST", "/body", strings.NewReader("Text=form"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = serveTest(h, r)
+	assert.Equal(t, `"form"`, w.Body.String())
+}
+
+type pageContent struct {
+	Score float64 `min:"0" max:"1" onRange:"clamp"`
+}
+
+type pageInput struct {
+	Page      int `min:"1" onRange:"reject"`
+	Limit     int `min:"1" max:"100" onRange:"clamp"`
+	Content__ *pageContent
+}
+
+type pageApi struct {
+	META struct{} `path:"/page"`
+}
+
+func (pageApi) POST(in *pageInput) (string, error) {
+	return fmt.Sprintf("%d,%d,%g", in.Page, in.Limit, in.Content__.Score), nil
+}
+
+func TestRanges(t *testing.T) {
+	h := newTestHandler(&pageApi{})
+	for query, want := range map[string]string{
+		"Page=1&Limit=1":     `"1,1,0.5"`,
+		"Page=1&Limit=100":   `"1,100,0.5"`,
+		"Page=2&Limit=0":     `"2,1,0.5"`,
+		"Page=2&Limit=10000": `"2,100,0.5"`,
+	} {
+		w := postJSON(h, "/page?"+query, `{"Score":0.5}`)
+		assert.Equal(t, want, w.Body.String(), query)
+	}
+	w := postJSON(h, "/page?Page=1&Limit=1", `{"Score":3}`)
+	assert.Equal(t, `"1,1,1"`, w.Body.String())
+
+	w = postJSON(h, "/page?Page=0&Limit=10", `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Page out of range [1, +inf]")
+}
+
+type slowInput struct {
+	Sleep     int
+	Context__ context.Context
+}
+
+type slowApi struct {
+	META struct{} `path:"/slow" timeout:"50ms"`
+}
+
+func (slowApi) GET(in *slowInput) (string, error) {
+	select {
+	case <-time.After(time.Duration(in.Sleep) * time.Millisecond):
+	case <-in.Context__.Done():
+		// Ignored to mimic a func not honoring the context
+		time.Sleep(time.Duration(in.Sleep) * time.Millisecond)
+	}
+	return "done", nil
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	h := newTestHandler(&slowApi{})
+	w := serveTest(h, httptest.NewRequest("GET", "/slow?Sleep=1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"done"`, w.Body.String())
+
+	begin := time.Now()
+	w = serveTest(h, httptest.NewRequest("GET", "/slow?Sleep=1000", nil))
+	assert.True(t, time.Since(begin) < 500*time.Millisecond)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	var aerr appgo.ApiError
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &aerr))
+	assert.Equal(t, appgo.ErrCode(appgo.ECodeGatewayTimeout), aerr.Code)
+	assert.Equal(t, "timeout", aerr.Msg)
+}
+
+type patientApi struct {
+	META struct{} `path:"/patient"`
+}
+
+func (patientApi) GET(in *slowInput) (string, error) {
+	return slowApi{}.GET(in)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	appgo.Conf.RequestTimeout.Header = "X-Timeout-Ms"
+	appgo.Conf.RequestTimeout.Max = 2000
+	defer func() { appgo.Conf.RequestTimeout.Header, appgo.Conf.RequestTimeout.Max = "", 0 }()
+	h := newTestHandler(&patientApi{})
+	get := func(timeout string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/patient?Sleep=1000", nil)
+		r.Header.Set("X-Timeout-Ms", timeout)
+		return serveTest(h, r)
+	}
+	begin := time.Now()
+	w := get("50")
+	assert.True(t, time.Since(begin) < 500*time.Millisecond)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	// Bad values are ignored
+	assert.Equal(t, http.StatusOK, get("soon").Code)
+
+	r := httptest.NewRequest("GET", "/patient", nil)
+	r.Header.Set("X-Timeout-Ms", "3600000")
+	assert.Equal(t, 2*time.Second, h.callTimeout(r))
+	r.Header.Set("X-Timeout-Ms", "100")
+	assert.Equal(t, 100*time.Millisecond, h.callTimeout(r))
+	// The handler's timeout wins if shorter
+	r.Header.Set("X-Timeout-Ms", "1000")
+	assert.Equal(t, 50*time.Millisecond, newTestHandler(&slowApi{}).callTimeout(r))
+}
+
+func TestFieldErrors(t *testing.T) {
+	decode := func(w *httptest.ResponseRecorder) *appgo.ApiError {
+		var aerr appgo.ApiError
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &aerr))
+		return &aerr
+	}
+	w := serveTest(newTestHandler(&slowApi{}), httptest.NewRequest("GET", "/slow?Sleep=long", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	aerr := decode(w)
+	assert.Equal(t, appgo.ErrCode(appgo.ECodeBadRequest), aerr.Code)
+	assert.Equal(t, map[string]string{"query.Sleep": "expected int"}, aerr.Fields)
+	assert.Equal(t, "bad field query.Sleep: expected int", aerr.Msg)
+
+	w = postJSON(newTestHandler(&bodyApi{}), "/body", `{"Text":42}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	aerr = decode(w)
+	assert.Equal(t, appgo.ErrCode(appgo.ECodeBadRequest), aerr.Code)
+	assert.Equal(t, map[string]string{"body.Text": "expected string, got number"}, aerr.Fields)
+}
+
+type weekday int
+
+type typedQueryInput struct {
+	Since time.Time
+	Id    appgo.Id
+	Day   weekday
+	Price appgo.Money
+}
+
+type typedQueryApi struct {
+	META struct{} `path:"/typed"`
+}
+
+func (typedQueryApi) GET(in *typedQueryInput) (string, error) {
+	return fmt.Sprintf("%s,%d,%d,%s", in.Since.Format(time.RFC3339), in.Id, in.Day, in.Price), nil
+}
+
+func TestQueryConverters(t *testing.T) {
+	RegisterQueryConverter(weekday(0), func(s string) reflect.Value {
+		for i, name := range []string{"sun", "mon", "tue"} {
+			if s == name {
+				return reflect.ValueOf(weekday(i))
+			}
+		}
+		return reflect.Value{}
+	})
+	h := newTestHandler(&typedQueryApi{})
+
+	w := serveTest(h, httptest.NewRequest("GET",
+		"/typed?since=2023-01-02T15:04:05%2B08:00&id=42&day=tue&price=12.5+usd", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"2023-01-02T15:04:05+08:00,42,2,12.50 USD"`, w.Body.String())
+
+	for _, q := range []string{"since=yesterday", "id=abc", "day=fri", "price=12.5",
+		"price=1.234+USD", "price=1+XXX"} {
+		w = serveTest(h, httptest.NewRequest("GET", "/typed?"+q, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, q)
+	}
+}
+
+type oldApi struct {
+	META struct{} `path:"/old" deprecated:"true"`
+}
+
+func (oldApi) GET(in *appgo.DummyInput) (string, error) {
+	return "ok", nil
+}
+
+type sunsetApi struct {
+	META struct{} `path:"/sunset" sunset:"2000-01-02"`
+	oldApi
+}
+
+type futureSunsetApi struct {
+	META struct{} `path:"/future" sunset:"2999-01-02T15:04:05+08:00"`
+	oldApi
+}
+
+// deprecatedCount returns the deprecated_request_counter of path
+func deprecatedCount(t *testing.T, path string) float64 {
+	mfs, err := stdprometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != "appgo_http_deprecated_request_counter" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() == path {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestDeprecation(t *testing.T) {
+	appgo.Conf.Prometheus.Enable = true
+	defer func() { appgo.Conf.Prometheus.Enable = false }()
+	initMetrics()
+	get := func(api interface{}, path string) *httptest.ResponseRecorder {
+		return serveTest(newTestHandler(api), httptest.NewRequest("GET", path, nil))
+	}
+
+	before := deprecatedCount(t, "/old")
+	w := get(&oldApi{}, "/old")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Deprecation"))
+	assert.Empty(t, w.Header().Get("Sunset"))
+	assert.Equal(t, before+1, deprecatedCount(t, "/old"))
+
+	// Advisory unless enforced
+	w = get(&sunsetApi{}, "/sunset")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Deprecation"))
+	assert.Equal(t, "Sun, 02 Jan 2000 00:00:00 GMT", w.Header().Get("Sunset"))
+
+	appgo.Conf.Deprecation.EnforceSunset = true
+	defer func() { appgo.Conf.Deprecation.EnforceSunset = false }()
+	before = deprecatedCount(t, "/sunset")
+	w = get(&sunsetApi{}, "/sunset")
+	assert.Equal(t, http.StatusGone, w.Code)
+	assert.Contains(t, w.Body.String(), `"errcode"`)
+	assert.Equal(t, "Sun, 02 Jan 2000 00:00:00 GMT", w.Header().Get("Sunset"))
+	assert.Equal(t, before+1, deprecatedCount(t, "/sunset"))
+	w = get(&futureSunsetApi{}, "/future")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Wed, 02 Jan 2999 07:04:05 GMT", w.Header().Get("Sunset"))
+
+	w = get(&versionedApi{}, "/versioned")
+	assert.Empty(t, w.Header().Get("Deprecation"))
+
+	assert.Panics(t, func() {
+		newTestHandler(&struct {
+			META struct{} `path:"/bad" sunset:"2000-13-01"`
+			oldApi
+		}{})
+	})
+	assert.Panics(t, func() {
+		newTestHandler(&struct {
+			META struct{} `path:"/bad" sunset:"tomorrow"`
+			oldApi
+		}{})
+	})
+}
+
+// histogramOf returns the sample count and sum of a histogram series
+func histogramOf(t *testing.T, name, method, route string) (uint64, float64) {
+	mfs, err := stdprometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if (lp.GetName() == "method" && lp.GetValue() != method) ||
+					(lp.GetName() == "route" && lp.GetValue() != route) {
+					continue metrics
+				}
+			}
+			return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+		}
+	}
+	return 0, 0
+}
+
+func TestLatencyBuckets(t *testing.T) {
+	appgo.Conf.Prometheus.Enable = true
+	defer func() { appgo.Conf.Prometheus.Enable = false }()
+	initMetrics()
+	begin := time.Now()
+	metricsNow = func() time.Time { return begin.Add(300 * time.Millisecond) }
+	defer func() { metricsNow = time.Now }()
+
+	r := httptest.NewRequest("GET", "/clock", nil)
+	addMetrics(r, &accessWriter{}, r.ContentLength, begin)
+	mfs, err := stdprometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	counts := make(map[float64]uint64)
+	for _, mf := range mfs {
+		if mf.GetName() != "appgo_http_request_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "route" && lp.GetValue() == "/clock" {
+					for _, b := range m.GetHistogram().GetBucket() {
+						counts[b.GetUpperBound()] = b.GetCumulativeCount()
+					}
+				}
+			}
+		}
+	}
+	assert.Equal(t, uint64(0), counts[0.25])
+	assert.Equal(t, uint64(1), counts[0.5])
+
+	appgo.Conf.Prometheus.LatencyBuckets = []float64{0.1, 1}
+	defer func() { appgo.Conf.Prometheus.LatencyBuckets = nil }()
+	assert.Equal(t, []float64{0.1, 1}, latencyBuckets())
+}
+
+func TestPayloadSizeMetrics(t *testing.T) {
+	appgo.Conf.Prometheus.Enable = true
+	defer func() { appgo.Conf.Prometheus.Enable = false }()
+	initMetrics()
+
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&bodyApi{}})
+	body := `{"Text":"hello"}`
+	postJSON(s, "/api/body", body)
+
+	n, sum := histogramOf(t, "appgo_http_request_size_bytes", "POST", "/api/body")
+	assert.Equal(t, uint64(1), n)
+	assert.Equal(t, float64(len(body)), sum)
+	n, sum = histogramOf(t, "appgo_http_response_size_bytes", "POST", "/api/body")
+	assert.Equal(t, uint64(1), n)
+	assert.Equal(t, float64(len(`"hello"`)), sum)
+}
+
+type listInput struct {
+	Page__    int
+	PerPage__ int
+}
+
+type listApi struct {
+	META struct{} `path:"/list" perPage:"10" maxPerPage:"50"`
+}
+
+func (listApi) GET(in *listInput) (*appgo.Page, error) {
+	items := []int{}
+	for i := appgo.Offset(in.Page__, in.PerPage__); i < 120 && len(items) < in.PerPage__; i++ {
+		items = append(items, i)
+	}
+	return appgo.NewPage(items, in.Page__, in.PerPage__, 120), nil
+}
+
+func TestPagination(t *testing.T) {
+	h := newTestHandler(&listApi{})
+	get := func(query string) *appgo.Page {
+		w := serveTest(h, httptest.NewRequest("GET", "/list?"+query, nil))
+		if w.Code != http.StatusOK {
+			return nil
+		}
+		var p appgo.Page
+		json.Unmarshal(w.Body.Bytes(), &p)
+		return &p
+	}
+
+	p := get("")
+	assert.Equal(t, 1, p.Page)
+	assert.Equal(t, 10, p.PerPage)
+	assert.Len(t, p.Items, 10)
+	assert.True(t, p.HasMore)
+
+	p = get("page=0&per_page=-5")
+	assert.Equal(t, 1, p.Page)
+	assert.Equal(t, 10, p.PerPage)
+
+	p = get("page=3&per_page=1000000")
+	assert.Equal(t, 3, p.Page)
+	assert.Equal(t, 50, p.PerPage)
+	assert.Len(t, p.Items, 20)
+	assert.False(t, p.HasMore)
+
+	assert.Nil(t, get("page=abc"))
+	appgo.Conf.Pagination.RejectOverMax = true
+	defer func() { appgo.Conf.Pagination.RejectOverMax = false }()
+	assert.Nil(t, get("per_page=51"))
+	assert.NotNil(t, get("per_page=50"))
+}
+
+type createInput struct {
+	Headers__ http.Header
+	Content__ *bodyContent
+}
+
+type createApi struct {
+	META struct{} `path:"/things"`
+}
+
+func (createApi) POST(in *createInput) (string, error) {
+	in.Headers__.Set("Location", "/things/"+in.Content__.Text)
+	in.Headers__.Set("Content-Type", "text/plain")
+	return in.Content__.Text, nil
+}
+
+func TestResponseHeaders(t *testing.T) {
+	w := postJSON(newTestHandler(&createApi{}), "/things", `{"Text":"42"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "/things/42", w.Header().Get("Location"))
+	// Framework headers win
+	assert.Equal(t, "application/json; charset=UTF-8", w.Header().Get("Content-Type"))
+}
+
+type missingApi struct {
+	META struct{} `path:"/missing"`
+}
+
+func (missingApi) GET(in *appgo.DummyInput) (string, error) {
+	return "", appgo.NewApiErr(appgo.ECodeNotFound, "no such thing")
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	appgo.RegisterErrMessage(appgo.ECodeNotFound, "en", "Not found")
+	appgo.RegisterErrMessage(appgo.ECodeNotFound, "zh", "未找到")
+	get := func(h http.Handler, lang string) *appgo.ApiError {
+		r := httptest.NewRequest("GET", "/versioned", nil)
+		// No such version
+		r.Header.Set(appgo.CustomVersionHeaderName, "7")
+		r.Header.Set("Accept-Language", lang)
+		w := serveTest(h, r)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		var e appgo.ApiError
+		json.Unmarshal(w.Body.Bytes(), &e)
+		assert.Equal(t, appgo.ErrCode(appgo.ECodeNotFound), e.Code)
+		return &e
+	}
+	h := newTestHandler(&versionedApi{})
+	assert.Equal(t, "Not found", get(h, "").Msg)
+	assert.Equal(t, "Not found", get(h, "en-US").Msg)
+	assert.Equal(t, "未找到", get(h, "zh-CN,zh;q=0.9,en;q=0.8").Msg)
+	assert.Equal(t, "未找到", get(h, "fr, en;q=0.5, zh;q=0.8").Msg)
+	assert.Equal(t, "Not found", get(h, "fr").Msg)
+
+	// Messages of API funcs pass through
+	r := httptest.NewRequest("GET", "/missing", nil)
+	r.Header.Set("Accept-Language", "zh")
+	w := serveTest(newTestHandler(&missingApi{}), r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "no such thing")
+}
+
+type lenientBodyApi struct {
+	META struct{} `path:"/body" strictJSON:"false"`
+}
+
+func (lenientBodyApi) POST(in *bodyInput) (string, error) {
+	return in.Content__.Text, nil
+}
+
+func TestStrictJSON(t *testing.T) {
+	body := `{"Text":"a","Txet":"b"}`
+	w := postJSON(newTestHandler(&bodyApi{}), "/body", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	appgo.Conf.StrictJSON = true
+	defer func() { appgo.Conf.StrictJSON = false }()
+	w = postJSON(newTestHandler(&bodyApi{}), "/body", body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown field: Txet")
+	w = postJSON(newTestHandler(&bodyApi{}), "/body", `{"Text":"a"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = postJSON(newTestHandler(&lenientBodyApi{}), "/body", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+type createdApi struct {
+	META struct{} `path:"/things"`
+}
+
+func (createdApi) POST(in *bodyInput) (interface{}, error) {
+	if in.Content__.Text == "" {
+		return "nothing", nil
+	}
+	return &appgo.Created{
+		Location: "/things/" + in.Content__.Text,
+		Body:     map[string]string{"id": in.Content__.Text},
+	}, nil
+}
+
+func TestCreated(t *testing.T) {
+	h := newTestHandler(&createdApi{})
+	w := postJSON(h, "/things", `{"Text":"42"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/things/42", w.Header().Get("Location"))
+	assert.Equal(t, `{"id":"42"}`, w.Body.String())
+
+	w = postJSON(h, "/things", `{"Text":""}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+	assert.Equal(t, `"nothing"`, w.Body.String())
+}
+
+type removeApi struct {
+	META struct{} `path:"/things/{id}" noContent:"true"`
+}
+
+func (removeApi) DELETE(in *struct{ ResourceId__ int64 }) error {
+	return nil
+}
+
+func (removeApi) PUT(in *struct{ ResourceId__ int64 }) (interface{}, error) {
+	if in.ResourceId__ == 2 {
+		return appgo.NoContent{}, nil
+	}
+	return in.ResourceId__, nil
+}
+
+type keepApi struct {
+	META struct{} `path:"/kept/{id}"`
+}
+
+func (keepApi) DELETE(in *struct{ ResourceId__ int64 }) error {
+	return nil
+}
+
+func TestNoContent(t *testing.T) {
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&removeApi{}, &keepApi{}})
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	w := serve("DELETE", "/api/things/1")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Body.String())
+	w = serve("PUT", "/api/things/2")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Body.String())
+	w = serve("PUT", "/api/things/1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Body.String())
+
+	w = serve("DELETE", "/api/kept/1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "{}", w.Body.String())
+}
+
+type callerInput struct {
+	UserId__  int64 `allowAnonymous:"true"`
+	Context__ context.Context
+}
+
+type callerApi struct {
+	META struct{} `path:"/caller"`
+}
+
+func caller(ctx context.Context) string {
+	return fmt.Sprintf("v%d %d %d", appgo.VersionFromContext(ctx),
+		appgo.UserIDFromContext(ctx), appgo.RoleFromContext(ctx))
+}
+
+func (callerApi) GET(in *callerInput) (string, error) {
+	return caller(in.Context__) + " " + strconv.FormatInt(in.UserId__, 10), nil
+}
+
+func (callerApi) GET3(in *callerInput) (string, error) {
+	return caller(in.Context__) + " " + strconv.FormatInt(in.UserId__, 10), nil
+}
+
+func TestContextValues(t *testing.T) {
+	defer withTestTokens()()
+	h := newTestHandler(&callerApi{})
+	get := func(ver string, token auth.Token) string {
+		r := httptest.NewRequest("GET", "/caller", nil)
+		r.Header.Set(appgo.CustomVersionHeaderName, ver)
+		if token != "" {
+			r.Header.Set(appgo.CustomTokenHeaderName, string(token))
+		}
+		w := serveTest(h, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	// Anonymous ones have no user in the context
+	assert.Equal(t, `"v1 0 0 6666"`, get("", ""))
+	assert.Equal(t, `"v1 0 0 6666"`, get("", "bad"))
+	assert.Equal(t, `"v3 42 100 42"`, get("3", newTestToken(42)))
+	assert.Equal(t, `"v1 7 200 7"`, get("1", auth.NewToken(7, appgo.RoleWebAdmin)))
+}
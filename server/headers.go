@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// headerField is an input field filled from a request header, declared
+// with a tag like `header:"X-Device-Id,required"`.
+type headerField struct {
+	index    []int
+	name     string
+	required bool
+}
+
+// setRequiredHeaders reads META tag `requireHeaders:"X-Signature,X-Device"`.
+func (h *handler) setRequiredHeaders(meta reflect.StructTag) {
+	for _, name := range strings.Split(meta.Get("requireHeaders"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			h.requiredHeaders = append(h.requiredHeaders, http.CanonicalHeaderKey(name))
+		}
+	}
+}
+
+func parseHeaderFields(inputType reflect.Type) ([]headerField, error) {
+	var fields []headerField
+	for i := 0; i < inputType.NumField(); i++ {
+		sf := inputType.Field(i)
+		tag := sf.Tag.Get("header")
+		if tag == "" {
+			continue
+		}
+		if sf.Type.Kind() != reflect.String {
+			return nil, fmt.Errorf("Header field %s needs to be string", sf.Name)
+		}
+		parts := strings.Split(tag, ",")
+		hf := headerField{
+			index: sf.Index,
+			name:  http.CanonicalHeaderKey(strings.TrimSpace(parts[0])),
+		}
+		for _, opt := range parts[1:] {
+			if strings.TrimSpace(opt) == "required" {
+				hf.required = true
+			}
+		}
+		fields = append(fields, hf)
+	}
+	return fields, nil
+}
+
+func (h *handler) checkRequiredHeaders(r *http.Request) *appgo.ApiError {
+	for _, name := range h.requiredHeaders {
+		if r.Header.Get(name) == "" {
+			return missingHeaderErr(name)
+		}
+	}
+	return nil
+}
+
+// setHeaderFields always overwrites the fields, so that they can't be
+// spoofed with query params of the same name.
+func setHeaderFields(input reflect.Value, fields []headerField,
+	r *http.Request) *appgo.ApiError {
+	s := input.Elem()
+	for _, hf := range fields {
+		v := r.Header.Get(hf.name)
+		if v == "" && hf.required {
+			return missingHeaderErr(hf.name)
+		}
+		s.FieldByIndex(hf.index).SetString(v)
+	}
+	return nil
+}
+
+func missingHeaderErr(name string) *appgo.ApiError {
+	return appgo.NewApiErr(appgo.ECodeBadRequest, "missing header: "+name)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/redis"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultReadinessTimeout = 5 * time.Second
+
+// Checker checks a dependency for readiness probes, failing with an
+// error, e.g. the PingContext method of a *sql.DB.
+type Checker func(ctx context.Context) error
+
+type readinessCheck struct {
+	name string
+	fn   Checker
+}
+
+// Result of a check in replies of readiness probes
+type checkResult struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+var (
+	readinessMu     sync.Mutex
+	readinessChecks []readinessCheck
+)
+
+// AddReadinessCheck adds a check run for readiness probes, e.g. pinging
+// the database. The server is ready only if all checks pass.
+func AddReadinessCheck(name string, fn Checker) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	readinessChecks = append(readinessChecks, readinessCheck{name, fn})
+}
+
+// DBChecker pings the database.
+func DBChecker(db *sql.DB) Checker {
+	return db.PingContext
+}
+
+// RedisChecker pings the redis of Conf.Redis.
+func RedisChecker() Checker {
+	return func(ctx context.Context) error {
+		return redis.Ping()
+	}
+}
+
+// AddHealth serves liveness probes at Conf.Health.LivenessPath and
+// readiness probes at Conf.Health.ReadinessPath, /healthz and /readyz if
+// not set. They bypass auth and versioning.
+func (s *Server) AddHealth() {
+	liveness, readiness := appgo.Conf.Health.LivenessPath, appgo.Conf.Health.ReadinessPath
+	if liveness == "" {
+		liveness = "/healthz"
+	}
+	if readiness == "" {
+		readiness = "/readyz"
+	}
+	s.HandleFunc(liveness, func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+	}).Methods("GET", "HEAD")
+	s.HandleFunc(readiness, s.serveReadiness).Methods("GET", "HEAD")
+}
+
+func (s *Server) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	if s.shuttingDown() {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status": "shutting down",
+		})
+		return
+	}
+	timeout := defaultReadinessTimeout
+	if t := appgo.Conf.Health.Timeout; t > 0 {
+		timeout = time.Duration(t) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	results := runReadinessChecks(ctx)
+	failed := make(map[string]string)
+	for name, res := range results {
+		if res.Error != "" {
+			failed[name] = res.Error
+		}
+	}
+	if len(failed) == 0 {
+		writeHealth(w, http.StatusOK, map[string]interface{}{
+			"status": "ok",
+			"checks": results,
+		})
+		return
+	}
+	writeHealth(w, http.StatusServiceUnavailable, map[string]interface{}{
+		"status": "unavailable",
+		"checks": results,
+		"failed": failed,
+	})
+}
+
+// runReadinessChecks runs the checks concurrently, it returns the result
+// of each by name.
+func runReadinessChecks(ctx context.Context) map[string]checkResult {
+	readinessMu.Lock()
+	checks := append([]readinessCheck{}, readinessChecks...)
+	readinessMu.Unlock()
+	errs := make([]error, len(checks))
+	durs := make([]time.Duration, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c readinessCheck) {
+			defer wg.Done()
+			begin := time.Now()
+			done := make(chan error, 1)
+			go func() { done <- c.fn(ctx) }()
+			select {
+			case errs[i] = <-done:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+			}
+			durs[i] = time.Since(begin)
+		}(i, c)
+	}
+	wg.Wait()
+	results := make(map[string]checkResult)
+	for i, err := range errs {
+		res := checkResult{Status: "ok", DurationMs: int64(durs[i] / time.Millisecond)}
+		if err != nil {
+			res.Status, res.Error = "failed", err.Error()
+		}
+		results[checks[i].name] = res
+	}
+	return results
+}
+
+func writeHealth(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	defer func() { readinessChecks = nil }()
+	appgo.Conf.Health.ReadinessPath = "/ready"
+	defer func() { appgo.Conf.Health.ReadinessPath = "" }()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddHealth()
+	ready := func() (int, map[string]interface{}) {
+		w := serveTest(s, httptest.NewRequest("GET", "/ready", nil))
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	w := serveTest(s, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	code, _ := ready()
+	assert.Equal(t, http.StatusOK, code)
+
+	AddReadinessCheck("db", func(context.Context) error { return nil })
+	AddReadinessCheck("cache", func(context.Context) error { return nil })
+	code, body := ready()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body["status"])
+
+	AddReadinessCheck("upstream", func(context.Context) error { return errors.New("refused") })
+	code, body = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]interface{}{"upstream": "refused"}, body["failed"])
+	checks, _ := body["checks"].(map[string]interface{})
+	if assert.Len(t, checks, 3) {
+		db := checks["db"].(map[string]interface{})
+		assert.Equal(t, "ok", db["status"])
+		assert.Contains(t, db, "duration_ms")
+		upstream := checks["upstream"].(map[string]interface{})
+		assert.Equal(t, "failed", upstream["status"])
+		assert.Equal(t, "refused", upstream["error"])
+	}
+
+	// Tokens and versions are ignored
+	r := httptest.NewRequest("GET", "/healthz", nil)
+	r.Header.Set(appgo.CustomTokenHeaderName, "bad")
+	r.Header.Set(appgo.CustomVersionHeaderName, "99")
+	assert.Equal(t, http.StatusOK, serveTest(s, r).Code)
+}
+
+func TestReadinessTimeout(t *testing.T) {
+	defer func() { readinessChecks = nil }()
+	appgo.Conf.Health.Timeout = 1
+	defer func() { appgo.Conf.Health.Timeout = 0 }()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddHealth()
+	block := make(chan struct{})
+	defer close(block)
+	AddReadinessCheck("stuck", func(context.Context) error {
+		<-block
+		return nil
+	})
+	w := serveTest(s, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "deadline exceeded")
+
+	s.Shutdown(context.Background())
+	w = serveTest(s, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Contains(t, w.Body.String(), "shutting down")
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultReadHeaderTimeout = 10
+	defaultIdleTimeout       = 120
+)
+
+// Replaced in tests
+var serverTimeoutUnit = time.Second
+
+// newHTTPServer makes the server of handler with the timeouts and limits
+// of Conf.HttpServer.
+func newHTTPServer(handler http.Handler) *http.Server {
+	c := &appgo.Conf.HttpServer
+	timeout := func(n, def int) time.Duration {
+		if n == 0 {
+			n = def
+		}
+		if n < 0 {
+			return 0
+		}
+		return time.Duration(n) * serverTimeoutUnit
+	}
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: timeout(c.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       timeout(c.ReadTimeout, 0),
+		WriteTimeout:      timeout(c.WriteTimeout, 0),
+		IdleTimeout:       timeout(c.IdleTimeout, defaultIdleTimeout),
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+}
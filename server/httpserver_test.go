@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bufio"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServerTimeouts(t *testing.T) {
+	c := appgo.Conf.HttpServer
+	appgo.Conf.HttpServer.ReadHeaderTimeout = 5
+	appgo.Conf.HttpServer.ReadTimeout = 20
+	serverTimeoutUnit = 10 * time.Millisecond
+	defer func() {
+		appgo.Conf.HttpServer = c
+		serverTimeoutUnit = time.Second
+	}()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&bodyApi{}})
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newHTTPServer(s)
+	ts.Start()
+	defer ts.Close()
+	assert.Equal(t, 50*time.Millisecond, ts.Config.ReadHeaderTimeout)
+	assert.Equal(t, time.Duration(0), ts.Config.WriteTimeout)
+	assert.Equal(t, 1200*time.Millisecond, ts.Config.IdleTimeout)
+
+	// Slow headers are cut off
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /api/body HTTP/1.1\r\nHost: a\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = ioutil.ReadAll(conn)
+	assert.NoError(t, err, "closed by the server")
+
+	// So are slow bodies
+	conn, err = net.Dial("tcp", ts.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST /api/body HTTP/1.1\r\nHost: a\r\n" +
+		"Content-Type: application/json\r\nContent-Length: 100\r\n\r\n{\"Text\":"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, string(body), "timeout reading request body")
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// localizeErr returns err with the message registered for the client's
+// language, falling back to English, or err itself if none registered.
+func localizeErr(r *http.Request, err *appgo.ApiError) *appgo.ApiError {
+	for _, lang := range append(acceptLanguages(r), "en") {
+		if msg, ok := appgo.ErrMessage(err.Code, lang); ok {
+			localized := *err
+			localized.Msg = msg
+			return &localized
+		}
+	}
+	return err
+}
+
+// acceptLanguages returns the languages in Accept-Language by preference.
+func acceptLanguages(r *http.Request) []string {
+	type langQ struct {
+		lang string
+		q    float64
+	}
+	var langs []langQ
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(part, ";")
+		lang := strings.TrimSpace(fields[0])
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, langQ{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].q > langs[j].q
+	})
+	ret := make([]string, len(langs))
+	for i, l := range langs {
+		ret[i] = l.lang
+	}
+	return ret
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// IdempotentReply is a reply stored for an Idempotency-Key.
+type IdempotentReply struct {
+	// SHA-256 of the request body, in hex
+	BodyHash string
+	Status   int
+	Header   http.Header
+	Body     []byte
+	// Reserved by a request being served, which has no reply yet
+	Pending bool
+}
+
+// IdempotencyStore stores replies of APIs with META tag
+// `idempotent:"true"`, which are replayed for requests retried with the
+// same Idempotency-Key. Stores shared by servers, e.g. on Redis, need to
+// expire the replies themselves, pending ones included.
+type IdempotencyStore interface {
+	// Reserve stores pending under key and returns nil if no reply is
+	// stored under it, or else returns the stored one. It must be atomic
+	// for concurrent retries to be detected.
+	Reserve(key string, pending *IdempotentReply) (*IdempotentReply, error)
+	Put(key string, reply *IdempotentReply) error
+	// Delete drops the reply, pending or not, under key
+	Delete(key string) error
+}
+
+var idempotencyStore IdempotencyStore = NewMemIdempotencyStore(24 * time.Hour)
+
+// SetIdempotencyStore replaces the default in-memory store, which keeps
+// replies for 24 hours.
+func SetIdempotencyStore(s IdempotencyStore) {
+	idempotencyStore = s
+}
+
+// MemIdempotencyStore keeps replies in memory for ttl.
+type MemIdempotencyStore struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	replies   map[string]memReply
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memReply struct {
+	reply *IdempotentReply
+	at    time.Time
+}
+
+func NewMemIdempotencyStore(ttl time.Duration) *MemIdempotencyStore {
+	return &MemIdempotencyStore{
+		ttl:     ttl,
+		replies: make(map[string]memReply),
+		now:     time.Now,
+	}
+}
+
+func (s *MemIdempotencyStore) Reserve(key string, pending *IdempotentReply) (*IdempotentReply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mr, ok := s.replies[key]; ok && s.now().Sub(mr.at) < s.ttl {
+		return mr.reply, nil
+	}
+	s.sweep()
+	s.replies[key] = memReply{reply: pending, at: s.now()}
+	return nil, nil
+}
+
+func (s *MemIdempotencyStore) Put(key string, reply *IdempotentReply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	s.replies[key] = memReply{reply: reply, at: s.now()}
+	return nil
+}
+
+func (s *MemIdempotencyStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.replies, key)
+	return nil
+}
+
+// sweep drops expired replies, at most once per ttl.
+func (s *MemIdempotencyStore) sweep() {
+	now := s.now()
+	if now.Sub(s.lastSweep) < s.ttl {
+		return
+	}
+	s.lastSweep = now
+	for key, mr := range s.replies {
+		if now.Sub(mr.at) >= s.ttl {
+			delete(s.replies, key)
+		}
+	}
+}
+
+// idempotentReq is a request to an idempotent API with a key.
+type idempotentReq struct {
+	// Store key, of the client, the route and the Idempotency-Key
+	key      string
+	bodyHash string
+}
+
+// idempotentRequest hashes the body of r, it returns nil if h isn't
+// idempotent or r has no Idempotency-Key.
+func (h *handler) idempotentRequest(r *http.Request) (*idempotentReq, *appgo.ApiError) {
+	if !h.idempotent || idempotencyStore == nil || r.Header.Get(IdempotencyKeyHeader) == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, bodyErr(err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	sum := sha256.Sum256(data)
+	return &idempotentReq{bodyHash: hex.EncodeToString(sum[:])}, nil
+}
+
+// replay replies the reply stored for the request if any, or a conflict
+// if the stored one was of a different body or is still pending. It
+// returns false if the API func is to be called, for which the key is
+// reserved. Anonymous clients are told apart by IP, so that they don't
+// get the replies of each other.
+func (ir *idempotentReq) replay(h *handler, w *accessWriter, r *http.Request,
+	user appgo.Id) bool {
+	ir.key = fmt.Sprintf("%s:%s:%s:%s", h.clientKey(r, user), r.Method, r.URL.Path,
+		r.Header.Get(IdempotencyKeyHeader))
+	pending := &IdempotentReply{BodyHash: ir.bodyHash, Pending: true}
+	reply, err := idempotencyStore.Reserve(ir.key, pending)
+	if err != nil {
+		logEntry(r).WithField("error", err).Error("Error getting idempotent reply")
+		return false
+	} else if reply == nil {
+		w.capture = new(bytes.Buffer)
+		return false
+	}
+	if reply.BodyHash != ir.bodyHash {
+		h.renderError(w, r, appgo.NewApiErr(appgo.ECodeConflict,
+			"Idempotency-Key reused with a different body"))
+		return true
+	} else if reply.Pending {
+		h.renderError(w, r, appgo.NewApiErr(appgo.ECodeConflict,
+			"request of the Idempotency-Key in progress"))
+		return true
+	}
+	// Headers of this request, e.g. X-Request-ID, are kept
+	for k, v := range reply.Header {
+		if _, ok := w.Header()[k]; !ok {
+			w.Header()[k] = v
+		}
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(reply.Status)
+	w.Write(reply.Body)
+	return true
+}
+
+// store saves the reply captured by w, failed ones aren't saved so that
+// they can be retried.
+func (ir *idempotentReq) store(w *accessWriter, r *http.Request) {
+	if w.capture == nil {
+		return
+	} else if w.status >= 500 {
+		if err := idempotencyStore.Delete(ir.key); err != nil {
+			logEntry(r).WithFields(log.Fields{
+				"error": err,
+				"key":   ir.key,
+			}).Error("Error deleting idempotent reply")
+		}
+		return
+	}
+	reply := &IdempotentReply{
+		BodyHash: ir.bodyHash,
+		Status:   w.status,
+		Header:   w.Header().Clone(),
+		Body:     w.capture.Bytes(),
+	}
+	if err := idempotencyStore.Put(ir.key, reply); err != nil {
+		logEntry(r).WithFields(log.Fields{
+			"error": err,
+			"key":   ir.key,
+		}).Error("Error storing idempotent reply")
+	}
+}
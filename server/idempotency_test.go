@@ -0,0 +1,140 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var orderCount int
+
+type orderApi struct {
+	META struct{} `path:"/orders" idempotent:"true"`
+}
+
+func (orderApi) POST(in *bodyInput) (string, error) {
+	orderCount++
+	return in.Content__.Text + strings.Repeat("!", orderCount), nil
+}
+
+func TestIdempotency(t *testing.T) {
+	now := time.Now()
+	store := NewMemIdempotencyStore(time.Hour)
+	store.now = func() time.Time { return now }
+	SetIdempotencyStore(store)
+	defer SetIdempotencyStore(NewMemIdempotencyStore(24 * time.Hour))
+	orderCount = 0
+	h := newTestHandler(&orderApi{})
+	post := func(key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/orders", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set(IdempotencyKeyHeader, key)
+		}
+		return serveTest(h, r)
+	}
+
+	w := post("k1", `{"Text":"a"}`)
+	assert.Equal(t, `"a!"`, w.Body.String())
+	w = post("k1", `{"Text":"a"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"a!"`, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(t, "application/json; charset=UTF-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, 1, orderCount)
+
+	w = post("k1", `{"Text":"b"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"errcode":40900`)
+	assert.Equal(t, 1, orderCount)
+
+	// Without a key, or with another one
+	assert.Equal(t, `"a!!"`, post("", `{"Text":"a"}`).Body.String())
+	assert.Equal(t, `"a!!!"`, post("k2", `{"Text":"a"}`).Body.String())
+
+	now = now.Add(time.Hour)
+	w = post("k1", `{"Text":"b"}`)
+	assert.Equal(t, `"b!!!!"`, w.Body.String())
+	assert.Empty(t, w.Header().Get(IdempotentReplayedHeader))
+}
+
+func TestIdempotencyErrors(t *testing.T) {
+	SetIdempotencyStore(NewMemIdempotencyStore(time.Hour))
+	defer SetIdempotencyStore(NewMemIdempotencyStore(24 * time.Hour))
+	orderCount = 0
+	h := newTestHandler(&orderApi{})
+	post := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/orders", strings.NewReader(body))
+		r.Header.Set(IdempotencyKeyHeader, "k")
+		return serveTest(h, r)
+	}
+	// Client errors are replayed
+	assert.Equal(t, http.StatusBadRequest, post(`{`).Code)
+	w := post(`{`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "true", w.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(t, 0, orderCount)
+}
+
+func TestIdempotencyClients(t *testing.T) {
+	SetIdempotencyStore(NewMemIdempotencyStore(time.Hour))
+	defer SetIdempotencyStore(NewMemIdempotencyStore(24 * time.Hour))
+	orderCount = 0
+	h := newTestHandler(&orderApi{})
+	post := func(ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/orders", strings.NewReader(`{"Text":"a"}`))
+		r.Header.Set(IdempotencyKeyHeader, "k")
+		r.RemoteAddr = ip + ":1234"
+		return serveTest(h, r)
+	}
+	assert.Equal(t, `"a!"`, post("10.0.0.1").Body.String())
+	// Anonymous clients don't share replies
+	w := post("10.0.0.2")
+	assert.Equal(t, `"a!!"`, w.Body.String())
+	assert.Empty(t, w.Header().Get(IdempotentReplayedHeader))
+	w = post("10.0.0.1")
+	assert.Equal(t, `"a!"`, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get(IdempotentReplayedHeader))
+}
+
+var slowOrderEntered, slowOrderRelease chan struct{}
+
+type slowOrderApi struct {
+	META struct{} `path:"/slow-orders" idempotent:"true"`
+}
+
+func (slowOrderApi) POST(in *bodyInput) (string, error) {
+	slowOrderEntered <- struct{}{}
+	<-slowOrderRelease
+	return in.Content__.Text, nil
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	SetIdempotencyStore(NewMemIdempotencyStore(time.Hour))
+	defer SetIdempotencyStore(NewMemIdempotencyStore(24 * time.Hour))
+	slowOrderEntered = make(chan struct{}, 2)
+	slowOrderRelease = make(chan struct{})
+	h := newTestHandler(&slowOrderApi{})
+	post := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/slow-orders", strings.NewReader(`{"Text":"a"}`))
+		r.Header.Set(IdempotencyKeyHeader, "k")
+		return serveTest(h, r)
+	}
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- post() }()
+	<-slowOrderEntered
+
+	// A concurrent retry isn't served
+	w := post()
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "in progress")
+	close(slowOrderRelease)
+	assert.Equal(t, http.StatusOK, (<-first).Code)
+	assert.Len(t, slowOrderEntered, 0)
+
+	w = post()
+	assert.Equal(t, `"a"`, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get(IdempotentReplayedHeader))
+}
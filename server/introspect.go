@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ApiInfo describes an added API for introspection
+type ApiInfo struct {
+	Path       string         `json:"path"`
+	Methods    []string       `json:"methods"`
+	Deprecated bool           `json:"deprecated,omitempty"`
+	Errors     []ErrorExample `json:"errors,omitempty"`
+}
+
+// ErrorExample is an error an API declares it may reply
+type ErrorExample struct {
+	Code    appgo.ErrCode   `json:"code"`
+	Status  int             `json:"status"`
+	Example *appgo.ApiError `json:"example"`
+}
+
+// setErrCodes reads META tag `errCodes:"40000,40400"`, the codes need
+// to be known ones, see appgo.RegisterErrCode.
+func (h *handler) setErrCodes(meta reflect.StructTag) error {
+	for _, s := range strings.Split(meta.Get("errCodes"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil || !appgo.IsKnownErrCode(appgo.ErrCode(code)) {
+			return fmt.Errorf("Bad errCodes of %s: %s", h.path, s)
+		}
+		h.errCodes = append(h.errCodes, appgo.ErrCode(code))
+	}
+	return nil
+}
+
+func (h *handler) info(path string) ApiInfo {
+	methods := h.supports
+	if h.htype == HandlerTypeHtml {
+		methods = []string{"GET"}
+	}
+	info := ApiInfo{
+		Path:       path,
+		Methods:    methods,
+		Deprecated: h.deprecated,
+	}
+	for _, code := range h.errCodes {
+		example := appgo.NewApiErr(code, "")
+		status := example.HttpStatus()
+		example.Msg = http.StatusText(status)
+		info.Errors = append(info.Errors, ErrorExample{code, status, example})
+	}
+	return info
+}
+
+// Apis returns the info of all added APIs
+func (s *Server) Apis() []ApiInfo {
+	return s.apis
+}
+
+// AddIntrospection serves the info of added APIs as JSON at path
+func (s *Server) AddIntrospection(path string) {
+	s.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(w).Encode(s.Apis())
+	}).Methods("GET")
+}
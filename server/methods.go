@@ -0,0 +1,98 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// autoMethods tells if HEAD and OPTIONS are answered by h itself, unless
+// the func set has HEAD or OPTIONS funcs.
+func (h *handler) autoMethods() bool {
+	return h.htype == HandlerTypeJson && !appgo.Conf.DisableAutoMethods
+}
+
+func (h *handler) hasFunc(method string) bool {
+	_, ok := h.funcs[method]
+	return ok
+}
+
+// funcMethod returns the method of the func to serve r, HEAD is served
+// by GET funcs if there is no HEAD func.
+func (h *handler) funcMethod(r *http.Request) string {
+	if r.Method == "HEAD" && h.autoMethods() && !h.hasFunc("HEAD") {
+		return "GET"
+	}
+	return r.Method
+}
+
+// routeMethods returns the methods to route to h.
+func (h *handler) routeMethods() []string {
+	methods := append([]string{}, h.supports...)
+	if h.autoMethods() && !h.hasFunc("HEAD") {
+		methods = append(methods, "HEAD")
+	}
+	if (h.autoMethods() || h.builtinCors()) && !h.hasFunc("OPTIONS") {
+		// For preflights if not auto
+		methods = append(methods, "OPTIONS")
+	}
+	return methods
+}
+
+// allowedMethods returns the HTTP methods of h, without versions.
+func (h *handler) allowedMethods() []string {
+	methods := make([]string, 0, 6)
+	seen := make(map[string]bool)
+	for _, m := range h.supports {
+		m = strings.TrimRight(m, "0123456789")
+		if !seen[m] {
+			seen[m] = true
+			methods = append(methods, m)
+		}
+	}
+	if seen["GET"] && !seen["HEAD"] {
+		methods = append(methods, "HEAD")
+	}
+	if !seen["OPTIONS"] {
+		methods = append(methods, "OPTIONS")
+	}
+	return methods
+}
+
+func (h *handler) renderOptions(w http.ResponseWriter) {
+	w.Header().Set("Allow", strings.Join(h.allowedMethods(), ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// headWriter discards the body of replies to HEAD requests, and sets
+// the Content-Length the body would have.
+type headWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *headWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *headWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.size += len(b)
+	return len(b), nil
+}
+
+func (w *headWriter) finish() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.size > 0 && w.Header().Get("Content-Length") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(w.size))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type Middleware func(http.Handler) http.Handler
+
+// Use adds middlewares wrapping every handler mounted afterwards by
+// AddRest/AddHtml, the first one added is the outermost.
+func (s *Server) Use(mws ...Middleware) {
+	s.chain = append(s.chain, mws...)
+}
+
+// Name => middleware, for META tag "middleware"
+var namedMiddlewares = make(map[string]Middleware)
+
+// RegisterMiddleware names a middleware for META tags like
+// `middleware:"audit,cache"`, which wrap the handler of the func set
+// inside those added by Use. It should be called before the APIs using
+// it are added.
+func RegisterMiddleware(name string, mw Middleware) {
+	namedMiddlewares[name] = mw
+}
+
+// setMiddlewares reads META tag `middleware:"audit,cache"`, the first
+// one is the outermost.
+func (h *handler) setMiddlewares(tag string) error {
+	h.middlewares = nil
+	for _, name := range strings.Split(tag, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		mw, ok := namedMiddlewares[name]
+		if !ok {
+			return fmt.Errorf("Unknown middleware of %s: %s", h.path, name)
+		}
+		h.middlewares = append(h.middlewares, mw)
+	}
+	return nil
+}
+
+// wrap applies the middlewares, the request id and trace are set before
+// them all. Requests are tracked for Shutdown.
+func (s *Server) wrap(h http.Handler) http.Handler {
+	if hd, ok := h.(*handler); ok {
+		for i := len(hd.middlewares) - 1; i >= 0; i-- {
+			h = hd.middlewares[i](h)
+		}
+	}
+	for i := len(s.chain) - 1; i >= 0; i-- {
+		h = s.chain[i](h)
+	}
+	return s.track(withRequestID(withTrace(h)))
+}
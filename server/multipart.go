@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Same as the default of net/http
+const defaultMultipartMaxMemory = 32 << 20
+
+// formValues returns the values to decode the input from, which are the
+// query params plus the non-file fields of a multipart form, or the
+// fields of a urlencoded form if the input has no Content__.
+func (h *handler) formValues(r *http.Request, f *httpFunc) (url.Values, *appgo.ApiError) {
+	if !isMultipart(r) {
+		if f.hasContent || mediaType(r) != "application/x-www-form-urlencoded" {
+			return r.URL.Query(), nil
+		}
+		if aerr := h.transformBody(r, "application/x-www-form-urlencoded"); aerr != nil {
+			return nil, aerr
+		}
+		if err := r.ParseForm(); err != nil {
+			return nil, bodyErr(err)
+		}
+		return bodyOverQuery(r), nil
+	}
+	maxMem := appgo.Conf.Multipart.MaxMemory
+	if f.files != nil && f.files.maxMemory != 0 {
+		maxMem = f.files.maxMemory
+	}
+	if maxMem <= 0 {
+		maxMem = defaultMultipartMaxMemory
+	}
+	if err := r.ParseMultipartForm(maxMem); err != nil {
+		return nil, bodyErr(err)
+	}
+	return bodyOverQuery(r), nil
+}
+
+// bodyOverQuery merges the parsed form fields into the query params,
+// fields of the body win.
+func bodyOverQuery(r *http.Request) url.Values {
+	values := r.URL.Query()
+	for k, v := range r.PostForm {
+		values[k] = v
+	}
+	return values
+}
+
+func isMultipart(r *http.Request) bool {
+	return mediaType(r) == "multipart/form-data"
+}
+
+func mediaType(r *http.Request) string {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return ct
+}
+
+func uploadedFiles(r *http.Request) map[string][]*multipart.FileHeader {
+	if r.MultipartForm == nil {
+		return map[string][]*multipart.FileHeader{}
+	}
+	return r.MultipartForm.File
+}
+
+// fileRules are of tags of Files__ like
+//
+//	Files__ map[string][]*multipart.FileHeader `maxFileSize:"1048576" fileTypes:"image/*,application/pdf" maxMemory:"1"`
+//
+// maxFileSize overrides Conf.Multipart.MaxFileSize, fileTypes are matched
+// against types sniffed from the content rather than the declared ones,
+// and maxMemory overrides Conf.Multipart.MaxMemory, a small one saves
+// files to temp files.
+type fileRules struct {
+	maxSize   int64
+	types     []string
+	maxMemory int64
+}
+
+func parseFileRules(tag reflect.StructTag) (*fileRules, error) {
+	rules := &fileRules{}
+	for _, name := range []string{"maxFileSize", "maxMemory"} {
+		s := tag.Get(name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("Bad %s of Files: %s", name, s)
+		}
+		if name == "maxFileSize" {
+			rules.maxSize = n
+		} else {
+			rules.maxMemory = n
+		}
+	}
+	for _, t := range strings.Split(tag.Get("fileTypes"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			rules.types = append(rules.types, strings.ToLower(t))
+		}
+	}
+	return rules, nil
+}
+
+// checkFiles checks the uploaded files against the rules and
+// Conf.Multipart.MaxFileSize.
+func checkFiles(r *http.Request, rules *fileRules) *appgo.ApiError {
+	if r.MultipartForm == nil || rules == nil {
+		return nil
+	}
+	maxSize := appgo.Conf.Multipart.MaxFileSize
+	if rules.maxSize > 0 {
+		maxSize = rules.maxSize
+	}
+	fields := make(map[string]string)
+	for name, fhs := range r.MultipartForm.File {
+		for _, fh := range fhs {
+			if maxSize > 0 && fh.Size > maxSize {
+				fields["files."+name] = fmt.Sprintf("larger than %d bytes", maxSize)
+			} else if len(rules.types) > 0 {
+				ct, err := sniffType(fh)
+				if err != nil {
+					return appgo.NewApiErr(appgo.ECodeBadRequest, err.Error())
+				}
+				if !typeAllowed(ct, rules.types) {
+					fields["files."+name] = "type not allowed: " + ct
+				}
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fieldsErr(fields)
+}
+
+func sniffType(fh *multipart.FileHeader) (string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	ct, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	return ct, nil
+}
+
+// typeAllowed matches ct against types like "image/png" or "image/*".
+func typeAllowed(ct string, types []string) bool {
+	for _, t := range types {
+		if t == ct || (strings.HasSuffix(t, "/*") && strings.HasPrefix(ct, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
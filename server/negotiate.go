@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// xmlList is the root element of XML replies of slices.
+type xmlList struct {
+	XMLName xml.Name    `xml:"list"`
+	Items   interface{} `xml:"item"`
+}
+
+// xmlMap encodes a map, which encoding/xml can't, as elements named by
+// its keys in order, or as <entry key="..."> for keys that are not XML
+// names. Maps replied are rooted at <map>.
+type xmlMap struct {
+	m reflect.Value
+}
+
+var xmlNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+func (m xmlMap) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	keys := make([]string, 0, m.m.Len())
+	values := make(map[string]reflect.Value, m.m.Len())
+	for it := m.m.MapRange(); it.Next(); {
+		k := fmt.Sprint(it.Key().Interface())
+		keys = append(keys, k)
+		values[k] = it.Value()
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		el := xml.StartElement{Name: xml.Name{Local: k}}
+		if !xmlNameRegexp.MatchString(k) {
+			el = xml.StartElement{
+				Name: xml.Name{Local: "entry"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: k}},
+			}
+		}
+		if err := e.EncodeElement(xmlMaps(values[k].Interface()), el); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// xmlMaps wraps v as xmlMap if it's a map, and so the items of v if it's
+// a slice of maps or interfaces.
+func xmlMaps(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		return xmlMap{rv}
+	case reflect.Slice, reflect.Array:
+		if k := rv.Type().Elem().Kind(); k != reflect.Map && k != reflect.Interface {
+			return v
+		}
+		items := make([]interface{}, rv.Len())
+		for i := range items {
+			items[i] = xmlMaps(rv.Index(i).Interface())
+		}
+		return items
+	}
+	return v
+}
+
+// marshalXML encodes a reply, see xmlList and xmlMap.
+func marshalXML(v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case appgo.Envelope:
+		v = appgo.Envelope{Code: x.Code, Data: xmlMaps(x.Data)}
+	case *appgo.Envelope:
+		v = &appgo.Envelope{Code: x.Code, Data: xmlMaps(x.Data)}
+	}
+	var buf bytes.Buffer
+	e := xml.NewEncoder(&buf)
+	if appgo.Conf.DevMode {
+		e.Indent("", "  ")
+	}
+	var err error
+	switch x := xmlMaps(v).(type) {
+	case xmlMap:
+		err = e.EncodeElement(x, xml.StartElement{Name: xml.Name{Local: "map"}})
+	case []interface{}:
+		err = e.Encode(&xmlList{Items: x})
+	default:
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			x = &xmlList{Items: v}
+		}
+		err = e.Encode(x)
+	}
+	return buf.Bytes(), err
+}
+
+// Codec encodes replies of a media type other than JSON and XML, e.g.
+// msgpack or protobuf. Values it can't encode, such as non-proto
+// messages, are replied as JSON if it returns ErrCodecUnsupported.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+}
+
+var ErrCodecUnsupported = errors.New("value not supported by the codec")
+
+// Media type => codec
+var codecs = make(map[string]Codec)
+
+// RegisterCodec sets the codec of replies to clients preferring
+// mediaType in Accept, like "application/msgpack", a nil c removes it.
+// Not safe to call once the server is serving, and only in effect with
+// Conf.ContentNegotiation.Enable.
+func RegisterCodec(mediaType string, c Codec) {
+	mediaType = strings.ToLower(mediaType)
+	if c == nil {
+		delete(codecs, mediaType)
+	} else {
+		codecs[mediaType] = c
+	}
+}
+
+// negotiate returns the media type the client prefers in Accept among
+// XML and those of codecs, or "" for JSON. Ties go to JSON, and then to
+// the one listed first. Handlers with META tag `reply:"xml"` always
+// reply XML, e.g. to callbacks of payment services.
+func (h *handler) negotiate(r *http.Request) string {
+	if h.replyXML {
+		return "application/xml"
+	}
+	if !appgo.Conf.ContentNegotiation.Enable {
+		return ""
+	}
+	var jsonQ, bestQ float64
+	best := ""
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(part, ";")
+		mt := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch mt {
+		case "application/json", "application/*", "*/*":
+			if q > jsonQ {
+				jsonQ = q
+			}
+			continue
+		case "text/xml":
+			mt = "application/xml"
+		case "application/xml":
+		default:
+			if _, ok := codecs[mt]; !ok {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mt, q
+		}
+	}
+	if bestQ > jsonQ {
+		return best
+	}
+	return ""
+}
+
+// renderValue replies v in the media type the client prefers, see
+// negotiate.
+func (h *handler) renderValue(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	mt := h.negotiate(r)
+	if mt == "" {
+		h.renderJSON(w, r, status, v)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	if codec, ok := codecs[mt]; ok {
+		h.renderCodec(w, r, status, codec, mt, v)
+		return
+	}
+	data, err := marshalXML(v)
+	if err != nil {
+		logEntry(r).WithField("error", err).Error("Error encoding xml")
+		aerr := appgo.NewApiErr(appgo.ECodeInternal, "Failed to encode reply")
+		status = errStatus(aerr)
+		data, _ = xml.Marshal(aerr)
+	}
+	data = append([]byte(xml.Header), data...)
+	h.writeData(w, r, status, "application/xml; charset=UTF-8", data)
+}
+
+func (h *handler) renderCodec(w http.ResponseWriter, r *http.Request, status int,
+	codec Codec, mediaType string, v interface{}) {
+	data, err := codec.Marshal(v)
+	if err == ErrCodecUnsupported {
+		h.renderJSON(w, r, status, v)
+		return
+	} else if err != nil {
+		logEntry(r).WithFields(log.Fields{
+			"error": err,
+			"type":  mediaType,
+		}).Error("Error encoding reply")
+		aerr := appgo.NewApiErr(appgo.ECodeInternal, "Failed to encode reply")
+		h.renderJSON(w, r, errStatus(aerr), aerr)
+		return
+	}
+	h.writeData(w, r, status, mediaType, data)
+}
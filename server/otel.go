@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"github.com/oxfeeefeee/appgo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+)
+
+const tracerName = "github.com/oxfeeefeee/appgo/server"
+
+// W3C trace context and baggage
+var propagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{}, propagation.Baggage{})
+
+// SetupTracing sets the global TracerProvider, exporting spans with
+// exporter, e.g. one of OTLP or Jaeger, as configured by Conf.Trace.Otel.
+// The returned func flushes and stops it, call it on exit.
+func SetupTracing(exporter sdktrace.SpanExporter) (shutdown func(context.Context) error) {
+	c := &appgo.Conf.Trace.Otel
+	ratio := c.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	attrs := []attribute.KeyValue{}
+	if c.ServiceName != "" {
+		attrs = append(attrs, semconv.ServiceNameKey.String(c.ServiceName))
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagator)
+	return tp.Shutdown
+}
+
+// ForwardTrace sets the trace context of ctx on out, a request to a
+// downstream service, for it to join the trace.
+func ForwardTrace(ctx context.Context, out *http.Request) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(out.Header))
+}
+
+// startSpan starts the span of serving r if Conf.Trace.Otel is enabled,
+// a child of the trace in its headers if any. The trace of the returned
+// request, e.g. in logs, is the span's.
+func startSpan(r *http.Request) (*http.Request, trace.Span) {
+	if !appgo.Conf.Trace.Otel.Enable {
+		return r, nil
+	}
+	route := routeOf(r)
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPRouteKey.String(route),
+			semconv.HTTPTargetKey.String(r.URL.RequestURI()),
+		))
+	if sc := span.SpanContext(); sc.IsValid() {
+		ctx = appgo.WithTrace(ctx, &appgo.TraceContext{
+			TraceId: sc.TraceID().String(),
+			SpanId:  sc.SpanID().String(),
+			Sampled: sc.IsSampled(),
+		})
+	}
+	return r.WithContext(ctx), span
+}
+
+// endSpan records the reply and the user, replies of 5xx are errors.
+func endSpan(span trace.Span, w *accessWriter, user appgo.Id) {
+	if span == nil {
+		return
+	}
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+	if user != 0 {
+		span.SetAttributes(semconv.EnduserIDKey.String(user.String()))
+	}
+	if w.errCode != 0 {
+		span.SetAttributes(attribute.Int("appgo.errcode", int(w.errCode)))
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, strconv.Itoa(status))
+	}
+	span.End()
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+const (
+	defaultPerPage    = 20
+	defaultMaxPerPage = 100
+)
+
+// setPagination reads META tags `perPage:"20" maxPerPage:"50"`, which
+// override Conf.Pagination.
+func (h *handler) setPagination(meta reflect.StructTag) error {
+	for tag, ptr := range map[string]*int{
+		"perPage":    &h.perPage,
+		"maxPerPage": &h.maxPerPage,
+	} {
+		if s := meta.Get(tag); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return fmt.Errorf("Bad %s of %s: %s", tag, h.path, s)
+			}
+			*ptr = n
+		}
+	}
+	return nil
+}
+
+// pageParams reads query params "page" and "per_page", values below 1
+// fall back to the defaults, per_page over the max is clamped unless
+// Conf.Pagination.RejectOverMax.
+func (h *handler) pageParams(r *http.Request) (int, int, *appgo.ApiError) {
+	c := &appgo.Conf.Pagination
+	perPage := firstPositive(h.perPage, c.PerPage, defaultPerPage)
+	maxPerPage := firstPositive(h.maxPerPage, c.MaxPerPage, defaultMaxPerPage)
+	query := r.URL.Query()
+	page, aerr := intParam(query.Get("page"), "page", 1)
+	if aerr != nil {
+		return 0, 0, aerr
+	}
+	pp, aerr := intParam(query.Get("per_page"), "per_page", perPage)
+	if aerr != nil {
+		return 0, 0, aerr
+	}
+	if pp > maxPerPage {
+		if c.RejectOverMax {
+			return 0, 0, appgo.NewApiErr(appgo.ECodeBadRequest,
+				fmt.Sprintf("per_page exceeds %d", maxPerPage))
+		}
+		pp = maxPerPage
+	}
+	return page, pp, nil
+}
+
+func intParam(s, name string, def int) (int, *appgo.ApiError) {
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, appgo.NewApiErr(appgo.ECodeBadRequest, "bad "+name+": "+s)
+	}
+	if n < 1 {
+		return def, nil
+	}
+	return n, nil
+}
+
+func firstPositive(ns ...int) int {
+	for _, n := range ns {
+		if n > 0 {
+			return n
+		}
+	}
+	return 0
+}
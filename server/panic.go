@@ -0,0 +1,17 @@
+package server
+
+import (
+	"net/http"
+)
+
+// PanicReporter reports a panic of an API func along with the request and
+// the stack, e.g. to Sentry. It's called before the error is replied, so
+// shouldn't block.
+type PanicReporter func(r *http.Request, p interface{}, stack []byte)
+
+var panicReporter PanicReporter
+
+// SetPanicReporter sets the reporter of panics, which are logged anyway.
+func SetPanicReporter(rep PanicReporter) {
+	panicReporter = rep
+}
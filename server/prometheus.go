@@ -0,0 +1,149 @@
+package server
+
+import (
+	gkmetrics "github.com/go-kit/kit/metrics"
+	gkprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/oxfeeefeee/appgo"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	metrics_once sync.Once
+	// Labeled by method, route template and status, so that paths with
+	// ids like /users/{id} are one series. Sum them up for the total.
+	metrics_req_count_vec    *stdprometheus.CounterVec
+	metrics_req_count        gkmetrics.Counter
+	metrics_req_dur          gkmetrics.Histogram
+	metrics_req_dur_legacy   gkmetrics.Histogram
+	metrics_req_size         gkmetrics.Histogram
+	metrics_resp_size        gkmetrics.Histogram
+	metrics_deprecated_count gkmetrics.Counter
+	metrics_variant_count    gkmetrics.Counter
+	metrics_sse_conns        gkmetrics.Gauge
+	metrics_in_flight        gkmetrics.Gauge
+	metrics_panic_count      gkmetrics.Counter
+	// Replaced in tests
+	metricsNow = time.Now
+)
+
+func initMetrics() {
+	metrics_once.Do(func() {
+		metrics_req_count_vec = stdprometheus.NewCounterVec(stdprometheus.CounterOpts{
+			Namespace: "appgo",
+			Subsystem: "http",
+			Name:      "request_counter",
+			Help:      "Total served requests count.",
+		}, []string{"method", "route", "status"})
+		stdprometheus.MustRegister(metrics_req_count_vec)
+		metrics_req_count = gkprometheus.NewCounter(metrics_req_count_vec)
+		metrics_req_dur = gkprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "appgo",
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Total time spent serving requests.",
+			Buckets:   latencyBuckets(),
+		}, []string{"method", "route", "status"})
+		if appgo.Conf.Prometheus.LegacySummary {
+			metrics_req_dur_legacy = gkprometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
+				Namespace: "appgo",
+				Subsystem: "http",
+				Name:      "request_duration_microseconds",
+				Help:      "Total time spent serving requests.",
+			}, []string{})
+		}
+		// 64B to 16MB
+		sizeBuckets := stdprometheus.ExponentialBuckets(64, 4, 10)
+		metrics_req_size = gkprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "appgo",
+			Subsystem: "http",
+			Name:      "request_size_bytes",
+			Help:      "Sizes of request bodies.",
+			Buckets:   sizeBuckets,
+		}, []string{"method", "route"})
+		metrics_resp_size = gkprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "appgo",
+			Subsystem: "http",
+			Name:      "response_size_bytes",
+			Help:      "Sizes of response bodies.",
+			Buckets:   sizeBuckets,
+		}, []string{"method", "route"})
+		metrics_deprecated_count = gkprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "appgo",
+			Subsystem: "http",
+			Name:      "deprecated_request_counter",
+			Help:      "Served requests count of deprecated APIs.",
+		}, []string{"path"})
+		metrics_variant_count = gkprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "appgo",
+			Subsystem: "http",
+			Name:      "template_variant_counter",
+			Help:      "Rendered count of each template variant.",
+		}, []string{"path", "variant"})
+		metrics_sse_conns = gkprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "appgo",
+			Subsystem: "http",
+			Name:      "sse_connections",
+			Help:      "Open Server-Sent Events streams.",
+		}, []string{"route"})
+		metrics_in_flight = gkprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "appgo",
+			Subsystem: "http",
+			Name:      "requests_in_flight",
+			Help:      "Requests being served.",
+		}, []string{})
+		metrics_panic_count = gkprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "appgo",
+			Subsystem: "http",
+			Name:      "panic_counter",
+			Help:      "Panics of API funcs.",
+		}, []string{"route"})
+	})
+}
+
+func latencyBuckets() []float64 {
+	if buckets := appgo.Conf.Prometheus.LatencyBuckets; len(buckets) > 0 {
+		return buckets
+	}
+	return stdprometheus.DefBuckets
+}
+
+// addMetrics records the request, reqSize is its Content-Length which
+// is -1 if unknown.
+func addMetrics(r *http.Request, w *accessWriter, reqSize int64, begin time.Time) {
+	if !appgo.Conf.Prometheus.Enable {
+		return
+	}
+	labels := []string{"method", r.Method, "route", routeOf(r)}
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	statusLabels := append(labels, "status", strconv.Itoa(status))
+	elapsed := metricsNow().Sub(begin)
+	metrics_req_dur.With(statusLabels...).Observe(elapsed.Seconds())
+	if metrics_req_dur_legacy != nil {
+		metrics_req_dur_legacy.Observe(float64(elapsed / time.Microsecond))
+	}
+	metrics_req_count.With(statusLabels...).Add(1)
+	if reqSize >= 0 {
+		metrics_req_size.With(labels...).Observe(float64(reqSize))
+	}
+	metrics_resp_size.With(labels...).Observe(float64(w.size))
+}
+
+// addInFlight counts a request starting(1) or ending(-1).
+func addInFlight(delta float64) {
+	if appgo.Conf.Prometheus.Enable {
+		metrics_in_flight.Add(delta)
+	}
+}
+
+func addPanicMetrics(r *http.Request) {
+	if appgo.Conf.Prometheus.Enable {
+		metrics_panic_count.With("route", routeOf(r)).Add(1)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"github.com/gorilla/schema"
+	"github.com/oxfeeefeee/appgo"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+func init() {
+	RegisterQueryConverter(appgo.Id(0), convertId)
+	RegisterQueryConverter(time.Time{}, convertTime)
+	RegisterQueryConverter(appgo.Money{}, convertMoney)
+}
+
+// RegisterQueryConverter makes values of typ decodable from query params,
+// fn returns an invalid reflect.Value for bad input. It needs to be
+// called before any request is served.
+func RegisterQueryConverter(typ interface{}, fn schema.Converter) {
+	decoder.RegisterConverter(typ, fn)
+}
+
+func convertId(s string) reflect.Value {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return reflect.Value{}
+	}
+	return reflect.ValueOf(appgo.Id(id))
+}
+
+// convertTime parses RFC3339 time like 2017-01-02T15:04:05Z
+func convertTime(s string) reflect.Value {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return reflect.Value{}
+	}
+	return reflect.ValueOf(t)
+}
+
+// convertMoney parses money like "12.34 USD", see appgo.Money.UnmarshalText
+func convertMoney(s string) reflect.Value {
+	var m appgo.Money
+	if err := m.UnmarshalText([]byte(s)); err != nil {
+		return reflect.Value{}
+	}
+	return reflect.ValueOf(m)
+}
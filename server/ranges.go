@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"reflect"
+	"strconv"
+)
+
+// rangeField is a numeric field with tags like
+// `min:"1" max:"100" onRange:"clamp"`, out of range values are clamped
+// to the bounds or, by default, rejected.
+type rangeField struct {
+	index []int
+	name  string
+	// Of Content__ rather than the input
+	inContent      bool
+	hasMin, hasMax bool
+	min, max       float64
+	clamp          bool
+}
+
+func parseRangeFields(t reflect.Type, inContent bool) ([]rangeField, error) {
+	var fields []rangeField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		minTag, maxTag := sf.Tag.Get("min"), sf.Tag.Get("max")
+		if minTag == "" && maxTag == "" {
+			continue
+		}
+		switch sf.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+		default:
+			return nil, fmt.Errorf("Range field %s needs to be a number", sf.Name)
+		}
+		rf := rangeField{index: sf.Index, name: sf.Name, inContent: inContent}
+		var err error
+		if minTag != "" {
+			rf.hasMin = true
+			if rf.min, err = strconv.ParseFloat(minTag, 64); err != nil {
+				return nil, fmt.Errorf("Bad min of field %s: %s", sf.Name, minTag)
+			}
+		}
+		if maxTag != "" {
+			rf.hasMax = true
+			if rf.max, err = strconv.ParseFloat(maxTag, 64); err != nil {
+				return nil, fmt.Errorf("Bad max of field %s: %s", sf.Name, maxTag)
+			}
+		}
+		switch mode := sf.Tag.Get("onRange"); mode {
+		case "clamp":
+			rf.clamp = true
+		case "", "reject":
+		default:
+			return nil, fmt.Errorf("Bad onRange of field %s: %s", sf.Name, mode)
+		}
+		fields = append(fields, rf)
+	}
+	return fields, nil
+}
+
+func checkRanges(input reflect.Value, fields []rangeField) *appgo.ApiError {
+	s := input.Elem()
+	for _, rf := range fields {
+		owner := s
+		if rf.inContent {
+			owner = s.FieldByName(ContentFieldName)
+			if owner.IsNil() {
+				continue
+			}
+			owner = owner.Elem()
+		}
+		if aerr := rf.check(owner.FieldByIndex(rf.index)); aerr != nil {
+			return aerr
+		}
+	}
+	return nil
+}
+
+func (rf *rangeField) check(v reflect.Value) *appgo.ApiError {
+	var val float64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		val = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		val = float64(v.Uint())
+	default:
+		val = v.Float()
+	}
+	bound := val
+	if rf.hasMin && val < rf.min {
+		bound = rf.min
+	} else if rf.hasMax && val > rf.max {
+		bound = rf.max
+	}
+	if bound == val {
+		return nil
+	}
+	if !rf.clamp {
+		return appgo.NewApiErr(appgo.ECodeBadRequest,
+			fmt.Sprintf("%s out of range%s", rf.name, rf.bounds()))
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(bound))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(bound))
+	default:
+		v.SetFloat(bound)
+	}
+	return nil
+}
+
+func (rf *rangeField) bounds() string {
+	min, max := "-inf", "+inf"
+	if rf.hasMin {
+		min = strconv.FormatFloat(rf.min, 'g', -1, 64)
+	}
+	if rf.hasMax {
+		max = strconv.FormatFloat(rf.max, 'g', -1, 64)
+	}
+	return " [" + min + ", " + max + "]"
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Set by SetRateLimiter, see currentRateLimiter
+var rateLimiter RateLimiter
+
+type RateLimit struct {
+	Allowed bool
+	// How long until the next request would be allowed
+	RetryAfter time.Duration
+	// Quota of the key, Remaining counts this request in already.
+	// Headers of the status are only sent if Limit > 0
+	Limit     int
+	Remaining int
+	// When the quota is fully restored
+	Reset time.Time
+}
+
+type RateLimiter interface {
+	Take(key string) *RateLimit
+}
+
+func SetRateLimiter(l RateLimiter) {
+	rateLimiter = l
+}
+
+// setRateLimit reads META tags `rateLimit:"5,10"`, the rate and burst of
+// a limiter of the handler's own, and `rateLimitBy:"ip"` overriding
+// Conf.RateLimit.KeyBy.
+func (h *handler) setRateLimit(meta reflect.StructTag) error {
+	h.limitBy = meta.Get("rateLimitBy")
+	switch h.limitBy {
+	case "", "user", "ip", "route":
+	default:
+		return fmt.Errorf("Bad rateLimitBy of %s: %s", h.path, h.limitBy)
+	}
+	s := meta.Get("rateLimit")
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	rate, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	burst := 1
+	if err == nil && len(parts) > 1 {
+		burst, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+	}
+	if err != nil || rate <= 0 || len(parts) > 2 {
+		return fmt.Errorf("Bad rateLimit of %s: %s", h.path, s)
+	}
+	h.limiter = newConfStoreLimiter(rate, burst)
+	return nil
+}
+
+// checkRateLimit takes a token of the bucket of the request, user is
+// that resolved already by the auth of the func if any.
+func (h *handler) checkRateLimit(w http.ResponseWriter, r *http.Request, user appgo.Id) bool {
+	limiter, key := h.limiter, h.rateLimitKey(r, user)
+	if limiter != nil {
+		// Stores may be shared by handlers
+		key = h.path + "|" + key
+	} else if limiter = currentRateLimiter(); limiter == nil {
+		return true
+	}
+	rl := limiter.Take(key)
+	if appgo.Conf.RateLimit.Headers && rl.Limit > 0 {
+		setRateLimitHeaders(w, rl)
+	}
+	if rl.Allowed {
+		return true
+	}
+	w.Header().Set("Retry-After", retryAfterValue(rl.RetryAfter, time.Now()))
+	aerr := *appgo.TooManyRequestsErr
+	aerr.Details = map[string]int64{"retry_after": retrySeconds(rl.RetryAfter)}
+	h.renderError(w, r, &aerr)
+	return false
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, rl *RateLimit) {
+	conf := appgo.Conf.RateLimit
+	remaining := rl.Remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set(headerName(conf.LimitHeader, "X-RateLimit-Limit"),
+		strconv.Itoa(rl.Limit))
+	w.Header().Set(headerName(conf.RemainingHeader, "X-RateLimit-Remaining"),
+		strconv.Itoa(remaining))
+	if !rl.Reset.IsZero() {
+		w.Header().Set(headerName(conf.ResetHeader, "X-RateLimit-Reset"),
+			strconv.FormatInt(rl.Reset.Unix(), 10))
+	}
+}
+
+func headerName(name, def string) string {
+	if name == "" {
+		return def
+	}
+	return name
+}
+
+// rateLimitKey returns the bucket of the request, see
+// Conf.RateLimit.KeyBy.
+func (h *handler) rateLimitKey(r *http.Request, user appgo.Id) string {
+	by := h.limitBy
+	if by == "" {
+		by = appgo.Conf.RateLimit.KeyBy
+	}
+	switch by {
+	case "ip":
+		return "ip:" + appgo.ClientIP(r)
+	case "route":
+		return "r:" + routeOf(r)
+	}
+	return h.clientKey(r, user)
+}
+
+// clientKey identifies the client, by user if authenticated, by IP
+// otherwise. The user is only authenticated here for funcs without auth.
+func (h *handler) clientKey(r *http.Request, user appgo.Id) string {
+	if user == 0 {
+		user, _ = h.authByRequest(r)
+	}
+	if user != 0 {
+		return "u:" + user.String()
+	}
+	return "ip:" + appgo.ClientIP(r)
+}
+
+func retryAfterValue(d time.Duration, now time.Time) string {
+	if appgo.Conf.RateLimit.RetryAfterFormat == "http-date" {
+		return now.Add(d).UTC().Format(http.TimeFormat)
+	}
+	return strconv.FormatInt(retrySeconds(d), 10)
+}
+
+func retrySeconds(d time.Duration) int64 {
+	secs := int64(math.Ceil(d.Seconds()))
+	if secs < 0 {
+		secs = 0
+	}
+	return secs
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"errors"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/unrolled/render"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fixedWindowLimiter struct {
+	limit int
+	used  map[string]int
+	reset time.Time
+}
+
+func (l *fixedWindowLimiter) Take(key string) *RateLimit {
+	l.used[key]++
+	remaining := l.limit - l.used[key]
+	rl := &RateLimit{
+		Allowed:   remaining >= 0,
+		Limit:     l.limit,
+		Remaining: remaining,
+		Reset:     l.reset,
+	}
+	if !rl.Allowed {
+		rl.RetryAfter = time.Until(l.reset)
+	}
+	return rl
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	reset := time.Now().Add(time.Minute)
+	SetRateLimiter(&fixedWindowLimiter{2, map[string]int{}, reset})
+	appgo.Conf.RateLimit.Headers = true
+	appgo.Conf.RateLimit.ResetHeader = "X-Quota-Reset"
+	defer func() {
+		SetRateLimiter(nil)
+		appgo.Conf.RateLimit.Headers = false
+		appgo.Conf.RateLimit.ResetHeader = ""
+	}()
+	h := newTestHandler(&versionedApi{})
+
+	for i, want := range []string{"1", "0", "0"} {
+		w := serveTest(h, httptest.NewRequest("GET", "/versioned", nil))
+		assert.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"))
+		assert.Equal(t, want, w.Header().Get("X-RateLimit-Remaining"))
+		assert.Equal(t, strconv.FormatInt(reset.Unix(), 10), w.Header().Get("X-Quota-Reset"))
+		if i < 2 {
+			assert.Equal(t, http.StatusOK, w.Code)
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, w.Code)
+			assert.Equal(t, "60", w.Header().Get("Retry-After"))
+		}
+	}
+
+	appgo.Conf.RateLimit.Headers = false
+	w := serveTest(h, httptest.NewRequest("GET", "/versioned", nil))
+	assert.Equal(t, "", w.Header().Get("X-RateLimit-Limit"))
+}
+
+func TestMemRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewMemRateLimiter(0.5, 2)
+	l.now = func() time.Time { return now }
+	SetRateLimiter(l)
+	defer SetRateLimiter(nil)
+	h := newTestHandler(&versionedApi{})
+	get := func(ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/versioned", nil)
+		r.RemoteAddr = ip + ":1234"
+		return serveTest(h, r)
+	}
+
+	assert.Equal(t, http.StatusOK, get("10.0.0.1").Code)
+	assert.Equal(t, http.StatusOK, get("10.0.0.1").Code)
+	w := get("10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), `"errcode":42900`)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, get("10.0.0.2").Code)
+
+	now = now.Add(1500 * time.Millisecond)
+	w = get("10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, get("10.0.0.1").Code)
+}
+
+func TestConfRateLimiter(t *testing.T) {
+	appgo.Conf.RateLimit.Rate = 1
+	appgo.Conf.RateLimit.Burst = 1
+	appgo.Conf.TrustedProxies = []string{"192.0.2.0/24"}
+	defer func() {
+		appgo.Conf.RateLimit.Rate = 0
+		appgo.Conf.RateLimit.Burst = 0
+		appgo.Conf.TrustedProxies = nil
+	}()
+	h := newTestHandler(&versionedApi{})
+	get := func(xff string) int {
+		r := httptest.NewRequest("GET", "/versioned", nil)
+		r.Header.Set("X-Forwarded-For", xff)
+		return serveTest(h, r).Code
+	}
+	// Clients behind the proxy are limited separately
+	assert.Equal(t, http.StatusOK, get("203.0.113.1"))
+	assert.Equal(t, http.StatusTooManyRequests, get("203.0.113.1"))
+	assert.Equal(t, http.StatusOK, get("203.0.113.2"))
+	assert.Equal(t, http.StatusTooManyRequests, get("203.0.113.9, 203.0.113.2"))
+}
+
+type limitedApi struct {
+	META struct{} `path:"/limited" rateLimit:"1,2" rateLimitBy:"route"`
+}
+
+func (limitedApi) GET(in *appgo.DummyInput) (string, error) {
+	return "ok", nil
+}
+
+func TestMetaRateLimit(t *testing.T) {
+	h := newTestHandler(&limitedApi{})
+	get := func(ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/limited", nil)
+		r.RemoteAddr = ip + ":1234"
+		return serveTest(h, r)
+	}
+	// Shared by all clients of the route
+	assert.Equal(t, http.StatusOK, get("10.0.0.1").Code)
+	assert.Equal(t, http.StatusOK, get("10.0.0.2").Code)
+	w := get("10.0.0.3")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), `"retry_after":1`)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	assert.Panics(t, func() {
+		newTestHandler(&struct {
+			META struct{} `path:"/bad" rateLimit:"fast"`
+			limitedApi
+		}{})
+	})
+}
+
+func TestRateLimitKeyBy(t *testing.T) {
+	defer withTestTokens()()
+	SetRateLimiter(NewMemRateLimiter(1, 1))
+	appgo.Conf.RateLimit.KeyBy = "ip"
+	defer func() {
+		SetRateLimiter(nil)
+		appgo.Conf.RateLimit.KeyBy = ""
+	}()
+	h := newTestHandler(&versionedApi{})
+	get := func(user appgo.Id) int {
+		r := httptest.NewRequest("GET", "/versioned", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if user != 0 {
+			r.Header.Set(appgo.CustomTokenHeaderName, string(newTestToken(user)))
+		}
+		return serveTest(h, r).Code
+	}
+	// Users of an IP share its bucket
+	assert.Equal(t, http.StatusOK, get(42))
+	assert.Equal(t, http.StatusTooManyRequests, get(43))
+}
+
+// countingTokenStore counts lookups, which are round trips of remote stores
+type countingTokenStore struct {
+	n int32
+}
+
+func (s *countingTokenStore) Validate(token auth.Token) bool {
+	atomic.AddInt32(&s.n, 1)
+	return true
+}
+
+func TestRateLimitAfterAuth(t *testing.T) {
+	defer withTestTokens()()
+	SetRateLimiter(NewMemRateLimiter(1, 1))
+	defer SetRateLimiter(nil)
+	ts := &countingTokenStore{}
+	renderer := render.New(render.Options{Directory: "N/A"})
+	// Of the funcs with auth and without
+	for i, api := range []interface{}{&meApi{}, &versionedApi{}} {
+		user := appgo.Id(42 + i*10)
+		h := newHandler(api, HandlerTypeJson, ts, renderer)
+		path := reflect.TypeOf(api).Elem().Field(0).Tag.Get("path")
+		get := func(user appgo.Id) int {
+			r := httptest.NewRequest("GET", path, nil)
+			r.Header.Set(appgo.CustomTokenHeaderName, string(newTestToken(user)))
+			return serveTest(h, r).Code
+		}
+		atomic.StoreInt32(&ts.n, 0)
+		assert.Equal(t, http.StatusOK, get(user), path)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&ts.n), path)
+		// By user
+		assert.Equal(t, http.StatusTooManyRequests, get(user), path)
+		assert.Equal(t, http.StatusOK, get(user+1), path)
+	}
+
+	// Rejected ones too, by IP
+	h := newHandler(&meApi{}, HandlerTypeJson, ts, renderer)
+	for _, want := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		r := httptest.NewRequest("GET", "/me", nil)
+		r.Header.Set(appgo.CustomTokenHeaderName, "bad")
+		assert.Equal(t, want, serveTest(h, r).Code)
+	}
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewRedisRateLimiter(0.5, 2)
+	l.now = func() time.Time { return now }
+	var args []interface{}
+	reply := []interface{}{int64(0), []byte("0.25")}
+	l.do = func(cmd string, a ...interface{}) (interface{}, error) {
+		assert.Equal(t, "EVAL", cmd)
+		args = a
+		return reply, nil
+	}
+
+	rl := l.Take("ip:10.0.0.1")
+	assert.Equal(t, []interface{}{"ratelimit:ip:10.0.0.1", 0.5, 2, int64(1000000)}, args[2:])
+	assert.False(t, rl.Allowed)
+	assert.Equal(t, 2, rl.Limit)
+	assert.Equal(t, 0, rl.Remaining)
+	assert.Equal(t, 1500*time.Millisecond, rl.RetryAfter)
+	assert.Equal(t, now.Add(3500*time.Millisecond), rl.Reset)
+
+	reply = []interface{}{int64(1), []byte("1")}
+	rl = l.Take("ip:10.0.0.1")
+	assert.True(t, rl.Allowed)
+	assert.Equal(t, 1, rl.Remaining)
+	assert.Equal(t, time.Duration(0), rl.RetryAfter)
+
+	// Allowed if redis fails
+	l.do = func(string, ...interface{}) (interface{}, error) {
+		return nil, errors.New("connection refused")
+	}
+	assert.True(t, l.Take("ip:10.0.0.1").Allowed)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	log "github.com/Sirupsen/logrus"
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/oxfeeefeee/appgo/redis"
+	"math"
+	"time"
+)
+
+const redisLimitPrefix = "ratelimit:"
+
+// Refills and takes a token of bucket KEYS[1] atomically, ARGV are the
+// rate, burst and now in ms. Returns whether allowed and tokens left.
+const takeTokenScript = `
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local b = redis.call("HMGET", KEYS[1], "tokens", "at")
+local tokens = tonumber(b[1]) or burst
+local at = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - at) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "at", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`
+
+// RedisRateLimiter is a token bucket per key in redis, shared by the
+// servers, which refills rate tokens per second up to burst. Requests
+// are allowed if redis fails.
+type RedisRateLimiter struct {
+	rate  float64
+	burst int
+	now   func() time.Time
+	// Replaced in tests
+	do func(cmd string, args ...interface{}) (interface{}, error)
+}
+
+func NewRedisRateLimiter(rate float64, burst int) *RedisRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RedisRateLimiter{
+		rate:  rate,
+		burst: burst,
+		now:   time.Now,
+		do:    redis.Do,
+	}
+}
+
+func (l *RedisRateLimiter) Take(key string) *RateLimit {
+	now := l.now()
+	reply, err := l.do("EVAL", takeTokenScript, 1, redisLimitPrefix+key,
+		l.rate, l.burst, now.UnixNano()/int64(time.Millisecond))
+	vals, err := redigo.Values(reply, err)
+	var allowed int
+	var tokens float64
+	if err == nil {
+		_, err = redigo.Scan(vals, &allowed, &tokens)
+	}
+	if err != nil {
+		log.WithField("error", err).Errorln("Failed to take redis rate limit")
+		return &RateLimit{Allowed: true}
+	}
+	rl := &RateLimit{Allowed: allowed == 1, Limit: l.burst, Remaining: int(tokens)}
+	if !rl.Allowed {
+		rl.RetryAfter = l.refillTime(1 - tokens)
+	}
+	rl.Reset = now.Add(l.refillTime(float64(l.burst) - tokens))
+	return rl
+}
+
+func (l *RedisRateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration(math.Max(0, tokens) / l.rate * float64(time.Second))
+}
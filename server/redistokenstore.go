@@ -0,0 +1,186 @@
+package server
+
+import (
+	log "github.com/Sirupsen/logrus"
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/oxfeeefeee/appgo/redis"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	redisTokenPrefix = "token:"
+	// Set of the token hashes of a user
+	redisUserTokensPrefix = "tokens:"
+)
+
+// Sets when the token is seen if it exists, so that an expired one is
+// not recreated without a ttl.
+const touchTokenScript = `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "seen", ARGV[1])
+return 1
+`
+
+// RedisTokenStore keeps tokens in the redis of Conf.Redis, to be shared
+// by servers. Tokens expire by the ttl of their keys.
+type RedisTokenStore struct {
+	ttl time.Duration
+	now func() time.Time
+	// Replaced in tests
+	do func(cmd string, args ...interface{}) (interface{}, error)
+}
+
+func NewRedisTokenStore(ttl time.Duration) *RedisTokenStore {
+	return &RedisTokenStore{ttl: ttl, now: time.Now, do: redis.Do}
+}
+
+func (s *RedisTokenStore) IssueForDevice(user appgo.Id, role appgo.Role,
+	device string) (auth.Token, error) {
+	token := auth.NewToken(user, role)
+	if err := s.save(token, user, device); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *RedisTokenStore) save(token auth.Token, user appgo.Id, device string) error {
+	hash := tokenHash(token)
+	ms := s.ttl.Nanoseconds() / int64(time.Millisecond)
+	now := s.now().UnixNano()
+	key, userKey := redisTokenPrefix+hash, redisUserTokensPrefix+user.String()
+	if _, err := s.do("HMSET", key, "user", int64(user), "device", device,
+		"at", now, "seen", now); err != nil {
+		return err
+	}
+	if _, err := s.do("PEXPIRE", key, ms); err != nil {
+		return err
+	}
+	if _, err := s.do("SADD", userKey, hash); err != nil {
+		return err
+	}
+	_, err := s.do("PEXPIRE", userKey, ms)
+	return err
+}
+
+func (s *RedisTokenStore) Validate(token auth.Token) bool {
+	ok, err := redigo.Bool(s.do("EVAL", touchTokenScript, 1,
+		redisTokenPrefix+tokenHash(token), s.now().UnixNano()))
+	if err != nil {
+		log.WithField("error", err).Errorln("Failed to validate token")
+		return false
+	}
+	return ok
+}
+
+func (s *RedisTokenStore) Refresh(old auth.Token) (auth.Token, error) {
+	user, role := old.Validate()
+	if user == 0 {
+		return "", appgo.UnauthorizedErr
+	}
+	hash := tokenHash(old)
+	device, err := redigo.String(s.do("HGET", redisTokenPrefix+hash, "device"))
+	if err == redigo.ErrNil {
+		return "", appgo.UnauthorizedErr
+	} else if err != nil {
+		return "", err
+	}
+	// Only one of concurrent refreshes deletes it
+	if n, err := redigo.Int(s.do("DEL", redisTokenPrefix+hash)); err != nil {
+		return "", err
+	} else if n == 0 {
+		return "", appgo.UnauthorizedErr
+	}
+	s.do("SREM", redisUserTokensPrefix+user.String(), hash)
+	return s.IssueForDevice(user, role, device)
+}
+
+func (s *RedisTokenStore) Revoke(token auth.Token) error {
+	hash := tokenHash(token)
+	user, err := redigo.Int64(s.do("HGET", redisTokenPrefix+hash, "user"))
+	if err == redigo.ErrNil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := s.do("DEL", redisTokenPrefix+hash); err != nil {
+		return err
+	}
+	_, err = s.do("SREM", redisUserTokensPrefix+appgo.Id(user).String(), hash)
+	return err
+}
+
+func (s *RedisTokenStore) RevokeAllForUser(user appgo.Id) error {
+	userKey := redisUserTokensPrefix + user.String()
+	hashes, err := redigo.Strings(s.do("SMEMBERS", userKey))
+	if err != nil {
+		return err
+	}
+	keys := []interface{}{userKey}
+	for _, hash := range hashes {
+		keys = append(keys, redisTokenPrefix+hash)
+	}
+	_, err = s.do("DEL", keys...)
+	return err
+}
+
+func (s *RedisTokenStore) Sessions(user appgo.Id) ([]*Session, error) {
+	userKey := redisUserTokensPrefix + user.String()
+	hashes, err := redigo.Strings(s.do("SMEMBERS", userKey))
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*Session
+	for _, hash := range hashes {
+		vals, err := redigo.Values(s.do("HMGET", redisTokenPrefix+hash, "device", "at", "seen"))
+		if err != nil {
+			return nil, err
+		}
+		var device string
+		var at, seen int64
+		if vals[1] == nil {
+			// Expired
+			s.do("SREM", userKey, hash)
+			continue
+		}
+		if _, err := redigo.Scan(vals, &device, &at, &seen); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &Session{
+			Id:       hash[:16],
+			Device:   device,
+			IssuedAt: time.Unix(0, at),
+			LastSeen: time.Unix(0, seen),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].IssuedAt.Before(sessions[j].IssuedAt)
+	})
+	return sessions, nil
+}
+
+func (s *RedisTokenStore) RevokeSession(user appgo.Id, id string) error {
+	userKey := redisUserTokensPrefix + user.String()
+	hashes, err := redigo.Strings(s.do("SMEMBERS", userKey))
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if len(id) == 16 && strings.HasPrefix(hash, id) {
+			n, err := redigo.Int(s.do("DEL", redisTokenPrefix+hash))
+			if err != nil {
+				return err
+			}
+			s.do("SREM", userKey, hash)
+			if n == 1 {
+				return nil
+			}
+		}
+	}
+	return appgo.NotFoundErr
+}
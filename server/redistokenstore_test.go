@@ -0,0 +1,72 @@
+package server
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRedisTokenStore(t *testing.T) {
+	defer withTestTokens()()
+	mr, err := miniredis.Run()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer mr.Close()
+	now := time.Now()
+	s := NewRedisTokenStore(time.Hour)
+	s.now = func() time.Time { return now }
+	s.do = func(cmd string, args ...interface{}) (interface{}, error) {
+		conn, err := redigo.Dial("tcp", mr.Addr())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return conn.Do(cmd, args...)
+	}
+
+	phone, err := s.IssueForDevice(42, appgo.RoleAppUser, "phone")
+	assert.NoError(t, err)
+	now = now.Add(time.Minute)
+	laptop, _ := s.IssueForDevice(42, appgo.RoleAppUser, "laptop")
+	other, _ := s.IssueForDevice(43, appgo.RoleAppUser, "")
+	assert.True(t, s.Validate(phone))
+	assert.False(t, s.Validate(newTestToken(42)), "not issued by the store")
+	// Keys hold no tokens
+	assert.False(t, mr.Exists(redisTokenPrefix+string(phone)))
+
+	sessions, err := s.Sessions(42)
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 2) {
+		assert.Equal(t, "phone", sessions[0].Device)
+		assert.Equal(t, sessionId(phone), sessions[0].Id)
+		assert.True(t, now.Equal(sessions[1].IssuedAt))
+	}
+
+	fresh, err := s.Refresh(phone)
+	assert.NoError(t, err)
+	assert.False(t, s.Validate(phone))
+	assert.True(t, s.Validate(fresh))
+	_, err = s.Refresh(phone)
+	assert.Equal(t, appgo.UnauthorizedErr, err)
+
+	assert.Equal(t, appgo.NotFoundErr, s.RevokeSession(43, sessionId(fresh)))
+	assert.NoError(t, s.RevokeSession(42, sessionId(fresh)))
+	assert.False(t, s.Validate(fresh))
+	assert.NoError(t, s.Revoke(other))
+	assert.False(t, s.Validate(other))
+	assert.NoError(t, s.RevokeAllForUser(42))
+	assert.False(t, s.Validate(laptop))
+
+	// Expired by the ttl of keys
+	token, _ := s.IssueForDevice(44, appgo.RoleAppUser, "")
+	mr.FastForward(time.Hour)
+	assert.False(t, s.Validate(token))
+	assert.False(t, mr.Exists(redisTokenPrefix+tokenHash(token)), "not recreated")
+	sessions, err = s.Sessions(44)
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+}
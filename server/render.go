@@ -1,50 +1,213 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/oxfeeefeee/appgo"
+	"io"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
 )
 
-func (h *handler) renderData(w http.ResponseWriter, v interface{}) {
-	if h.htype == HandlerTypeJson {
-		h.renderJSON(w, v)
+func (h *handler) renderData(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if p, ok := v.(*appgo.Precompressed); ok && p != nil {
+		h.renderPrecompressed(w, r, p)
+	} else if s, ok := v.(*appgo.StreamResponse); ok && s != nil {
+		h.renderStream(w, r, s)
+	} else if rd, ok := v.(io.Reader); ok && rd != nil && h.htype == HandlerTypeJson {
+		h.renderStream(w, r, &appgo.StreamResponse{Body: rd})
+	} else if _, ok := v.(appgo.NoContent); ok && h.htype == HandlerTypeJson {
+		w.WriteHeader(http.StatusNoContent)
+	} else if c, ok := v.(*appgo.Created); ok && c != nil && h.htype == HandlerTypeJson {
+		if c.Location != "" {
+			w.Header().Set("Location", c.Location)
+		}
+		h.renderReply(w, r, http.StatusCreated, c.Body)
+	} else if sr, ok := v.(*appgo.StatusReply); ok && sr != nil && h.htype == HandlerTypeJson {
+		h.renderReply(w, r, sr.Status, sr.Body)
+	} else if h.htype == HandlerTypeJson {
+		h.renderReply(w, r, http.StatusOK, v)
 	} else if h.htype == HandlerTypeHtml {
-		h.renderHtml(w, h.template, v)
+		h.renderHtml(w, r, h.pickTemplate(w, r), v)
 	} else {
 		panic("Bad handler type")
 	}
 }
 
-func (h *handler) renderError(w http.ResponseWriter, err *appgo.ApiError) {
-	if h.htype == HandlerTypeJson {
-		h.renderJSON(w, err)
+// renderReply replies what JSON API funcs return, in the envelope and
+// with the fields the client can see.
+func (h *handler) renderReply(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if h.negotiate(r) != "" {
+		h.renderValue(w, r, status, h.blankInvisible(r, h.envelope(v)))
+		return
+	}
+	visible, err := h.filterVisible(r, h.envelope(v))
+	if err != nil {
+		logEntry(r).WithFields(log.Fields{
+			"error": err,
+			"type":  fmt.Sprintf("%T", v),
+		}).Error("Error encoding json")
+		h.renderError(w, r, appgo.NewApiErr(appgo.ECodeInternal, "Failed to encode reply"))
+		return
+	}
+	h.renderJSON(w, r, status, visible)
+}
+
+// renderError replies an error of the framework, localized if a message
+// is registered for its code, see appgo.RegisterErrMessage.
+func (h *handler) renderError(w http.ResponseWriter, r *http.Request, err *appgo.ApiError) {
+	h.writeError(w, r, localizeErr(r, err))
+}
+
+// writeError replies err as is, e.g. errors returned by API funcs, along
+// with the request id.
+func (h *handler) writeError(w http.ResponseWriter, r *http.Request, err *appgo.ApiError) {
+	setErrCode(w, err.Code)
+	if id := appgo.RequestIDFromContext(r.Context()); id != "" && err.RequestId != id {
+		// Errors may be shared, e.g. appgo.NotFoundErr
+		e := *err
+		e.RequestId = id
+		err = &e
+	}
+	if h.htype == HandlerTypeJson || h.htype == HandlerTypeSSE ||
+		h.htype == HandlerTypeWebSocket {
+		h.renderValue(w, r, errStatus(err), h.errEnvelope(err))
 	} else if h.htype == HandlerTypeHtml {
-		err := h.renderer.Text(w, err.HttpCode(), err.Error())
-		if err != nil {
-			log.WithField("error", err).Error("Error rendering html error")
+		if page := h.errorPage(r, err.HttpStatus(), err); page != nil {
+			h.writeData(w, r, errStatus(err), "text/html; charset=UTF-8", page)
+			return
 		}
+		h.writeData(w, r, errStatus(err), "text/plain; charset=UTF-8", []byte(err.Error()))
 	} else {
 		panic("Bad handler type")
 	}
 }
 
-func (h *handler) renderJSON(w http.ResponseWriter, v interface{}) {
-	err := h.renderer.JSON(w, http.StatusOK, v)
+// renderJSON marshals v before writing anything, so a reply failing to
+// encode still gets a proper error instead of a broken body.
+func (h *handler) renderJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	data, err := marshalJSON(v)
 	if err != nil {
-		log.WithFields(log.Fields{
+		logEntry(r).WithFields(log.Fields{
 			"error": err,
-			"data":  v,
-		}).Error("Error rendering json")
+			"type":  fmt.Sprintf("%T", v),
+		}).Error("Error encoding json")
+		aerr := appgo.NewApiErr(appgo.ECodeInternal, "Failed to encode reply")
+		status = errStatus(aerr)
+		data, _ = marshalJSON(aerr)
 	}
+	if h.etag && status == http.StatusOK && (r.Method == "GET" || r.Method == "HEAD") {
+		if h.checkETag(w, r, data) {
+			return
+		}
+	}
+	h.writeData(w, r, status, "application/json; charset=UTF-8", data)
 }
 
-func (h *handler) renderHtml(w http.ResponseWriter, template string, data interface{}) {
-	err := h.renderer.HTML(w, http.StatusOK, template, data)
+// writeData writes out a fully rendered reply, compressing it if enabled
+// and accepted by the client.
+func (h *handler) writeData(w http.ResponseWriter, r *http.Request, status int,
+	contentType string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	if appgo.Conf.Compression.Enable {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if enc := compressEncoding(w, r, contentType, len(data)); enc != "" {
+			if cdata, err := compress(enc, data); err != nil {
+				logEntry(r).WithField("error", err).Error("Error compressing reply")
+			} else {
+				w.Header().Set("Content-Encoding", enc)
+				data = cdata
+			}
+		}
+	}
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		logEntry(r).WithField("error", err).Info("Error writing reply")
+	}
+}
+
+// renderStream copies the body to the client as it's read, compressed on
+// the fly if enabled and accepted.
+func (h *handler) renderStream(w http.ResponseWriter, r *http.Request, s *appgo.StreamResponse) {
+	if c, ok := s.Body.(io.Closer); ok {
+		defer c.Close()
+	}
+	ctype := s.ContentType
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	if s.Filename != "" {
+		w.Header().Set("Content-Disposition",
+			mime.FormatMediaType("attachment", map[string]string{"filename": s.Filename}))
+	}
+	var out io.Writer = w
+	compressed := false
+	if appgo.Conf.Compression.Enable {
+		w.Header().Add("Vary", "Accept-Encoding")
+		// An unknown length is assumed long enough
+		size := s.Size
+		if size <= 0 || size > math.MaxInt32 {
+			size = math.MaxInt32
+		}
+		if enc := compressEncoding(w, r, ctype, int(size)); enc != "" {
+			w.Header().Set("Content-Encoding", enc)
+			cw := compressWriter(enc, w)
+			defer cw.Close()
+			out = cw
+			compressed = true
+		}
+	}
+	if s.Size > 0 && !compressed {
+		w.Header().Set("Content-Length", strconv.FormatInt(s.Size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(out, s.Body); err != nil {
+		logEntry(r).WithField("error", err).Info("Error streaming reply")
+	}
+}
+
+func marshalJSON(v interface{}) ([]byte, error) {
+	if appgo.Conf.DevMode {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
+
+// renderHtml renders data with the template, in the status of data if it's
+// an *appgo.StatusReply.
+func (h *handler) renderHtml(w http.ResponseWriter, r *http.Request, template string, data interface{}) {
+	status := http.StatusOK
+	if s, ok := data.(*appgo.StatusReply); ok && s != nil {
+		status, data = s.Status, s.Body
+	}
+	page, err := h.executeHtml(template, data)
 	if err != nil {
-		log.WithFields(log.Fields{
+		logEntry(r).WithFields(log.Fields{
 			"error": err,
 			"data":  data,
 		}).Error("Error rendering html")
+		h.renderError(w, r, appgo.NewApiErr(appgo.ECodeInternal, "Error rendering html"))
+		return
+	}
+	h.writeData(w, r, status, "text/html; charset=UTF-8", page)
+}
+
+func (h *handler) executeHtml(template string, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := h.renderer.HTML(&buf, http.StatusOK, template, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func errStatus(err *appgo.ApiError) int {
+	if appgo.Conf.AlwaysReturn200 {
+		return http.StatusOK
 	}
+	return err.HttpStatus()
 }
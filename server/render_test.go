@@ -0,0 +1,700 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/unrolled/render"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type sizedApi struct {
+	META struct{} `path:"/sized"`
+}
+
+type sizedInput struct {
+	Size int
+}
+
+func (sizedApi) GET(in *sizedInput) (string, error) {
+	return strings.Repeat("a", in.Size), nil
+}
+
+func TestCompression(t *testing.T) {
+	appgo.Conf.Compression.Enable = true
+	appgo.Conf.Compression.MinLength = 100
+	defer func() { appgo.Conf.Compression.Enable = false }()
+	h := newTestHandler(&sizedApi{})
+
+	r := httptest.NewRequest("GET", "/sized?Size=4096", nil)
+	r.Header.Set("Accept-Encoding", "deflate;q=0.5, gzip")
+	w := serveTest(h, r)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	gr, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(gr)
+	assert.NoError(t, err)
+	var reply string
+	assert.NoError(t, json.Unmarshal(data, &reply))
+	assert.Len(t, reply, 4096)
+
+	r = httptest.NewRequest("GET", "/sized?Size=10", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = serveTest(h, r)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, `"aaaaaaaaaa"`, w.Body.String())
+}
+
+type precompressedApi struct {
+	META struct{} `path:"/precompressed"`
+}
+
+func (precompressedApi) GET(in *appgo.DummyInput) (*appgo.Precompressed, error) {
+	return appgo.GzipJSON(map[string]string{"a": "b"})
+}
+
+func TestPrecompressed(t *testing.T) {
+	h := newTestHandler(&precompressedApi{})
+	want, _ := appgo.GzipJSON(map[string]string{"a": "b"})
+
+	r := httptest.NewRequest("GET", "/precompressed", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := serveTest(h, r)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, want.Data, w.Body.Bytes())
+
+	r = httptest.NewRequest("GET", "/precompressed", nil)
+	r.Header.Set("Accept-Encoding", "deflate")
+	w = serveTest(h, r)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, `{"a":"b"}`, w.Body.String())
+}
+
+type abApi struct {
+	META struct{} `path:"/ab" template:"a" variants:"a:50,b:50"`
+}
+
+func (abApi) HTML(in *appgo.DummyInput) (string, error) {
+	return "", nil
+}
+
+type badAbApi struct {
+	META struct{} `path:"/ab" template:"a" variants:"a:50,b:20"`
+}
+
+func (badAbApi) HTML(in *appgo.DummyInput) (string, error) {
+	return "", nil
+}
+
+func TestTemplateVariants(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "a.tmpl"), []byte("layout a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.tmpl"), []byte("layout b"), 0644)
+	renderer := render.New(render.Options{Directory: dir})
+	h := newHandler(&abApi{}, HandlerTypeHtml, testTokenStore{}, renderer)
+
+	seen := map[string]int{}
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest("GET", "/ab", nil)
+		r.RemoteAddr = "10.0.0." + strconv.Itoa(i) + ":1234"
+		w := serveTest(h, r)
+		variant := w.Header().Get(appgo.CustomVariantHeaderName)
+		assert.Equal(t, "layout "+variant, w.Body.String())
+		seen[variant]++
+
+		// Sticks to the client
+		w = serveTest(h, r)
+		assert.Equal(t, variant, w.Header().Get(appgo.CustomVariantHeaderName))
+	}
+	assert.Len(t, seen, 2)
+
+	assert.Panics(t, func() {
+		newHandler(&badAbApi{}, HandlerTypeHtml, testTokenStore{}, renderer)
+	})
+}
+
+type htmlPageApi struct {
+	META struct{} `path:"/pages/{id}" template:"page"`
+}
+
+func (htmlPageApi) HTML(in *struct{ ResourceId__ int64 }) (interface{}, error) {
+	switch in.ResourceId__ {
+	case 1:
+		return "one", nil
+	case 2:
+		return &appgo.StatusReply{Status: http.StatusAccepted, Body: "two"}, nil
+	case 3:
+		return nil, appgo.NewApiErr(appgo.ECodeInternal, "broken")
+	}
+	return nil, appgo.NewApiErr(appgo.ECodeNotFound, "no such page")
+}
+
+func TestHtmlStatus(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "page.tmpl"), []byte("page {{.}}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "404.tmpl"), []byte("missing: {{.Msg}}"), 0644)
+	appgo.Conf.TemplatePath = dir
+	defer func() { appgo.Conf.TemplatePath = "" }()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddHtml("", "", []interface{}{&htmlPageApi{}}, nil)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	w := get("/pages/1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "page one", w.Body.String())
+	w = get("/pages/2")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "page two", w.Body.String())
+
+	// Plain text without error templates
+	w = get("/pages/4")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "no such page", w.Body.String())
+
+	SetErrorTemplate("4xx", "404")
+	defer SetErrorTemplate("4xx", "")
+	w = get("/pages/4")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "text/html; charset=UTF-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "missing: no such page", w.Body.String())
+	w = get("/pages/3")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "broken", w.Body.String())
+}
+
+type etagApi struct {
+	META struct{} `path:"/sized" etag:"true"`
+}
+
+func (etagApi) GET(in *sizedInput) (string, error) {
+	return strings.Repeat("a", in.Size), nil
+}
+
+func TestETag(t *testing.T) {
+	appgo.Conf.Compression.Enable = true
+	appgo.Conf.Compression.MinLength = 100
+	defer func() { appgo.Conf.Compression.Enable = false }()
+	h := newTestHandler(&etagApi{})
+
+	r := httptest.NewRequest("GET", "/sized?Size=10", nil)
+	w := serveTest(h, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.True(t, strings.HasPrefix(etag, `W/"`))
+
+	// Same ETag for the compressed representation
+	r = httptest.NewRequest("GET", "/sized?Size=10", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("If-None-Match", `"other", `+etag)
+	w = serveTest(h, r)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, 0, w.Body.Len())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	r = httptest.NewRequest("GET", "/sized?Size=1000", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = serveTest(h, r)
+	bigEtag := w.Header().Get("ETag")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	r = httptest.NewRequest("GET", "/sized?Size=1000", nil)
+	r.Header.Set("If-None-Match", bigEtag)
+	w = serveTest(h, r)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	r = httptest.NewRequest("GET", "/sized?Size=11", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = serveTest(h, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	w = serveTest(newTestHandler(&sizedApi{}), httptest.NewRequest("GET", "/sized?Size=10", nil))
+	assert.Equal(t, "", w.Header().Get("ETag"))
+}
+
+type envelopeApi struct {
+	META struct{} `path:"/sized"`
+}
+
+func (envelopeApi) GET(in *sizedInput) (interface{}, error) {
+	if in.Size < 0 {
+		return nil, appgo.NewApiErr(appgo.ECodeBadRequest, "bad size")
+	} else if in.Size == 0 {
+		return &appgo.Envelope{Code: appgo.ECodeOK, Data: "pre"}, nil
+	}
+	return strings.Repeat("a", in.Size), nil
+}
+
+type rawApi struct {
+	META struct{} `path:"/sized" raw:"true"`
+}
+
+func (rawApi) GET(in *sizedInput) (string, error) {
+	return strings.Repeat("a", in.Size), nil
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	SetResponseEnvelope(CodeEnvelope)
+	defer SetResponseEnvelope(nil)
+	h := newTestHandler(&envelopeApi{})
+
+	w := serveTest(h, httptest.NewRequest("GET", "/sized?Size=2", nil))
+	assert.Equal(t, `{"errcode":20000,"data":"aa"}`, w.Body.String())
+	w = serveTest(h, httptest.NewRequest("GET", "/sized?Size=0", nil))
+	assert.Equal(t, `{"errcode":20000,"data":"pre"}`, w.Body.String())
+	w = serveTest(h, httptest.NewRequest("GET", "/sized?Size=-1", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, `{"errcode":40000,"errmsg":"bad size"}`, w.Body.String())
+
+	w = serveTest(newTestHandler(&rawApi{}), httptest.NewRequest("GET", "/sized?Size=2", nil))
+	assert.Equal(t, `"aa"`, w.Body.String())
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	SetResponseEnvelope(func(data interface{}) interface{} {
+		return map[string]interface{}{"code": 0, "msg": "", "data": data}
+	})
+	SetErrorEnvelope(func(err *appgo.ApiError) interface{} {
+		return map[string]interface{}{"code": err.Code, "msg": err.Msg, "data": nil}
+	})
+	defer SetResponseEnvelope(nil)
+	defer SetErrorEnvelope(nil)
+	h := newTestHandler(&envelopeApi{})
+
+	w := serveTest(h, httptest.NewRequest("GET", "/sized?Size=2", nil))
+	assert.Equal(t, `{"code":0,"data":"aa","msg":""}`, w.Body.String())
+	w = serveTest(h, httptest.NewRequest("GET", "/sized?Size=-1", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, `{"code":40000,"data":null,"msg":"bad size"}`, w.Body.String())
+
+	w = serveTest(newTestHandler(&rawApi{}), httptest.NewRequest("GET", "/sized?Size=x", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"errcode":40000`)
+}
+
+type visibleProfile struct {
+	Phone string `visibility:"admin" json:"phone,omitempty"`
+	City  string `json:"city"`
+}
+
+type visibleUser struct {
+	Name    string `json:"name"`
+	Email   string `json:"email" visibility:"admin,appUser"`
+	Flagged bool   `visibility:"admin"`
+	visibleProfile
+	Friends []*visibleUser `json:"friends,omitempty"`
+}
+
+type visibleApi struct {
+	META struct{} `path:"/visible"`
+}
+
+func (visibleApi) GET(in *appgo.DummyInput) (*visibleUser, error) {
+	friend := &visibleUser{Name: "b", Email: "b@x.com"}
+	return &visibleUser{
+		Name:           "a",
+		Email:          "a@x.com",
+		Flagged:        true,
+		visibleProfile: visibleProfile{Phone: "123", City: "sh"},
+		Friends:        []*visibleUser{friend},
+	}, nil
+}
+
+func TestVisibility(t *testing.T) {
+	defer withTestTokens()()
+	h := newTestHandler(&visibleApi{})
+	get := func(role appgo.Role) string {
+		r := httptest.NewRequest("GET", "/visible", nil)
+		if role != 0 {
+			r.Header.Set(appgo.CustomTokenHeaderName, string(auth.NewToken(1, role)))
+		}
+		return serveTest(h, r).Body.String()
+	}
+
+	assert.Equal(t, `{"name":"a","email":"a@x.com","Flagged":true,"phone":"123","city":"sh",`+
+		`"friends":[{"name":"b","email":"b@x.com","Flagged":false,"city":""}]}`,
+		get(appgo.RoleWebAdmin))
+	assert.Equal(t, `{"name":"a","email":"a@x.com","city":"sh",`+
+		`"friends":[{"name":"b","email":"b@x.com","city":""}]}`, get(appgo.RoleAppUser))
+	assert.Equal(t, `{"name":"a","city":"sh","friends":[{"name":"b","city":""}]}`,
+		get(appgo.RoleWebUser))
+	assert.Equal(t, `{"name":"a","city":"sh","friends":[{"name":"b","city":""}]}`, get(0))
+
+	// Same as encoding/json for types without visibility tags
+	data, _ := json.Marshal(map[string]interface{}{"a": []int{1}, "b": visibleProfile{City: "x"}})
+	v, err := h.filterVisible(httptest.NewRequest("GET", "/", nil),
+		map[string]interface{}{"a": []int{1}, "b": visibleProfile{City: "x"}})
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), string(v.(json.RawMessage)))
+}
+
+// exportReader yields size bytes of CSV-ish lines, pausing at half until
+// resumed.
+type exportReader struct {
+	size, read int
+	resume     chan struct{}
+	closed     bool
+}
+
+func (e *exportReader) Read(p []byte) (int, error) {
+	if e.read >= e.size {
+		return 0, io.EOF
+	}
+	if e.read == e.size/2 && e.resume != nil {
+		<-e.resume
+		e.resume = nil
+	}
+	n := len(p)
+	if left := e.size - e.read; n > left {
+		n = left
+	}
+	if half := e.size / 2; e.read < half && e.read+n > half {
+		n = half - e.read
+	}
+	for i := 0; i < n; i++ {
+		p[i] = "a,b\n"[(e.read+i)%4]
+	}
+	e.read += n
+	return n, nil
+}
+
+func (e *exportReader) Close() error {
+	e.closed = true
+	return nil
+}
+
+var export *exportReader
+
+type exportApi struct {
+	META struct{} `path:"/export"`
+}
+
+func (exportApi) GET(in *appgo.DummyInput) (*appgo.StreamResponse, error) {
+	return &appgo.StreamResponse{ContentType: "text/csv", Body: export}, nil
+}
+
+type rawExportApi struct {
+	META struct{} `path:"/export"`
+}
+
+func (rawExportApi) GET(in *appgo.DummyInput) (io.Reader, error) {
+	return strings.NewReader("raw"), nil
+}
+
+func TestStreamResponse(t *testing.T) {
+	const size = 8 << 20
+	export = &exportReader{size: size, resume: make(chan struct{})}
+	var entries []AccessLogEntry
+	SetAccessLogger(func(e AccessLogEntry) { entries = append(entries, e) })
+	defer SetAccessLogger(nil)
+	ts := httptest.NewServer(newTestHandler(&exportApi{}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/export")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	// The first half arrives while the reader is paused
+	head := make([]byte, size/2)
+	_, err = io.ReadFull(resp.Body, head)
+	assert.NoError(t, err)
+	assert.Equal(t, "a,b\na,b\n", string(head[:8]))
+	close(export.resume)
+	rest, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, size/2, len(rest))
+	first := export
+
+	// Compressed on the fly
+	appgo.Conf.Compression.Enable = true
+	defer func() { appgo.Conf.Compression.Enable = false }()
+	export = &exportReader{size: size}
+	r, _ := http.NewRequest("GET", ts.URL+"/export", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(r)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		gr, err := gzip.NewReader(resp.Body)
+		if assert.NoError(t, err) {
+			data, err := ioutil.ReadAll(gr)
+			assert.NoError(t, err)
+			assert.Equal(t, size, len(data))
+		}
+		resp.Body.Close()
+	}
+	// Waits for the handlers to return
+	ts.Close()
+	assert.True(t, first.closed)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, http.StatusOK, entries[0].Status)
+	}
+
+	w := serveTest(newTestHandler(&rawExportApi{}), httptest.NewRequest("GET", "/export", nil))
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "raw", w.Body.String())
+}
+
+type downloadApi struct {
+	META struct{} `path:"/download"`
+}
+
+func (downloadApi) GET(in *appgo.DummyInput) (*appgo.StreamResponse, error) {
+	return &appgo.StreamResponse{
+		ContentType: "text/csv",
+		Body:        &exportReader{size: 4096},
+		Size:        4096,
+		Filename:    "report 1.csv",
+	}, nil
+}
+
+func TestStreamSize(t *testing.T) {
+	h := newTestHandler(&downloadApi{})
+	w := serveTest(h, httptest.NewRequest("GET", "/download", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "4096", w.Header().Get("Content-Length"))
+	assert.Equal(t, `attachment; filename="report 1.csv"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, 4096, w.Body.Len())
+
+	// The length is unknown once compressed
+	appgo.Conf.Compression.Enable = true
+	defer func() { appgo.Conf.Compression.Enable = false }()
+	r := httptest.NewRequest("GET", "/download", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = serveTest(h, r)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header().Get("Content-Length"))
+}
+
+func TestContentNegotiation(t *testing.T) {
+	defer withTestTokens()()
+	h := newTestHandler(&visibleApi{})
+	get := func(h http.Handler, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/visible", nil)
+		r.Header.Set("Accept", accept)
+		return serveTest(h, r)
+	}
+	w := get(h, "application/xml")
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json", "disabled")
+
+	appgo.Conf.ContentNegotiation.Enable = true
+	defer func() { appgo.Conf.ContentNegotiation.Enable = false }()
+	w = get(h, "application/xml")
+	assert.Equal(t, "application/xml; charset=UTF-8", w.Header().Get("Content-Type"))
+	var u visibleUser
+	assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &u))
+	assert.Equal(t, "a", u.Name)
+	assert.Equal(t, "sh", u.City)
+	assert.Equal(t, "b", u.Friends[0].Name)
+	// Hidden from anonymous callers
+	assert.Empty(t, u.Email)
+	assert.Empty(t, u.Phone)
+	assert.False(t, u.Flagged)
+
+	for _, accept := range []string{"", "*/*", "application/json", "text/xml;q=0.5, */*",
+		"application/xml;q=0.9, application/json"} {
+		w = get(h, accept)
+		assert.Contains(t, w.Header().Get("Content-Type"), "application/json", accept)
+		assert.True(t, json.Valid(w.Body.Bytes()))
+	}
+	w = get(h, "text/xml, application/json;q=0.8")
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/xml")
+
+	// Errors too
+	r := httptest.NewRequest("GET", "/sized?Size=-1", nil)
+	r.Header.Set("Accept", "text/xml")
+	w = serveTest(newTestHandler(&envelopeApi{}), r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var e appgo.ApiError
+	assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &e))
+	assert.Equal(t, appgo.ErrCode(appgo.ECodeBadRequest), e.Code)
+	assert.Equal(t, "bad size", e.Msg)
+}
+
+type xmlMapApi struct {
+	META struct{} `path:"/maps"`
+}
+
+func (xmlMapApi) GET(in *appgo.DummyInput) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"name":   "a",
+		"tags":   []string{"x", "y"},
+		"scores": map[int]int{1: 2},
+		"a b":    true,
+	}, nil
+}
+
+func (xmlMapApi) PUT(in *appgo.DummyInput) (map[string]string, error) {
+	return nil, nil
+}
+
+func (xmlMapApi) POST(in *appgo.DummyInput) error {
+	return nil
+}
+
+func (xmlMapApi) DELETE(in *appgo.DummyInput) ([]map[string]string, error) {
+	return []map[string]string{{"id": "1"}, {"id": "2"}}, nil
+}
+
+func TestXMLMaps(t *testing.T) {
+	appgo.Conf.ContentNegotiation.Enable = true
+	defer func() { appgo.Conf.ContentNegotiation.Enable = false }()
+	h := newTestHandler(&xmlMapApi{})
+	call := func(method string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/maps", nil)
+		r.Header.Set("Accept", "application/xml")
+		return serveTest(h, r)
+	}
+
+	w := call("GET")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, xml.Header+`<map><entry key="a b">true</entry><name>a</name>`+
+		`<scores><entry key="1">2</entry></scores><tags>x</tags><tags>y</tags></map>`, w.Body.String())
+	// Nil maps and error-only funcs
+	for _, method := range []string{"PUT", "POST"} {
+		w = call(method)
+		assert.Equal(t, http.StatusOK, w.Code, method)
+		assert.Equal(t, xml.Header+`<map></map>`, w.Body.String(), method)
+	}
+	w = call("DELETE")
+	assert.Equal(t, xml.Header+`<list><item><id>1</id></item><item><id>2</id></item></list>`, w.Body.String())
+	// Whatever Accept is
+	w = serveTest(newTestHandler(&struct {
+		META struct{} `path:"/maps" reply:"xml"`
+		xmlMapApi
+	}{}), httptest.NewRequest("POST", "/maps", nil))
+	assert.Equal(t, xml.Header+`<map></map>`, w.Body.String())
+
+	// Enveloped
+	SetResponseEnvelope(func(v interface{}) interface{} {
+		return &appgo.Envelope{Data: v}
+	})
+	defer SetResponseEnvelope(nil)
+	w = call("POST")
+	assert.Equal(t, xml.Header+`<Envelope><errcode>0</errcode><data></data></Envelope>`, w.Body.String())
+}
+
+type userCodec struct{}
+
+func (userCodec) Marshal(v interface{}) ([]byte, error) {
+	if u, ok := v.(*visibleUser); ok {
+		return []byte("user:" + u.Name + ":" + u.Email), nil
+	}
+	return nil, ErrCodecUnsupported
+}
+
+func TestCodecs(t *testing.T) {
+	appgo.Conf.ContentNegotiation.Enable = true
+	RegisterCodec("application/x-user", userCodec{})
+	defer func() {
+		appgo.Conf.ContentNegotiation.Enable = false
+		RegisterCodec("application/x-user", nil)
+	}()
+	get := func(h http.Handler, path, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept", accept)
+		return serveTest(h, r)
+	}
+	h := newTestHandler(&visibleApi{})
+	w := get(h, "/visible", "application/x-user, application/json;q=0.5")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-user", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", w.Header().Get("Vary"))
+	// Hidden fields are blanked
+	assert.Equal(t, "user:a:", w.Body.String())
+
+	w = get(h, "/visible", "application/x-user;q=0.5, application/json")
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+	w = get(h, "/visible", "application/x-other")
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+
+	// Unsupported values fall back to JSON
+	w = get(newTestHandler(&envelopeApi{}), "/sized?Size=-1", "application/x-user")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+	assert.Contains(t, w.Body.String(), `"errcode":40000`)
+}
+
+type payNotice struct {
+	XMLName xml.Name `xml:"xml"`
+	OrderId string   `xml:"out_trade_no"`
+}
+
+type payAck struct {
+	XMLName xml.Name `xml:"xml"`
+	Code    string   `xml:"return_code"`
+}
+
+type payCallbackApi struct {
+	META struct{} `path:"/paid" reply:"xml"`
+}
+
+func (payCallbackApi) POST(in *struct{ Content__ *payNotice }) (*payAck, error) {
+	if in.Content__.OrderId == "" {
+		return nil, appgo.NewApiErr(appgo.ECodeBadRequest, "no order")
+	}
+	return &payAck{Code: "SUCCESS"}, nil
+}
+
+func TestReplyXML(t *testing.T) {
+	h := newTestHandler(&payCallbackApi{})
+	post := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/paid", strings.NewReader(body))
+		r.Header.Set("Content-Type", "text/xml")
+		return serveTest(h, r)
+	}
+	w := post(`<xml><out_trade_no>42</out_trade_no></xml>`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/xml; charset=UTF-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, xml.Header+`<xml><return_code>SUCCESS</return_code></xml>`, w.Body.String())
+
+	w = post(`<xml></xml>`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var aerr appgo.ApiError
+	assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &aerr))
+	assert.Equal(t, "no order", aerr.Msg)
+}
+
+func TestBrotliCompression(t *testing.T) {
+	c := appgo.Conf.Compression
+	appgo.Conf.Compression.Enable = true
+	appgo.Conf.Compression.MinLength = 100
+	defer func() { appgo.Conf.Compression = c }()
+	h := newTestHandler(&sizedApi{})
+	get := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/sized?Size=4096", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		return serveTest(h, r)
+	}
+
+	w := get("gzip, deflate, br")
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	data, err := decompress("br", w.Body.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, `"`+strings.Repeat("a", 4096)+`"`, string(data))
+
+	appgo.Conf.Compression.Encodings = []string{"gzip", "br"}
+	assert.Equal(t, "gzip", get("gzip, br").Header().Get("Content-Encoding"))
+	appgo.Conf.Compression.Encodings = nil
+
+	// Only types allowed
+	appgo.Conf.Compression.Types = []string{"text/"}
+	assert.Equal(t, "", get("br").Header().Get("Content-Encoding"))
+	appgo.Conf.Compression.Types = []string{"Application/JSON"}
+	assert.Equal(t, "br", get("br").Header().Get("Content-Encoding"))
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultRequestIdHeader = "X-Request-ID"
+	maxRequestIdLength     = 128
+)
+
+// withRequestID takes the request id from the request header or generates
+// one, puts it in the request context and echoes it in the reply header.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if appgo.RequestIDFromContext(r.Context()) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header := requestIdHeader()
+		id := r.Header.Get(header)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(header, id)
+		next.ServeHTTP(w, r.WithContext(appgo.WithRequestID(r.Context(), id)))
+	})
+}
+
+func requestIdHeader() string {
+	if h := appgo.Conf.RequestId.Header; h != "" {
+		return h
+	}
+	return defaultRequestIdHeader
+}
+
+// validRequestID accepts ids of letters, digits and "-_.:", against
+// injections into logs and headers of downstream requests.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ForwardRequestID sets the request id of ctx on out, a request to a
+// downstream service, for the calls to be correlated in logs.
+func ForwardRequestID(ctx context.Context, out *http.Request) {
+	if id := appgo.RequestIDFromContext(ctx); id != "" {
+		out.Header.Set(requestIdHeader(), id)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.WithField("error", err).Error("Failed to generate request id")
+	}
+	return hex.EncodeToString(b)
+}
+
+// logEntry returns a log entry with the request id and trace if any.
+func logEntry(r *http.Request) *log.Entry {
+	fields := log.Fields{}
+	if id := appgo.RequestIDFromContext(r.Context()); id != "" {
+		fields["request_id"] = id
+	}
+	if tc := appgo.TraceFromContext(r.Context()); tc != nil {
+		fields["trace_id"] = tc.TraceId
+		fields["span_id"] = tc.SpanId
+	}
+	return log.WithFields(fields)
+}
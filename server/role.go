@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"strings"
+)
+
+// parseRoles parses tag like `requireRole:"editor,moderator"` of UserId__,
+// the names are registered with appgo.RegisterRole.
+func parseRoles(tag string) ([]appgo.Role, error) {
+	var roles []appgo.Role
+	for _, name := range strings.Split(tag, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		role, ok := appgo.RoleByName(name)
+		if !ok {
+			return nil, fmt.Errorf("Unknown role in requireRole: %s", name)
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// allowsRole returns true if the func requires no role or role is one of
+// the required ones.
+func (f *httpFunc) allowsRole(role appgo.Role) bool {
+	if len(f.roles) == 0 {
+		return true
+	}
+	for _, r := range f.roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePerms parses tag like `perm:"article:write,article:publish"` of
+// UserId__, all of which are required.
+func parsePerms(tag string) ([]string, error) {
+	var perms []string
+	for _, perm := range strings.Split(tag, ",") {
+		if perm = strings.TrimSpace(perm); perm == "" {
+			continue
+		}
+		if strings.ContainsAny(perm, " *") {
+			return nil, fmt.Errorf("Bad permission in perm: %s", perm)
+		}
+		perms = append(perms, perm)
+	}
+	return perms, nil
+}
+
+// missingPerm returns the first permission required by the func which
+// role isn't granted, empty if none.
+func (f *httpFunc) missingPerm(role appgo.Role) string {
+	for _, perm := range f.perms {
+		if !appgo.RoleHasPermission(role, perm) {
+			return perm
+		}
+	}
+	return ""
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	roleEditor    appgo.Role = 300
+	roleModerator appgo.Role = 301
+	roleSupport   appgo.Role = 302
+)
+
+type editInput struct {
+	UserId__ int64 `requireRole:"editor,moderator"`
+}
+
+type editApi struct {
+	META struct{} `path:"/edit"`
+}
+
+func (editApi) POST(in *editInput) (string, error) {
+	return "ok", nil
+}
+
+type badRoleInput struct {
+	UserId__ int64 `requireRole:"nobody"`
+}
+
+type badRoleApi struct {
+	META struct{} `path:"/bad"`
+}
+
+func (badRoleApi) POST(in *badRoleInput) (string, error) {
+	return "ok", nil
+}
+
+func withTestTokens() func() {
+	key, lifetime := appgo.Conf.RootKey, appgo.Conf.TokenLifetime
+	appgo.Conf.RootKey = "0123456789abcdef"
+	appgo.Conf.TokenLifetime.AppUser = 3600
+	appgo.Conf.TokenLifetime.WebUser = 3600
+	appgo.Conf.TokenLifetime.WebAdmin = 3600
+	appgo.Conf.TokenLifetime.Default = 3600
+	return func() {
+		appgo.Conf.RootKey = key
+		appgo.Conf.TokenLifetime = lifetime
+	}
+}
+
+func newTestToken(user appgo.Id) auth.Token {
+	return auth.NewToken(user, appgo.RoleAppUser)
+}
+
+func TestRequireRole(t *testing.T) {
+	defer withTestTokens()()
+	appgo.RegisterRole("editor", roleEditor)
+	appgo.RegisterRole("moderator", roleModerator)
+	appgo.RegisterRole("support", roleSupport)
+	h := newTestHandler(&editApi{})
+
+	for role, status := range map[appgo.Role]int{
+		roleEditor:    http.StatusOK,
+		roleModerator: http.StatusOK,
+		roleSupport:   http.StatusForbidden,
+	} {
+		r := httptest.NewRequest("POST", "/edit", nil)
+		r.Header.Set(appgo.CustomTokenHeaderName, string(auth.NewToken(42, role)))
+		w := serveTest(h, r)
+		assert.Equal(t, status, w.Code)
+	}
+
+	w := serveTest(h, httptest.NewRequest("POST", "/edit", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Panics(t, func() { newTestHandler(&badRoleApi{}) })
+}
+
+type publishInput struct {
+	UserId__ int64 `perm:"article:write, article:publish"`
+}
+
+type publishApi struct {
+	META struct{} `path:"/publish"`
+}
+
+func (publishApi) POST(in *publishInput) (string, error) {
+	return "ok", nil
+}
+
+type badPermApi struct {
+	META struct{} `path:"/bad"`
+}
+
+func (badPermApi) POST(in *struct {
+	UserId__ int64 `perm:"article:*"`
+}) (string, error) {
+	return "ok", nil
+}
+
+func TestPermissions(t *testing.T) {
+	defer withTestTokens()()
+	appgo.RegisterRole("editor", roleEditor)
+	appgo.RegisterRole("moderator", roleModerator)
+	appgo.RegisterRole("support", roleSupport)
+	c := appgo.Conf.Permissions
+	defer func() { appgo.Conf.Permissions = c }()
+	appgo.Conf.Permissions.Roles = append(appgo.Conf.Permissions.Roles, struct {
+		Role  string
+		Perms []string
+	}{"editor", []string{"article:write"}}, struct {
+		Role  string
+		Perms []string
+	}{"moderator", []string{"article:*"}})
+	h := newTestHandler(&publishApi{})
+	post := func(role appgo.Role) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/publish", nil)
+		r.Header.Set(appgo.CustomTokenHeaderName, string(auth.NewToken(42, role)))
+		return serveTest(h, r)
+	}
+
+	w := post(roleEditor)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), `"details":{"permission":"article:publish"}`)
+	assert.Equal(t, http.StatusOK, post(roleModerator).Code)
+	assert.Equal(t, http.StatusForbidden, post(roleSupport).Code)
+	assert.Equal(t, http.StatusOK, post(appgo.RoleWebAdmin).Code)
+
+	// Set at runtime, e.g. from a DB
+	appgo.SetRolePermissions(roleEditor, []string{"article:write", "article:publish"})
+	appgo.SetRolePermissions(appgo.RoleWebAdmin, []string{})
+	defer func() {
+		appgo.SetRolePermissions(roleEditor, nil)
+		appgo.SetRolePermissions(appgo.RoleWebAdmin, nil)
+	}()
+	assert.Equal(t, http.StatusOK, post(roleEditor).Code)
+	assert.Equal(t, http.StatusForbidden, post(appgo.RoleWebAdmin).Code)
+
+	assert.Panics(t, func() { newTestHandler(&badPermApi{}) })
+}
@@ -12,15 +12,35 @@ import (
 	"github.com/rs/cors"
 	"github.com/unrolled/render"
 	"html/template"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
+	"reflect"
 	"strings"
+	"sync"
 )
 
 type Server struct {
 	ts          TokenStore
 	middlewares []negroni.Handler
+	chain       []Middleware
 	ver         *versioning
+	// "path method" => name of the funcSet registered it
+	routes map[string]string
+	apis   []ApiInfo
+	// Path => handler of funcs added by RegisterJSON
+	typed map[string]*typedHandler
+	// Of serve, see Shutdown
+	mu         sync.Mutex
+	httpServer *http.Server
+	drained    chan struct{}
+	closing    bool
+	// Requests being served, see track
+	inflight int
+	idle     chan struct{}
+	// Closed once shutting down, for streams to end
+	drain chan struct{}
 	*mux.Router
 }
 
@@ -39,23 +59,37 @@ func NewServer(ts TokenStore, middlewares []negroni.Handler,
 		middlewares = append(middlewares, m)
 	}
 	return &Server{
-		ts,
-		middlewares,
-		newVersioning(),
-		mux.NewRouter(),
+		ts:          ts,
+		middlewares: middlewares,
+		ver:         newVersioning(),
+		routes:      make(map[string]string),
+		typed:       make(map[string]*typedHandler),
+		drain:       make(chan struct{}),
+		Router:      mux.NewRouter(),
 	}
 }
 
 func (s *Server) AddRest(path string, rests []interface{}) {
-	renderer := render.New(render.Options{
+	renderer := jsonRenderer()
+	for _, api := range rests {
+		h := newHandler(api, HandlerTypeJson, s.ts, renderer)
+		s.addRoutes(path+h.path, h.supports, api)
+		s.Handle(path+h.path, s.wrap(h)).Methods(h.routeMethods()...)
+		s.apis = append(s.apis, h.info(path+h.path))
+		if appgo.Conf.PathVersioning {
+			vpath := path + "/v{" + apiVersionVar + ":[0-9]+}" + h.path
+			s.addRoutes(vpath, h.supports, api)
+			s.Handle(vpath, s.wrap(h)).Methods(h.routeMethods()...)
+		}
+	}
+}
+
+func jsonRenderer() *render.Render {
+	return render.New(render.Options{
 		Directory:     "N/A",
 		IndentJSON:    appgo.Conf.DevMode,
 		IsDevelopment: appgo.Conf.DevMode,
 	})
-	for _, api := range rests {
-		h := newHandler(api, HandlerTypeJson, s.ts, renderer)
-		s.Handle(path+h.path, h).Methods(h.supports...)
-	}
 }
 
 func (s *Server) AddHtml(path, layout string, htmls []interface{}, funcs template.FuncMap) {
@@ -76,7 +110,67 @@ func (s *Server) AddHtml(path, layout string, htmls []interface{}, funcs templat
 	})
 	for _, api := range htmls {
 		h := newHandler(api, HandlerTypeHtml, s.ts, renderer)
-		s.Handle(path+h.path, h).Methods("GET")
+		s.addRoutes(path+h.path, []string{"GET"}, api)
+		s.Handle(path+h.path, s.wrap(h)).Methods("GET")
+		s.apis = append(s.apis, h.info(path+h.path))
+	}
+}
+
+// AddSSE adds APIs of Server-Sent Events, whose funcs are named SSE and
+// served for GET. An SSE func sends events with the appgo.EventSink in
+// Events__ and returns once done or Context__ is canceled, e.g.
+//
+//	func (progressApi) SSE(in *struct {
+//		Context__ context.Context
+//		Events__  appgo.EventSink
+//	}) error
+//
+// An error returned before any event is sent is replied as a JSON error,
+// afterwards it's sent as an "error" event. Idle streams get heartbeats
+// every Conf.Sse.Heartbeat seconds, and a reconnecting client may be
+// resumed from EventSink.LastEventId.
+func (s *Server) AddSSE(path string, apis []interface{}) {
+	for _, api := range apis {
+		h := newHandler(api, HandlerTypeSSE, s.ts, nil)
+		s.addRoutes(path+h.path, h.supports, api)
+		s.Handle(path+h.path, s.wrap(h)).Methods(h.routeMethods()...)
+		s.apis = append(s.apis, h.info(path+h.path))
+	}
+}
+
+// AddWebSocket adds WebSocket APIs, whose funcs are named WS and served
+// for GET. Inputs are decoded and authenticated as of other APIs before
+// the connection is upgraded, then the func talks to the client with the
+// appgo.Socket in Socket__ until it returns, e.g.
+//
+//	func (chatApi) WS(in *struct {
+//		UserId__     int64
+//		ResourceId__ int64
+//		Socket__     appgo.Socket
+//	}) error
+//
+// Errors before the upgrade are replied as JSON errors, see endSocket for
+// those afterwards.
+func (s *Server) AddWebSocket(path string, apis []interface{}) {
+	for _, api := range apis {
+		h := newHandler(api, HandlerTypeWebSocket, s.ts, nil)
+		s.addRoutes(path+h.path, h.supports, api)
+		s.Handle(path+h.path, s.wrap(h)).Methods(h.routeMethods()...)
+		s.apis = append(s.apis, h.info(path+h.path))
+	}
+}
+
+// addRoutes records path+method(+version) of a funcSet and panics on
+// duplicated registrations.
+func (s *Server) addRoutes(path string, methods []string, funcSet interface{}) {
+	name := reflect.TypeOf(funcSet).String()
+	for _, m := range methods {
+		key := path + " " + m
+		if prev, ok := s.routes[key]; ok {
+			log.Panicf("Duplicated route %s %s, registered by both %s and %s",
+				m, path, prev, name)
+		}
+		s.routes[key] = name
 	}
 }
 
@@ -119,7 +213,9 @@ func (s *Server) Serve() {
 		appgo.Conf.LogLevel, &log.TextFormatter{}, "appgo")
 	llog.Logger = log.StandardLogger()
 	n.Use(llog)
-	n.Use(cors.New(corsOptions()))
+	if !appgo.Conf.Cors.Builtin {
+		n.Use(cors.New(corsOptions()))
+	}
 	for _, mw := range s.middlewares {
 		n.Use(mw)
 	}
@@ -127,15 +223,62 @@ func (s *Server) Serve() {
 		n.Use(gzip.Gzip(gzip.BestSpeed))
 	}
 	n.UseHandler(s)
-	n.Run(appgo.Conf.Negroni.Port)
+	l, err := net.Listen("tcp", appgo.Conf.Negroni.Port)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Infoln("listening on", l.Addr())
+	if err := s.serve(l, n); err != nil {
+		log.Fatalln(err)
+	}
 }
 
 func GetUserFromToken(r *http.Request) appgo.Id {
-	token := auth.Token(r.Header.Get(appgo.CustomTokenHeaderName))
+	token := tokenFromRequest(r)
 	user, _ := token.Validate()
 	return user
 }
 
+// tokenFromRequest reads the token from the first of the token headers
+// present, and only if none is, from the cookie named
+// Conf.Auth.CookieName when set, unless r may be forged by another site.
+// A "Bearer " prefix is stripped.
+func tokenFromRequest(r *http.Request) auth.Token {
+	for _, name := range tokenHeaders() {
+		t := strings.TrimSpace(r.Header.Get(name))
+		if len(t) > 7 && strings.EqualFold(t[:7], "Bearer ") {
+			t = strings.TrimSpace(t[7:])
+		}
+		if t != "" {
+			return auth.Token(t)
+		}
+	}
+	if name := appgo.Conf.Auth.CookieName; name != "" {
+		if c, err := r.Cookie(name); err == nil {
+			if !csrfSafe(r) {
+				logEntry(r).WithField("path", r.URL.Path).Warnln(
+					"Cookie token of a cross-site request ignored")
+				return ""
+			}
+			// Browsers may have it URL-encoded
+			if v, err := url.PathUnescape(c.Value); err == nil {
+				return auth.Token(v)
+			}
+			return auth.Token(c.Value)
+		}
+	}
+	return ""
+}
+
+// tokenHeaders returns Conf.Auth.TokenHeaders, or CustomTokenHeaderName
+// if not set.
+func tokenHeaders() []string {
+	if headers := appgo.Conf.Auth.TokenHeaders; len(headers) > 0 {
+		return headers
+	}
+	return []string{appgo.CustomTokenHeaderName}
+}
+
 func corsOptions() cors.Options {
 	origins := strings.Split(appgo.Conf.Cors.AllowedOrigins, ",")
 	methods := strings.Split(appgo.Conf.Cors.AllowedMethods, ",")
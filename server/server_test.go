@@ -0,0 +1,512 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type dupApi struct {
+	META struct{} `path:"/dup"`
+}
+
+func (dupApi) GET(in *dupInput) (string, error) {
+	return "", nil
+}
+
+type dupInput struct{}
+
+type dupApi2 struct {
+	META struct{} `path:"/dup"`
+}
+
+func (dupApi2) GET(in *dupInput) (string, error) {
+	return "", nil
+}
+
+func (dupApi2) POST(in *dupInput) (string, error) {
+	return "", nil
+}
+
+func TestDuplicatedRoutes(t *testing.T) {
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&dupApi{}})
+	assert.Panics(t, func() {
+		s.AddRest("/api", []interface{}{&dupApi2{}})
+	})
+	assert.NotPanics(t, func() {
+		s.AddRest("/v2", []interface{}{&dupApi2{}})
+	})
+}
+
+type mwApi struct {
+	META struct{} `path:"/mw"`
+}
+
+func (mwApi) GET(in *dupInput) (string, error) {
+	return "ok", nil
+}
+
+func TestMiddlewares(t *testing.T) {
+	var order []string
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			order = append(order, "outer")
+			w.Header().Set("X-Stamp", "1")
+			next.ServeHTTP(w, r)
+		})
+	}, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			order = append(order, "inner")
+			if r.URL.Query().Get("deny") != "" {
+				http.Error(w, "denied", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	s.AddRest("/api", []interface{}{&mwApi{}})
+
+	w := serveTest(s, httptest.NewRequest("GET", "/api/mw", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("X-Stamp"))
+	assert.Equal(t, []string{"outer", "inner"}, order)
+
+	w = serveTest(s, httptest.NewRequest("GET", "/api/mw?deny=1", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "1", w.Header().Get("X-Stamp"))
+}
+
+type auditedApi struct {
+	META struct{} `path:"/audited" middleware:"audit"`
+}
+
+func (auditedApi) GET(in *dupInput) (string, error) {
+	return "ok", nil
+}
+
+type unknownMwApi struct {
+	META struct{} `path:"/unknown" middleware:"nothing"`
+}
+
+func (unknownMwApi) GET(in *dupInput) (string, error) {
+	return "ok", nil
+}
+
+func TestHandlerMiddlewares(t *testing.T) {
+	var order []string
+	stamp := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	RegisterMiddleware("audit", stamp("audit"))
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.Use(stamp("server"))
+	s.AddRest("/api", []interface{}{&auditedApi{}, &mwApi{}})
+
+	w := serveTest(s, httptest.NewRequest("GET", "/api/audited", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"server", "audit"}, order)
+	order = nil
+	serveTest(s, httptest.NewRequest("GET", "/api/mw", nil))
+	assert.Equal(t, []string{"server"}, order)
+
+	assert.Panics(t, func() { s.AddRest("/api", []interface{}{&unknownMwApi{}}) })
+}
+
+func TestPathVersioning(t *testing.T) {
+	appgo.Conf.PathVersioning = true
+	defer func() { appgo.Conf.PathVersioning = false }()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&versionedApi{}})
+
+	w := serveTest(s, httptest.NewRequest("GET", "/api/v2/versioned", nil))
+	assert.Equal(t, `"v2"`, w.Body.String())
+	r := httptest.NewRequest("GET", "/api/versioned", nil)
+	r.Header.Set(appgo.CustomVersionHeaderName, "2")
+	w = serveTest(s, r)
+	assert.Equal(t, `"v2"`, w.Body.String())
+
+	w = serveTest(s, httptest.NewRequest("GET", "/api/v1/versioned", nil))
+	assert.Equal(t, `"v1"`, w.Body.String())
+	w = serveTest(s, httptest.NewRequest("GET", "/api/versioned", nil))
+	assert.Equal(t, `"v1"`, w.Body.String())
+	w = serveTest(s, httptest.NewRequest("GET", "/api/v7/versioned", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+type docApi struct {
+	META struct{} `path:"/doc" errCodes:"40000, 40400"`
+}
+
+func (docApi) GET(in *dupInput) (string, error) {
+	return "", nil
+}
+
+type badDocApi struct {
+	META struct{} `path:"/doc" errCodes:"40001"`
+}
+
+func (badDocApi) GET(in *dupInput) (string, error) {
+	return "", nil
+}
+
+func TestIntrospection(t *testing.T) {
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&docApi{}})
+	s.AddIntrospection("/apis")
+	assert.Panics(t, func() {
+		s.AddRest("/bad", []interface{}{&badDocApi{}})
+	})
+
+	w := serveTest(s, httptest.NewRequest("GET", "/apis", nil))
+	var apis []ApiInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &apis))
+	assert.Len(t, apis, 1)
+	assert.Equal(t, "/api/doc", apis[0].Path)
+	assert.Equal(t, []string{"GET"}, apis[0].Methods)
+	assert.Len(t, apis[0].Errors, 2)
+	e := apis[0].Errors[1]
+	assert.Equal(t, appgo.ErrCode(appgo.ECodeNotFound), e.Code)
+	assert.Equal(t, http.StatusNotFound, e.Status)
+	assert.Equal(t, "Not Found", e.Example.Msg)
+}
+
+type meInput struct {
+	UserId__ int64
+}
+
+type meApi struct {
+	META struct{} `path:"/me"`
+}
+
+func (meApi) GET(in *meInput) (appgo.Id, error) {
+	return appgo.Id(in.UserId__), nil
+}
+
+func (meApi) POST(in *meInput) (appgo.Id, error) {
+	return appgo.Id(in.UserId__), nil
+}
+
+func TestCookieAuth(t *testing.T) {
+	defer withTestTokens()()
+	appgo.Conf.Auth.CookieName = "token"
+	defer func() { appgo.Conf.Auth.CookieName = "" }()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&meApi{}})
+	token := string(auth.NewToken(42, appgo.RoleAppUser))
+
+	r := httptest.NewRequest("GET", "/api/me", nil)
+	r.AddCookie(&http.Cookie{Name: "token", Value: url.QueryEscape(token)})
+	w := serveTest(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"42"`, w.Body.String())
+
+	r = httptest.NewRequest("GET", "/api/me", nil)
+	r.AddCookie(&http.Cookie{Name: "other", Value: token})
+	w = serveTest(s, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestCookieCsrf(t *testing.T) {
+	defer withTestTokens()()
+	defer withCors()()
+	appgo.Conf.Cors.AllowCredentials = true
+	appgo.Conf.Auth.CookieName = "token"
+	defer func() { appgo.Conf.Auth.CookieName = "" }()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&meApi{}})
+	token := string(auth.NewToken(42, appgo.RoleAppUser))
+	post := func(header, value string) int {
+		// As a cross-site form would post it
+		r := httptest.NewRequest("POST", "/api/me", strings.NewReader("a=1"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: "token", Value: token})
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		return serveTest(s, r).Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post("", ""))
+	assert.Equal(t, http.StatusUnauthorized, post("Origin", "https://evil.com"))
+	assert.Equal(t, http.StatusUnauthorized, post("Origin", "null"))
+	assert.Equal(t, http.StatusUnauthorized, post("Referer", "https://evil.com/form"))
+	assert.Equal(t, http.StatusOK, post("Origin", "https://example.com"))
+	assert.Equal(t, http.StatusOK, post("Referer", "https://example.com/form"))
+	assert.Equal(t, http.StatusOK, post("Origin", "https://app.example.com"))
+	assert.Equal(t, http.StatusOK, post(CsrfHeaderName, "XMLHttpRequest"))
+
+	// Not sent by browsers on their own
+	r := httptest.NewRequest("POST", "/api/me", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	r.Header.Set(appgo.CustomTokenHeaderName, token)
+	assert.Equal(t, http.StatusOK, serveTest(s, r).Code)
+}
+
+func TestTokenHeaders(t *testing.T) {
+	defer withTestTokens()()
+	appgo.Conf.Auth.TokenHeaders = []string{"X-Legacy-Token", appgo.CustomTokenHeaderName, "Authorization"}
+	defer func() { appgo.Conf.Auth.TokenHeaders = nil }()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&meApi{}})
+	token := string(auth.NewToken(42, appgo.RoleAppUser))
+	get := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/me", nil)
+		r.Header.Set(header, value)
+		return serveTest(s, r)
+	}
+
+	for _, hv := range [][2]string{
+		{"X-Legacy-Token", token},
+		{appgo.CustomTokenHeaderName, token},
+		{"Authorization", "Bearer " + token},
+		{"Authorization", "bearer " + token},
+	} {
+		w := get(hv[0], hv[1])
+		assert.Equal(t, http.StatusOK, w.Code, hv[0])
+		assert.Equal(t, `"42"`, w.Body.String(), hv[0])
+	}
+	assert.Equal(t, http.StatusUnauthorized, get("X-Other-Token", token).Code)
+
+	// The first header present is used
+	r := httptest.NewRequest("GET", "/api/me", nil)
+	r.Header.Set("X-Legacy-Token", "bad")
+	r.Header.Set("Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusUnauthorized, serveTest(s, r).Code)
+}
+
+type reqIdInput struct {
+	Fail        bool
+	Context__   context.Context
+	RequestId__ string
+}
+
+type reqIdApi struct {
+	META struct{} `path:"/reqid"`
+}
+
+func (reqIdApi) GET(in *reqIdInput) (string, error) {
+	if in.Fail {
+		return "", appgo.NotFoundErr
+	}
+	if in.RequestId__ != appgo.RequestIDFromContext(in.Context__) {
+		return "", appgo.NewApiErr(appgo.ECodeInternal, "ids differ")
+	}
+	return in.RequestId__, nil
+}
+
+func TestRequestID(t *testing.T) {
+	s := NewServer(testTokenStore{}, nil, nil)
+	var seen string
+	s.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = appgo.RequestIDFromContext(r.Context())
+			next.ServeHTTP(w, r)
+		})
+	})
+	s.AddRest("/api", []interface{}{&reqIdApi{}})
+
+	r := httptest.NewRequest("GET", "/api/reqid", nil)
+	r.Header.Set("X-Request-ID", "abc-123")
+	w := serveTest(s, r)
+	assert.Equal(t, "abc-123", w.Header().Get("X-Request-ID"))
+	assert.Equal(t, `"abc-123"`, w.Body.String())
+	assert.Equal(t, "abc-123", seen)
+
+	w = serveTest(s, httptest.NewRequest("GET", "/api/reqid", nil))
+	id := w.Header().Get("X-Request-ID")
+	assert.NotEmpty(t, id)
+	assert.Equal(t, `"`+id+`"`, w.Body.String())
+
+	// Ids unsafe to log are replaced
+	r = httptest.NewRequest("GET", "/api/reqid", nil)
+	r.Header.Set("X-Request-ID", "abc\nlevel=error")
+	w = serveTest(s, r)
+	assert.NotEqual(t, "abc\nlevel=error", w.Header().Get("X-Request-ID"))
+
+	// Replied in errors, shared errors are left as is
+	r = httptest.NewRequest("GET", "/api/reqid?Fail=true", nil)
+	r.Header.Set("X-Request-ID", "abc-456")
+	w = serveTest(s, r)
+	assert.Contains(t, w.Body.String(), `"request_id":"abc-456"`)
+	assert.Empty(t, appgo.NotFoundErr.RequestId)
+
+	out := httptest.NewRequest("GET", "http://downstream/", nil)
+	ForwardRequestID(appgo.WithRequestID(context.Background(), "abc-789"), out)
+	assert.Equal(t, "abc-789", out.Header.Get("X-Request-ID"))
+}
+
+type logInput struct {
+	UserId__ appgo.Id
+	Log__    *log.Entry
+}
+
+type logApi struct {
+	META struct{} `path:"/log/{id}"`
+}
+
+// Of the last call of logApi
+var lastLogEntry *log.Entry
+
+func (logApi) POST(in *logInput) (string, error) {
+	lastLogEntry = in.Log__
+	return "ok", nil
+}
+
+func TestLogEntry(t *testing.T) {
+	defer withTestTokens()()
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&logApi{}})
+
+	r := httptest.NewRequest("POST", "/api/log/7", nil)
+	r.Header.Set("X-Request-ID", "abc-123")
+	r.Header.Set(appgo.CustomTokenHeaderName, string(newTestToken(42)))
+	w := serveTest(s, r)
+	if !assert.Equal(t, http.StatusOK, w.Code) || !assert.NotNil(t, lastLogEntry) {
+		return
+	}
+	assert.Equal(t, "abc-123", lastLogEntry.Data["request_id"])
+	assert.Equal(t, "/api/log/{id}", lastLogEntry.Data["route"])
+	assert.Equal(t, "POST", lastLogEntry.Data["method"])
+	assert.Equal(t, appgo.Id(42), lastLogEntry.Data["user"])
+
+	assert.Panics(t, func() {
+		newTestHandler(&struct {
+			META struct{} `path:"/badlog"`
+			badLogApi
+		}{})
+	})
+}
+
+type badLogApi struct{}
+
+func (badLogApi) GET(in *struct{ Log__ log.Entry }) (string, error) {
+	return "", nil
+}
+
+func TestAutoMethods(t *testing.T) {
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&dupApi2{}, &versionedApi{}})
+
+	w := serveTest(s, httptest.NewRequest("OPTIONS", "/api/dup", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "GET, POST, HEAD, OPTIONS", w.Header().Get("Allow"))
+	w = serveTest(s, httptest.NewRequest("OPTIONS", "/api/versioned", nil))
+	assert.Equal(t, "GET, HEAD, OPTIONS", w.Header().Get("Allow"))
+
+	get := serveTest(s, httptest.NewRequest("GET", "/api/versioned", nil))
+	w = serveTest(s, httptest.NewRequest("HEAD", "/api/versioned", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, get.Header().Get("Content-Type"), w.Header().Get("Content-Type"))
+	assert.Equal(t, strconv.Itoa(get.Body.Len()), w.Header().Get("Content-Length"))
+
+	appgo.Conf.DisableAutoMethods = true
+	defer func() { appgo.Conf.DisableAutoMethods = false }()
+	s = NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&dupApi2{}})
+	w = serveTest(s, httptest.NewRequest("OPTIONS", "/api/dup", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+type headersInput struct {
+	Headers__ http.Header
+}
+
+type explicitApi struct {
+	META struct{} `path:"/explicit"`
+}
+
+func (explicitApi) GET(in *headersInput) (string, error) {
+	return "full", nil
+}
+
+func (explicitApi) HEAD(in *headersInput) error {
+	in.Headers__.Set("X-Cheap", "1")
+	return nil
+}
+
+func (explicitApi) OPTIONS(in *headersInput) (string, error) {
+	in.Headers__.Set("Allow", "GET, HEAD, OPTIONS")
+	return "custom", nil
+}
+
+func (explicitApi) OPTIONS2(in *headersInput) (string, error) {
+	return "custom v2", nil
+}
+
+func TestExplicitHeadOptions(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		appgo.Conf.DisableAutoMethods = disabled
+		s := NewServer(testTokenStore{}, nil, nil)
+		s.AddRest("/api", []interface{}{&explicitApi{}})
+		w := serveTest(s, httptest.NewRequest("HEAD", "/api/explicit", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "1", w.Header().Get("X-Cheap"))
+		w = serveTest(s, httptest.NewRequest("OPTIONS", "/api/explicit", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, `"custom"`, w.Body.String())
+		assert.Equal(t, "GET, HEAD, OPTIONS", w.Header().Get("Allow"))
+		r := httptest.NewRequest("OPTIONS", "/api/explicit", nil)
+		r.Header.Set(appgo.CustomVersionHeaderName, "2")
+		w = serveTest(s, r)
+		assert.Equal(t, `"custom v2"`, w.Body.String())
+	}
+	appgo.Conf.DisableAutoMethods = false
+}
+
+type patchInput struct {
+	ResourceId__ appgo.Id
+	Content__    *struct {
+		Name *string
+	}
+}
+
+type patchApi struct {
+	META struct{} `path:"/items/{id}"`
+}
+
+func (patchApi) GET(in *patchInput) (string, error) {
+	return "", nil
+}
+
+func (patchApi) PATCH(in *patchInput) (string, error) {
+	return in.ResourceId__.String() + ":" + *in.Content__.Name, nil
+}
+
+func (patchApi) PATCH2(in *patchInput) (string, error) {
+	return "v2:" + *in.Content__.Name, nil
+}
+
+func TestPatch(t *testing.T) {
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&patchApi{}})
+
+	r := httptest.NewRequest("PATCH", "/api/items/7", strings.NewReader(`{"Name":"new"}`))
+	w := serveTest(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"7:new"`, w.Body.String())
+
+	r = httptest.NewRequest("PATCH", "/api/items/7", strings.NewReader(`{"Name":"new"}`))
+	r.Header.Set(appgo.CustomVersionHeaderName, "2")
+	w = serveTest(s, r)
+	assert.Equal(t, `"v2:new"`, w.Body.String())
+
+	w = serveTest(s, httptest.NewRequest("OPTIONS", "/api/items/7", nil))
+	assert.Equal(t, "GET, PATCH, HEAD, OPTIONS", w.Header().Get("Allow"))
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"crypto/subtle"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"strings"
+)
+
+const defaultServiceTokenHeader = "X-Service-Token"
+
+// ServiceTokenVerifier tells if token is a valid credential of an
+// internal service.
+type ServiceTokenVerifier func(r *http.Request, token string) bool
+
+var serviceTokenVerifier ServiceTokenVerifier
+
+// SetServiceTokenVerifier sets the verifier of service tokens, which is
+// used rather than Conf.ServiceAuth.Secrets.
+func SetServiceTokenVerifier(v ServiceTokenVerifier) {
+	serviceTokenVerifier = v
+}
+
+func serviceTokenHeader() string {
+	if name := appgo.Conf.ServiceAuth.Header; name != "" {
+		return name
+	}
+	return defaultServiceTokenHeader
+}
+
+// authService authenticates requests with a valid service token as the
+// service user of RoleService, it returns 0 for the others.
+func authService(r *http.Request) (appgo.Id, appgo.Role) {
+	c := &appgo.Conf.ServiceAuth
+	if serviceTokenVerifier == nil && len(c.Secrets) == 0 {
+		return 0, 0
+	}
+	token := strings.TrimSpace(r.Header.Get(serviceTokenHeader()))
+	if token == "" || !validServiceToken(r, token) {
+		return 0, 0
+	}
+	user := appgo.Id(c.UserId)
+	if user == 0 {
+		user = appgo.ServiceUserId
+	}
+	return user, appgo.RoleService
+}
+
+func validServiceToken(r *http.Request, token string) bool {
+	if serviceTokenVerifier != nil {
+		return serviceTokenVerifier(r, token)
+	}
+	valid := false
+	for _, secret := range appgo.Conf.ServiceAuth.Secrets {
+		if secret != "" &&
+			subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
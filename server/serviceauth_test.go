@@ -0,0 +1,65 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type syncInput struct {
+	UserId__ int64 `requireRole:"service"`
+}
+
+type syncApi struct {
+	META struct{} `path:"/sync"`
+}
+
+func (syncApi) POST(in *syncInput) (appgo.Id, error) {
+	return appgo.Id(in.UserId__), nil
+}
+
+func TestServiceAuth(t *testing.T) {
+	defer withTestTokens()()
+	appgo.Conf.ServiceAuth.Secrets = []string{"s3cret"}
+	defer func() { appgo.Conf.ServiceAuth.Secrets = nil }()
+	post := func(h http.Handler, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/sync", nil)
+		if token != "" {
+			r.Header.Set("X-Service-Token", token)
+		}
+		return serveTest(h, r)
+	}
+	h := newTestHandler(&syncApi{})
+	w := post(h, "s3cret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"8888"`, w.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, post(h, "guess").Code)
+	assert.Equal(t, http.StatusUnauthorized, post(h, "").Code)
+
+	// Users don't pass for services
+	r := httptest.NewRequest("POST", "/sync", nil)
+	r.Header.Set(appgo.CustomTokenHeaderName, string(newTestToken(42)))
+	assert.Equal(t, http.StatusForbidden, serveTest(h, r).Code)
+
+	// Nor services for users of other roles
+	appgo.RegisterRole("editor", roleEditor)
+	appgo.RegisterRole("moderator", roleModerator)
+	r = httptest.NewRequest("POST", "/edit", nil)
+	r.Header.Set("X-Service-Token", "s3cret")
+	assert.Equal(t, http.StatusForbidden, serveTest(newTestHandler(&editApi{}), r).Code)
+
+	appgo.Conf.ServiceAuth.UserId = 1000
+	SetServiceTokenVerifier(func(r *http.Request, token string) bool {
+		return token == "verified"
+	})
+	defer func() {
+		appgo.Conf.ServiceAuth.UserId = 0
+		SetServiceTokenVerifier(nil)
+	}()
+	assert.Equal(t, http.StatusUnauthorized, post(h, "s3cret").Code)
+	w = post(h, "verified")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"1000"`, w.Body.String())
+}
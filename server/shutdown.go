@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// serve serves handler on l until Shutdown, which it waits for to finish
+// draining in-flight requests.
+func (s *Server) serve(l net.Listener, handler http.Handler) error {
+	srv := newHTTPServer(handler)
+	drained := make(chan struct{})
+	s.mu.Lock()
+	s.httpServer = srv
+	s.drained = drained
+	s.mu.Unlock()
+	if !appgo.Conf.Shutdown.DisableSignals {
+		stop := s.shutdownOnSignal()
+		defer stop()
+	}
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	<-drained
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests
+// to finish, until ctx is done. SSE streams are canceled and WebSockets
+// closed with 1001 (going away), for the clients to reconnect elsewhere.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv, drained := s.httpServer, s.drained
+	s.httpServer = nil
+	if !s.closing {
+		s.closing = true
+		close(s.drain)
+	}
+	s.mu.Unlock()
+	if srv != nil {
+		defer close(drained)
+		if err := srv.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	// Hijacked connections are not waited for by srv
+	return s.waitIdle(ctx)
+}
+
+// track counts the requests being served for waitIdle, and lets them
+// know of the shutdown by drainOf.
+func (s *Server) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.inflight++
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			if s.inflight--; s.inflight == 0 && s.idle != nil {
+				close(s.idle)
+				s.idle = nil
+			}
+			s.mu.Unlock()
+		}()
+		ctx := context.WithValue(r.Context(), drainKey{}, s.drain)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// waitIdle waits for the requests being served to finish.
+func (s *Server) waitIdle(ctx context.Context) error {
+	s.mu.Lock()
+	if s.inflight == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.idle == nil {
+		s.idle = make(chan struct{})
+	}
+	idle := s.idle
+	s.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type drainKey struct{}
+
+// drainOf returns the channel closed once the server of r is shutting
+// down, nil if r isn't served by a Server.
+func drainOf(r *http.Request) <-chan struct{} {
+	drain, _ := r.Context().Value(drainKey{}).(chan struct{})
+	return drain
+}
+
+// cancelOnDrain cancels the context of r once the server is shutting
+// down, for long streams to end rather than holding up the shutdown.
+func cancelOnDrain(r *http.Request) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	if drain := drainOf(r); drain != nil {
+		go func() {
+			select {
+			case <-drain:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return r.WithContext(ctx), cancel
+}
+
+// shuttingDown tells if Shutdown has been called, readiness probes fail
+// since then.
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// shutdownOnSignal shuts s down on SIGTERM or SIGINT, waiting for at most
+// Conf.Shutdown.Timeout seconds. The returned func stops it.
+func (s *Server) shutdownOnSignal() (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.WithField("signal", sig).Infoln("Shutting down")
+			timeout := defaultShutdownTimeout
+			if t := appgo.Conf.Shutdown.Timeout; t > 0 {
+				timeout = time.Duration(t) * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := s.Shutdown(ctx); err != nil {
+				log.WithField("error", err).Errorln("Error shutting down")
+			}
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
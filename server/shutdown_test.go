@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var drainStarted, drainRelease chan struct{}
+
+type drainApi struct {
+	META struct{} `path:"/drain"`
+}
+
+func (drainApi) GET(in *appgo.DummyInput) (string, error) {
+	close(drainStarted)
+	<-drainRelease
+	return "done", nil
+}
+
+func TestShutdown(t *testing.T) {
+	appgo.Conf.Shutdown.DisableSignals = true
+	defer func() { appgo.Conf.Shutdown.DisableSignals = false }()
+	var entries []AccessLogEntry
+	SetAccessLogger(func(e AccessLogEntry) { entries = append(entries, e) })
+	defer SetAccessLogger(nil)
+	drainStarted, drainRelease = make(chan struct{}), make(chan struct{})
+
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&drainApi{}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	served := make(chan error, 1)
+	go func() { served <- s.serve(l, s) }()
+
+	replied := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/api/drain")
+		if err != nil {
+			replied <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		replied <- string(body)
+	}()
+	<-drainStarted
+
+	shut := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shut <- s.Shutdown(ctx)
+	}()
+	refused := false
+	for i := 0; i < 100 && !refused; i++ {
+		if conn, err := net.Dial("tcp", addr); err != nil {
+			refused = true
+		} else {
+			conn.Close()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	assert.True(t, refused, "new connections are refused")
+	select {
+	case <-served:
+		t.Fatal("served before draining")
+	default:
+	}
+
+	close(drainRelease)
+	assert.Equal(t, `"done"`, <-replied)
+	assert.NoError(t, <-shut)
+	assert.NoError(t, <-served)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, http.StatusOK, entries[0].Status)
+	}
+}
+
+func TestShutdownStreams(t *testing.T) {
+	defer withTestTokens()()
+	progressDone = make(chan error, 1)
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddSSE("/api", []interface{}{&progressApi{}})
+	s.AddWebSocket("/api", []interface{}{&echoApi{}})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/progress")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	header := http.Header{}
+	header.Set(appgo.CustomTokenHeaderName, string(newTestToken(42)))
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/rooms/7/echo"
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	assert.Equal(t, context.Canceled, <-progressDone)
+	_, _, err = conn.ReadMessage()
+	if ce, ok := err.(*websocket.CloseError); assert.True(t, ok) {
+		assert.Equal(t, websocket.CloseGoingAway, ce.Code)
+	}
+}
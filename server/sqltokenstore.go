@@ -0,0 +1,217 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const defaultTokenTable = "appgo_tokens"
+
+var (
+	validSessionId = regexp.MustCompile(`^[0-9a-f]{16}$`)
+	validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Last seen times are only updated once this old, to not write the table
+// on every request.
+const sqlSeenInterval = time.Minute
+
+// SQLTokenStore keeps tokens in a table of db, see CreateTable. Queries
+// use "?" placeholders, as of MySQL and SQLite.
+type SQLTokenStore struct {
+	db    *sql.DB
+	table string
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewSQLTokenStore(db *sql.DB, table string, ttl time.Duration) *SQLTokenStore {
+	if table == "" {
+		table = defaultTokenTable
+	}
+	if !validTableName.MatchString(table) {
+		panic("Bad token table name: " + table)
+	}
+	return &SQLTokenStore{db: db, table: table, ttl: ttl, now: time.Now}
+}
+
+// CreateTable creates the table if not existing.
+func (s *SQLTokenStore) CreateTable() error {
+	_, err := s.db.Exec(s.query(`CREATE TABLE IF NOT EXISTS %s (
+		token_hash CHAR(64) NOT NULL PRIMARY KEY,
+		user_id BIGINT NOT NULL,
+		device VARCHAR(255) NOT NULL,
+		issued_at BIGINT NOT NULL,
+		seen_at BIGINT NOT NULL
+	)`))
+	if err != nil {
+		return err
+	}
+	// Fails if created already, IF NOT EXISTS of indexes is not portable
+	s.db.Exec(s.query(`CREATE INDEX %[1]s_user ON %[1]s (user_id)`))
+	return nil
+}
+
+func (s *SQLTokenStore) query(q string) string {
+	return fmt.Sprintf(q, s.table)
+}
+
+// expiry returns the oldest issuing time of tokens still valid.
+func (s *SQLTokenStore) expiry() int64 {
+	return s.now().Add(-s.ttl).UnixNano()
+}
+
+func (s *SQLTokenStore) IssueForDevice(user appgo.Id, role appgo.Role,
+	device string) (auth.Token, error) {
+	s.sweep()
+	token := auth.NewToken(user, role)
+	if err := s.insert(s.db, token, user, device); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *SQLTokenStore) insert(db execer, token auth.Token, user appgo.Id, device string) error {
+	now := s.now().UnixNano()
+	_, err := db.Exec(s.query(`INSERT INTO %s
+		(token_hash, user_id, device, issued_at, seen_at) VALUES (?, ?, ?, ?, ?)`),
+		tokenHash(token), int64(user), device, now, now)
+	return err
+}
+
+func (s *SQLTokenStore) Validate(token auth.Token) bool {
+	hash := tokenHash(token)
+	var seen int64
+	err := s.db.QueryRow(s.query(`SELECT seen_at FROM %s
+		WHERE token_hash = ? AND issued_at > ?`), hash, s.expiry()).Scan(&seen)
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		log.WithField("error", err).Errorln("Failed to validate token")
+		return false
+	}
+	if now := s.now(); now.Sub(time.Unix(0, seen)) >= sqlSeenInterval {
+		s.db.Exec(s.query(`UPDATE %s SET seen_at = ? WHERE token_hash = ?`),
+			now.UnixNano(), hash)
+	}
+	return true
+}
+
+func (s *SQLTokenStore) Refresh(old auth.Token) (auth.Token, error) {
+	user, role := old.Validate()
+	if user == 0 {
+		return "", appgo.UnauthorizedErr
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	hash := tokenHash(old)
+	var device string
+	err = tx.QueryRow(s.query(`SELECT device FROM %s
+		WHERE token_hash = ? AND issued_at > ?`), hash, s.expiry()).Scan(&device)
+	if err == sql.ErrNoRows {
+		return "", appgo.UnauthorizedErr
+	} else if err != nil {
+		return "", err
+	}
+	// Only one of concurrent refreshes deletes it
+	res, err := tx.Exec(s.query(`DELETE FROM %s WHERE token_hash = ?`), hash)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		return "", appgo.UnauthorizedErr
+	}
+	token := auth.NewToken(user, role)
+	if err := s.insert(tx, token, user, device); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *SQLTokenStore) Revoke(token auth.Token) error {
+	_, err := s.db.Exec(s.query(`DELETE FROM %s WHERE token_hash = ?`), tokenHash(token))
+	return err
+}
+
+func (s *SQLTokenStore) RevokeAllForUser(user appgo.Id) error {
+	_, err := s.db.Exec(s.query(`DELETE FROM %s WHERE user_id = ?`), int64(user))
+	return err
+}
+
+func (s *SQLTokenStore) Sessions(user appgo.Id) ([]*Session, error) {
+	rows, err := s.db.Query(s.query(`SELECT token_hash, device, issued_at, seen_at
+		FROM %s WHERE user_id = ? AND issued_at > ? ORDER BY issued_at`),
+		int64(user), s.expiry())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []*Session
+	for rows.Next() {
+		var hash, device string
+		var at, seen int64
+		if err := rows.Scan(&hash, &device, &at, &seen); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &Session{
+			Id:       hash[:16],
+			Device:   device,
+			IssuedAt: time.Unix(0, at),
+			LastSeen: time.Unix(0, seen),
+		})
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLTokenStore) RevokeSession(user appgo.Id, id string) error {
+	if !validSessionId.MatchString(id) {
+		return appgo.NotFoundErr
+	}
+	res, err := s.db.Exec(s.query(`DELETE FROM %s WHERE user_id = ? AND token_hash LIKE ?`),
+		int64(user), id+"%")
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return appgo.NotFoundErr
+	}
+	return nil
+}
+
+// sweep deletes expired tokens, at most once per ttl.
+func (s *SQLTokenStore) sweep() {
+	s.mu.Lock()
+	now := s.now()
+	if now.Sub(s.lastSweep) < s.ttl {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.mu.Unlock()
+	if _, err := s.db.Exec(s.query(`DELETE FROM %s WHERE issued_at <= ?`), s.expiry()); err != nil {
+		log.WithField("error", err).Errorln("Failed to sweep tokens")
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSQLTokenStore(t *testing.T) {
+	defer withTestTokens()()
+	db, mock, err := sqlmock.New()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	now := time.Now()
+	s := NewSQLTokenStore(db, "", time.Hour)
+	s.now = func() time.Time { return now }
+	expiry := now.Add(-time.Hour).UnixNano()
+
+	mock.ExpectExec("DELETE FROM appgo_tokens WHERE issued_at <= ?").
+		WithArgs(expiry).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO appgo_tokens").
+		WithArgs(sqlmock.AnyArg(), int64(42), "phone", now.UnixNano(), now.UnixNano()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	token, err := s.IssueForDevice(42, appgo.RoleAppUser, "phone")
+	assert.NoError(t, err)
+	hash := tokenHash(token)
+
+	// Seen a while ago
+	mock.ExpectQuery("SELECT seen_at FROM appgo_tokens").WithArgs(hash, expiry).
+		WillReturnRows(sqlmock.NewRows([]string{"seen_at"}).AddRow(now.Add(-time.Hour).UnixNano()))
+	mock.ExpectExec("UPDATE appgo_tokens SET seen_at").WithArgs(now.UnixNano(), hash).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.True(t, s.Validate(token))
+	// Just seen
+	mock.ExpectQuery("SELECT seen_at FROM appgo_tokens").WithArgs(hash, expiry).
+		WillReturnRows(sqlmock.NewRows([]string{"seen_at"}).AddRow(now.UnixNano()))
+	assert.True(t, s.Validate(token))
+	mock.ExpectQuery("SELECT seen_at FROM appgo_tokens").WithArgs(hash, expiry).
+		WillReturnRows(sqlmock.NewRows([]string{"seen_at"}))
+	assert.False(t, s.Validate(token))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT device FROM appgo_tokens").WithArgs(hash, expiry).
+		WillReturnRows(sqlmock.NewRows([]string{"device"}).AddRow("phone"))
+	mock.ExpectExec("DELETE FROM appgo_tokens WHERE token_hash = ?").WithArgs(hash).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO appgo_tokens").
+		WithArgs(sqlmock.AnyArg(), int64(42), "phone", now.UnixNano(), now.UnixNano()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	_, err = s.Refresh(token)
+	assert.NoError(t, err)
+
+	mock.ExpectQuery("SELECT token_hash, device, issued_at, seen_at").WithArgs(int64(42), expiry).
+		WillReturnRows(sqlmock.NewRows([]string{"token_hash", "device", "issued_at", "seen_at"}).
+			AddRow(hash, "phone", now.UnixNano(), now.UnixNano()))
+	sessions, err := s.Sessions(42)
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, sessionId(token), sessions[0].Id)
+		assert.Equal(t, "phone", sessions[0].Device)
+	}
+
+	mock.ExpectExec("DELETE FROM appgo_tokens WHERE user_id = \\? AND token_hash LIKE \\?").
+		WithArgs(int64(42), hash[:16]+"%").WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.Equal(t, appgo.NotFoundErr, s.RevokeSession(42, hash[:16]))
+	// Not a pattern
+	assert.Equal(t, appgo.NotFoundErr, s.RevokeSession(42, "%"))
+
+	mock.ExpectExec("DELETE FROM appgo_tokens WHERE user_id = ?").WithArgs(int64(42)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	assert.NoError(t, s.RevokeAllForUser(42))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Panics(t, func() { NewSQLTokenStore(db, "tokens; DROP TABLE users", time.Hour) })
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultHeartbeat = 15
+
+var (
+	errStreamClosed = errors.New("event stream closed")
+	// Replaced in tests
+	heartbeatUnit = time.Second
+)
+
+// eventSink writes events to the reply, the headers are written along
+// with the first event or heartbeat.
+type eventSink struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	mu      sync.Mutex
+	started bool
+	closed  bool
+	// Written since the last heartbeat
+	busy  bool
+	quiet bool
+	done  chan struct{}
+}
+
+func newEventSink(w http.ResponseWriter, r *http.Request) *eventSink {
+	s := &eventSink{w: w, r: r, done: make(chan struct{})}
+	beat := appgo.Conf.Sse.Heartbeat
+	if beat == 0 {
+		beat = defaultHeartbeat
+	}
+	if beat > 0 {
+		go s.heartbeat(time.Duration(beat) * heartbeatUnit)
+	}
+	return s
+}
+
+func (s *eventSink) Send(event string, data interface{}) error {
+	return s.SendId("", event, data)
+}
+
+func (s *eventSink) SendId(id, event string, data interface{}) error {
+	if strings.ContainsAny(id+event, "\r\n") {
+		return errors.New("bad event id or name")
+	}
+	payload, ok := data.(string)
+	if !ok {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		payload = string(b)
+	}
+	var buf bytes.Buffer
+	if id != "" {
+		buf.WriteString("id: " + id + "\n")
+	}
+	if event != "" {
+		buf.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(payload, "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	buf.WriteString("\n")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(buf.Bytes())
+}
+
+func (s *eventSink) LastEventId() string {
+	return s.r.Header.Get("Last-Event-ID")
+}
+
+// write writes and flushes an event, s.mu must be held.
+func (s *eventSink) write(p []byte) error {
+	if s.closed {
+		return errStreamClosed
+	}
+	if err := s.r.Context().Err(); err != nil {
+		return err
+	}
+	s.start()
+	s.busy = true
+	if _, err := s.w.Write(p); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (s *eventSink) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	// Against buffering of nginx
+	s.w.Header().Set("X-Accel-Buffering", "no")
+	s.w.WriteHeader(http.StatusOK)
+	if appgo.Conf.Prometheus.Enable {
+		metrics_sse_conns.With("route", routeOf(s.r)).Add(1)
+	}
+}
+
+// heartbeat sends a comment every d the stream is idle, against proxies
+// closing quiet connections.
+func (s *eventSink) heartbeat(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.r.Context().Done():
+			return
+		case <-t.C:
+			s.mu.Lock()
+			if !s.quiet && !s.busy {
+				s.write([]byte(": ping\n\n"))
+			}
+			s.busy = false
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *eventSink) stopHeartbeat() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.quiet {
+		s.quiet = true
+		close(s.done)
+	}
+}
+
+// close ends the stream, events sent afterwards by a func running late
+// fail.
+func (s *eventSink) close() {
+	s.stopHeartbeat()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.started && appgo.Conf.Prometheus.Enable {
+		metrics_sse_conns.With("route", routeOf(s.r)).Add(-1)
+	}
+}
+
+// endEvents ends the stream once the SSE func has returned. An error
+// returned before any event or heartbeat is sent is replied as usual,
+// afterwards it's sent as an "error" event.
+func (h *handler) endEvents(w http.ResponseWriter, r *http.Request, sink *eventSink,
+	returns []reflect.Value) {
+	var aerr *appgo.ApiError
+	if err := returns[0]; !err.IsNil() {
+		var ok bool
+		if aerr, ok = err.Interface().(*appgo.ApiError); !ok {
+			aerr = appgo.NewApiErr(appgo.ECodeInternal, "Bad api-func format")
+		}
+	}
+	sink.stopHeartbeat()
+	sink.mu.Lock()
+	started := sink.started
+	sink.mu.Unlock()
+	if !started && aerr != nil {
+		h.writeError(w, r, aerr)
+	} else if aerr != nil {
+		setErrCode(w, aerr.Code)
+		sink.Send("error", aerr)
+	} else {
+		sink.mu.Lock()
+		sink.start()
+		sink.mu.Unlock()
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type progressInput struct {
+	Steps     int
+	Context__ context.Context
+	Events__  appgo.EventSink
+}
+
+var progressDone chan error
+
+type progressApi struct {
+	META struct{} `path:"/progress"`
+}
+
+func (progressApi) SSE(in *progressInput) error {
+	if in.Steps < 0 {
+		return appgo.NewApiErr(appgo.ECodeBadRequest, "bad steps")
+	}
+	for i := 1; in.Steps == 0 || i <= in.Steps; i++ {
+		if err := in.Events__.Send("progress", map[string]int{"step": i}); err != nil {
+			progressDone <- err
+			return nil
+		}
+		if in.Steps == 0 {
+			// Until the client goes
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	in.Events__.Send("", "done\nok")
+	return appgo.NewApiErr(appgo.ECodeInternal, "late")
+}
+
+func TestSSE(t *testing.T) {
+	progressDone = make(chan error, 1)
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddSSE("/api", []interface{}{&progressApi{}})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/progress?Steps=3")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	var lines []string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	resp.Body.Close()
+	assert.Equal(t, []string{
+		"event: progress", `data: {"step":1}`, "",
+		"event: progress", `data: {"step":2}`, "",
+		"event: progress", `data: {"step":3}`, "",
+		"data: done", "data: ok", "",
+		"event: error", `data: {"errcode":50000,"errmsg":"late"}`, "",
+	}, lines)
+
+	resp, err = http.Get(ts.URL + "/api/progress?Steps=-1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Type"), "application/json")
+		resp.Body.Close()
+	}
+
+	// Client disconnects
+	resp, err = http.Get(ts.URL + "/api/progress")
+	if assert.NoError(t, err) {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		assert.Equal(t, "event: progress\n", line)
+		resp.Body.Close()
+		select {
+		case err := <-progressDone:
+			assert.Equal(t, context.Canceled, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream not canceled")
+		}
+	}
+
+	assert.Panics(t, func() { s.AddSSE("/bad", []interface{}{&mwApi{}}) })
+}
+
+type feedInput struct {
+	Events__ appgo.EventSink
+}
+
+var feedOpen, feedRelease chan struct{}
+
+type feedApi struct {
+	META struct{} `path:"/feed"`
+}
+
+func (feedApi) SSE(in *feedInput) error {
+	// Idle for a few heartbeats
+	time.Sleep(50 * time.Millisecond)
+	from, _ := strconv.Atoi(in.Events__.LastEventId())
+	for i := from + 1; i <= 3; i++ {
+		in.Events__.SendId(strconv.Itoa(i), "", fmt.Sprint("item", i))
+	}
+	if err := in.Events__.SendId("4\n", "", "x"); err == nil {
+		return appgo.NewApiErr(appgo.ECodeInternal, "bad id sent")
+	}
+	feedOpen <- struct{}{}
+	<-feedRelease
+	return nil
+}
+
+func sseConns(t *testing.T, route string) float64 {
+	mfs, err := stdprometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != "appgo_http_sse_connections" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() == route {
+				return m.GetGauge().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestSSEFeed(t *testing.T) {
+	appgo.Conf.Prometheus.Enable = true
+	defer func() { appgo.Conf.Prometheus.Enable = false }()
+	initMetrics()
+	appgo.Conf.Sse.Heartbeat = 1
+	heartbeatUnit = 10 * time.Millisecond
+	defer func() {
+		appgo.Conf.Sse.Heartbeat = 0
+		heartbeatUnit = time.Second
+	}()
+	feedOpen, feedRelease = make(chan struct{}), make(chan struct{})
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddSSE("/api", []interface{}{&feedApi{}})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	read := func(lastId string) []string {
+		r, _ := http.NewRequest("GET", ts.URL+"/api/feed", nil)
+		if lastId != "" {
+			r.Header.Set("Last-Event-ID", lastId)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer resp.Body.Close()
+		<-feedOpen
+		assert.Equal(t, float64(1), sseConns(t, "/api/feed"))
+		close(feedRelease)
+		var lines []string
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		return lines
+	}
+	lines := read("")
+	if assert.NotEmpty(t, lines) {
+		assert.Equal(t, ": ping", lines[0])
+	}
+	var events []string
+	for _, l := range lines {
+		if l != ": ping" && l != "" {
+			events = append(events, l)
+		}
+	}
+	assert.Equal(t, []string{
+		"id: 1", "data: item1", "id: 2", "data: item2", "id: 3", "data: item3",
+	}, events)
+	assert.Equal(t, float64(0), sseConns(t, "/api/feed"))
+
+	// Resumed after the last seen event
+	feedRelease = make(chan struct{})
+	lines = read("2")
+	assert.Contains(t, lines, "id: 3")
+	assert.NotContains(t, lines, "id: 2")
+}
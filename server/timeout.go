@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// setTimeout reads META tag `timeout:"5s"`, which overrides
+// Conf.HandlerTimeout for the handler.
+func (h *handler) setTimeout(meta reflect.StructTag) error {
+	if s := meta.Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Bad timeout of %s: %s", h.path, s)
+		}
+		h.timeout = d
+	}
+	return nil
+}
+
+const defaultMaxRequestTimeout = 60 * time.Second
+
+// callTimeout returns the timeout of calling the API func, the shorter
+// of the handler's and the one the client asks for, 0 if none.
+func (h *handler) callTimeout(r *http.Request) time.Duration {
+	d := h.timeout
+	if d <= 0 && h.htype != HandlerTypeSSE && h.htype != HandlerTypeWebSocket {
+		// Streams last long unless told otherwise
+		d = time.Duration(appgo.Conf.HandlerTimeout) * time.Second
+	}
+	if rd := requestTimeout(r); rd > 0 && (d <= 0 || rd < d) {
+		d = rd
+	}
+	return d
+}
+
+// requestTimeout reads the header of Conf.RequestTimeout, capped by its
+// Max. Bad values are ignored.
+func requestTimeout(r *http.Request) time.Duration {
+	c := &appgo.Conf.RequestTimeout
+	if c.Header == "" {
+		return 0
+	}
+	ms, err := strconv.ParseInt(strings.TrimSpace(r.Header.Get(c.Header)), 10, 64)
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	max := defaultMaxRequestTimeout
+	if c.Max > 0 {
+		max = time.Duration(c.Max) * time.Millisecond
+	}
+	if ms > int64(max/time.Millisecond) {
+		return max
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+type callResult struct {
+	returns []reflect.Value
+	aerr    *appgo.ApiError
+}
+
+// States of a call with a deadline, left pending by whichever of the
+// call and the deadline comes first
+const (
+	callPending int32 = iota
+	callFinished
+	callAbandoned
+)
+
+// invoke calls the API func and ends the transaction if any. With a
+// deadline, the call races the deadline of the request context, and
+// the outcome is decided once by the first to finish: a call finishing
+// in time is committed and replied even if the deadline passes while
+// committing, a call running late is left behind and rolled back.
+func (h *handler) invoke(f *httpFunc, input reflect.Value, r *http.Request,
+	tx appgo.Tx) ([]reflect.Value, *appgo.ApiError) {
+	if _, ok := r.Context().Deadline(); !ok {
+		returns, aerr := h.call(f, input, r)
+		return returns, endCall(r, tx, returns, aerr, true)
+	}
+	state := callPending
+	done := make(chan callResult, 1)
+	go func() {
+		returns, aerr := h.call(f, input, r)
+		inTime := atomic.CompareAndSwapInt32(&state, callPending, callFinished)
+		done <- callResult{returns, endCall(r, tx, returns, aerr, inTime)}
+	}()
+	select {
+	case res := <-done:
+		return res.returns, res.aerr
+	case <-r.Context().Done():
+		if !atomic.CompareAndSwapInt32(&state, callPending, callAbandoned) {
+			// Finished just in time, reply it once committed
+			res := <-done
+			return res.returns, res.aerr
+		}
+		if r.Context().Err() == context.DeadlineExceeded {
+			logEntry(r).WithField("path", r.URL.Path).Warn("API func timed out")
+			return nil, appgo.NewApiErr(appgo.ECodeGatewayTimeout, "timeout")
+		}
+		return nil, appgo.NewApiErr(appgo.ECodeBadRequest, "request canceled")
+	}
+}
+
+// endCall ends the transaction of a call if any, which is committed if
+// the call succeeded and is replied. It returns the error to reply.
+func endCall(r *http.Request, tx appgo.Tx, returns []reflect.Value,
+	aerr *appgo.ApiError, replied bool) *appgo.ApiError {
+	if tx == nil {
+		return aerr
+	}
+	if err := endTx(r, tx, replied && aerr == nil && succeeded(returns)); err != nil {
+		return err
+	}
+	return aerr
+}
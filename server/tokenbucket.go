@@ -0,0 +1,118 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"math"
+	"sync"
+	"time"
+)
+
+// MemRateLimiter is a token bucket per key in memory, which refills rate
+// tokens per second up to burst.
+type MemRateLimiter struct {
+	rate      float64
+	burst     int
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func NewMemRateLimiter(rate float64, burst int) *MemRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &MemRateLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (l *MemRateLimiter) Take(key string) *RateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.at).Seconds()*l.rate)
+	b.at = now
+	rl := &RateLimit{Allowed: b.tokens >= 1, Limit: l.burst}
+	if rl.Allowed {
+		b.tokens--
+	} else {
+		rl.RetryAfter = l.refillTime(1 - b.tokens)
+	}
+	rl.Remaining = int(b.tokens)
+	rl.Reset = now.Add(l.refillTime(float64(l.burst) - b.tokens))
+	return rl
+}
+
+func (l *MemRateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// sweep drops the buckets which have been refilled, at most once per the
+// time to refill an empty bucket.
+func (l *MemRateLimiter) sweep(now time.Time) {
+	full := l.refillTime(float64(l.burst))
+	if now.Sub(l.lastSweep) < full {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.at) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+var (
+	confLimiterMu sync.Mutex
+	confLimiter   RateLimiter
+	// Of confLimiter
+	confLimit struct {
+		rate  float64
+		burst int
+		store string
+	}
+)
+
+// currentRateLimiter returns the one set by SetRateLimiter, or else a
+// limiter of Conf.RateLimit.Rate and Burst in its Store, nil if Rate
+// is 0.
+func currentRateLimiter() RateLimiter {
+	if rateLimiter != nil {
+		return rateLimiter
+	}
+	c := &appgo.Conf.RateLimit
+	if c.Rate <= 0 {
+		return nil
+	}
+	confLimiterMu.Lock()
+	defer confLimiterMu.Unlock()
+	if confLimiter == nil || confLimit.rate != c.Rate || confLimit.burst != c.Burst ||
+		confLimit.store != c.Store {
+		confLimiter = newConfStoreLimiter(c.Rate, c.Burst)
+		confLimit.rate, confLimit.burst, confLimit.store = c.Rate, c.Burst, c.Store
+	}
+	return confLimiter
+}
+
+// newConfStoreLimiter makes a limiter in Conf.RateLimit.Store.
+func newConfStoreLimiter(rate float64, burst int) RateLimiter {
+	if appgo.Conf.RateLimit.Store == "redis" {
+		return NewRedisRateLimiter(rate, burst)
+	}
+	return NewMemRateLimiter(rate, burst)
+}
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ExpiringTokenStore is a TokenStore whose tokens expire unless
+// refreshed, the old token is invalidated by Refresh.
+type ExpiringTokenStore interface {
+	TokenStore
+	Refresh(old auth.Token) (auth.Token, error)
+}
+
+// RevocableTokenStore is a TokenStore whose tokens can be revoked, which
+// are rejected right away, and which lists the sessions of users.
+type RevocableTokenStore interface {
+	TokenStore
+	Revoke(token auth.Token) error
+	RevokeAllForUser(user appgo.Id) error
+	// Sessions returns the tokens of the user not expired, by device
+	Sessions(user appgo.Id) ([]*Session, error)
+	RevokeSession(user appgo.Id, id string) error
+}
+
+// ManagedTokenStore is a TokenStore issuing its own tokens, which are
+// expiring and revocable, as are those of NewConfTokenStore.
+type ManagedTokenStore interface {
+	RevocableTokenStore
+	Refresh(old auth.Token) (auth.Token, error)
+	// IssueForDevice issues a token whose session is named by device,
+	// e.g. "iPhone 12", for users to tell their sessions
+	IssueForDevice(user appgo.Id, role appgo.Role, device string) (auth.Token, error)
+}
+
+const defaultTokenStoreTtl = 30 * 24 * 3600
+
+// NewConfTokenStore makes the store of Conf.TokenStore.Backend, db is
+// only used by "sql".
+func NewConfTokenStore(db *sql.DB) ManagedTokenStore {
+	c := &appgo.Conf.TokenStore
+	ttl := time.Duration(c.Ttl) * time.Second
+	if c.Ttl <= 0 {
+		ttl = defaultTokenStoreTtl * time.Second
+	}
+	switch c.Backend {
+	case "", "memory":
+		s := NewMemTokenStore(ttl)
+		s.maxTokens = c.MaxTokens
+		return s
+	case "redis":
+		return NewRedisTokenStore(ttl)
+	case "sql":
+		if db == nil {
+			log.Panicln("No db of the sql token store")
+		}
+		return NewSQLTokenStore(db, c.Table, ttl)
+	}
+	log.Panicln("Bad token store backend:", c.Backend)
+	return nil
+}
+
+// Session is a token issued to a device, without the token itself.
+type Session struct {
+	// Hash of the token, to revoke it by
+	Id       string    `json:"id"`
+	Device   string    `json:"device,omitempty"`
+	IssuedAt time.Time `json:"issued_at"`
+	LastSeen time.Time `json:"last_seen"`
+	// Of the token of the request listing it
+	Current bool `json:"current"`
+}
+
+// tokenHash keys tokens in stores, which keep no tokens themselves.
+func tokenHash(token auth.Token) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func sessionId(token auth.Token) string {
+	return tokenHash(token)[:16]
+}
+
+// MemTokenStore keeps tokens in memory, a token expires if not refreshed
+// within ttl since it was issued. Tokens not issued by it are invalid.
+type MemTokenStore struct {
+	ttl time.Duration
+	// The oldest tokens are evicted beyond, see Conf.TokenStore.MaxTokens
+	maxTokens int
+	mu        sync.Mutex
+	issued    map[auth.Token]*memSession
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memSession struct {
+	user   appgo.Id
+	device string
+	// Issued or refreshed at
+	at   time.Time
+	seen time.Time
+}
+
+func NewMemTokenStore(ttl time.Duration) *MemTokenStore {
+	return &MemTokenStore{
+		ttl:    ttl,
+		issued: make(map[auth.Token]*memSession),
+		now:    time.Now,
+	}
+}
+
+func (s *MemTokenStore) Issue(user appgo.Id, role appgo.Role) auth.Token {
+	token, _ := s.IssueForDevice(user, role, "")
+	return token
+}
+
+func (s *MemTokenStore) IssueForDevice(user appgo.Id, role appgo.Role,
+	device string) (auth.Token, error) {
+	token := auth.NewToken(user, role)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	if s.maxTokens > 0 && len(s.issued) >= s.maxTokens {
+		s.evictOldest()
+	}
+	now := s.now()
+	s.issued[token] = &memSession{user: user, device: device, at: now, seen: now}
+	return token, nil
+}
+
+func (s *MemTokenStore) evictOldest() {
+	var oldest auth.Token
+	var at time.Time
+	for token, sess := range s.issued {
+		if oldest == "" || sess.at.Before(at) {
+			oldest, at = token, sess.at
+		}
+	}
+	delete(s.issued, oldest)
+}
+
+func (s *MemTokenStore) Validate(token auth.Token) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.valid(token) {
+		return false
+	}
+	s.issued[token].seen = s.now()
+	return true
+}
+
+func (s *MemTokenStore) Refresh(old auth.Token) (auth.Token, error) {
+	user, role := old.Validate()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user == 0 || !s.valid(old) {
+		return "", appgo.UnauthorizedErr
+	}
+	sess := s.issued[old]
+	delete(s.issued, old)
+	token := auth.NewToken(user, role)
+	now := s.now()
+	s.issued[token] = &memSession{user: sess.user, device: sess.device, at: now, seen: now}
+	return token, nil
+}
+
+func (s *MemTokenStore) Revoke(token auth.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.issued, token)
+	return nil
+}
+
+func (s *MemTokenStore) RevokeAllForUser(user appgo.Id) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, sess := range s.issued {
+		if sess.user == user {
+			delete(s.issued, token)
+		}
+	}
+	return nil
+}
+
+func (s *MemTokenStore) Sessions(user appgo.Id) ([]*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sessions []*Session
+	for token, sess := range s.issued {
+		if sess.user == user && s.valid(token) {
+			sessions = append(sessions, &Session{
+				Id:       sessionId(token),
+				Device:   sess.device,
+				IssuedAt: sess.at,
+				LastSeen: sess.seen,
+			})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].IssuedAt.Before(sessions[j].IssuedAt)
+	})
+	return sessions, nil
+}
+
+func (s *MemTokenStore) RevokeSession(user appgo.Id, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, sess := range s.issued {
+		if sess.user == user && sessionId(token) == id {
+			delete(s.issued, token)
+			return nil
+		}
+	}
+	return appgo.NotFoundErr
+}
+
+func (s *MemTokenStore) valid(token auth.Token) bool {
+	sess, ok := s.issued[token]
+	if !ok {
+		return false
+	}
+	if s.now().Sub(sess.at) >= s.ttl {
+		delete(s.issued, token)
+		return false
+	}
+	return true
+}
+
+// sweep drops expired tokens, at most once per ttl.
+func (s *MemTokenStore) sweep() {
+	now := s.now()
+	if now.Sub(s.lastSweep) < s.ttl {
+		return
+	}
+	s.lastSweep = now
+	for token, sess := range s.issued {
+		if now.Sub(sess.at) >= s.ttl {
+			delete(s.issued, token)
+		}
+	}
+}
+
+// AddTokenRefresh serves POST at path which replies a fresh token for
+// the valid one sent, the server's TokenStore needs to be expiring.
+func (s *Server) AddTokenRefresh(path string) {
+	ets, ok := s.ts.(ExpiringTokenStore)
+	if !ok {
+		panic("TokenStore doesn't support refresh")
+	}
+	s.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		token, err := ets.Refresh(tokenFromRequest(r))
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(w).Encode(map[string]auth.Token{"token": token})
+	}).Methods("POST")
+}
+
+// JwtTokenStore accepts JWTs of valid signatures, and refreshes them
+// within Conf.Jwt.RefreshWindow after expiry. Embed it to revoke tokens
+// by overriding Validate.
+type JwtTokenStore struct{}
+
+func (JwtTokenStore) Validate(token auth.Token) bool {
+	return true
+}
+
+func (JwtTokenStore) Refresh(old auth.Token) (auth.Token, error) {
+	return auth.RefreshJwtToken(old)
+}
+
+// AddRefreshTokens serves the refresh tokens of auth.SetRefreshTokenStore
+// at path, POST trades {"refresh_token": ...} for new tokens and DELETE
+// revokes it, e.g. on logout.
+func (s *Server) AddRefreshTokens(path string) {
+	s.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&in)
+		if err != nil || in.RefreshToken == "" {
+			appgo.NewApiErr(appgo.ECodeBadRequest, "bad refresh_token").HttpError(w)
+			return
+		}
+		if r.Method == "DELETE" {
+			if err := auth.RevokeRefreshToken(in.RefreshToken); err != nil {
+				storeError(w, r, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		pair, err := auth.RefreshTokens(in.RefreshToken)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(w).Encode(pair)
+	}).Methods("POST", "DELETE")
+}
+
+// storeError replies err if it's an ApiError, or else InternalErr for
+// errors of token stores, e.g. of Redis or SQL, whose details are logged
+// instead of sent.
+func storeError(w http.ResponseWriter, r *http.Request, err error) {
+	if aerr, ok := err.(*appgo.ApiError); ok {
+		aerr.HttpError(w)
+		return
+	}
+	logEntry(r).WithField("error", err).Errorln("Token store failed")
+	appgo.InternalErr.HttpError(w)
+}
+
+// AddSessions serves the sessions of the user of the token sent, the
+// server's TokenStore needs to be revocable. At path, GET lists them and
+// DELETE logs out, of all devices with query all=true. DELETE at
+// path/{id} logs out a session.
+func (s *Server) AddSessions(path string) {
+	rts, ok := s.ts.(RevocableTokenStore)
+	if !ok {
+		panic("TokenStore doesn't support revocation")
+	}
+	authenticate := func(w http.ResponseWriter, r *http.Request) (auth.Token, appgo.Id) {
+		token := tokenFromRequest(r)
+		user, _ := token.Validate()
+		if user == 0 || !rts.Validate(token) {
+			appgo.UnauthorizedErr.HttpError(w)
+			return "", 0
+		}
+		return token, user
+	}
+	reply := func(w http.ResponseWriter, r *http.Request, err error) {
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	s.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		token, user := authenticate(w, r)
+		if user == 0 {
+			return
+		}
+		if r.Method == "DELETE" {
+			if r.URL.Query().Get("all") == "true" {
+				reply(w, r, rts.RevokeAllForUser(user))
+			} else {
+				reply(w, r, rts.Revoke(token))
+			}
+			return
+		}
+		sessions, err := rts.Sessions(user)
+		if err != nil {
+			storeError(w, r, err)
+			return
+		}
+		current := sessionId(token)
+		for _, sess := range sessions {
+			sess.Current = sess.Id == current
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(w).Encode(map[string][]*Session{"sessions": sessions})
+	}).Methods("GET", "DELETE")
+	s.HandleFunc(path+"/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if _, user := authenticate(w, r); user != 0 {
+			reply(w, r, rts.RevokeSession(user, mux.Vars(r)["id"]))
+		}
+	}).Methods("DELETE")
+}
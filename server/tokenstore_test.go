@@ -0,0 +1,229 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/oxfeeefeee/appgo/auth"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemTokenStore(t *testing.T) {
+	defer withTestTokens()()
+	now := time.Now()
+	ts := NewMemTokenStore(time.Hour)
+	ts.now = func() time.Time { return now }
+	s := NewServer(ts, nil, nil)
+	s.AddRest("/api", []interface{}{&meApi{}})
+	s.AddTokenRefresh("/refresh")
+	get := func(token auth.Token) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/me", nil)
+		r.Header.Set(appgo.CustomTokenHeaderName, string(token))
+		return serveTest(s, r)
+	}
+	refresh := func(token auth.Token) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/refresh", nil)
+		r.Header.Set(appgo.CustomTokenHeaderName, string(token))
+		return serveTest(s, r)
+	}
+
+	token := ts.Issue(42, appgo.RoleAppUser)
+	assert.Equal(t, http.StatusOK, get(token).Code)
+	assert.Equal(t, http.StatusUnauthorized,
+		get(auth.NewToken(42, appgo.RoleAppUser)).Code, "not issued by the store")
+
+	now = now.Add(50 * time.Minute)
+	w := refresh(token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reply map[string]auth.Token
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &reply))
+	fresh := reply["token"]
+	assert.NotEqual(t, token, fresh)
+	assert.Equal(t, http.StatusUnauthorized, get(token).Code)
+	w = get(fresh)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"42"`, w.Body.String())
+
+	// Slided by the refresh
+	now = now.Add(50 * time.Minute)
+	assert.Equal(t, http.StatusOK, get(fresh).Code)
+	now = now.Add(10 * time.Minute)
+	assert.Equal(t, http.StatusUnauthorized, get(fresh).Code)
+	assert.Equal(t, http.StatusUnauthorized, refresh(fresh).Code)
+}
+
+func TestJwtTokenStore(t *testing.T) {
+	defer withTestTokens()()
+	c := appgo.Conf.Jwt
+	defer func() { appgo.Conf.Jwt = c }()
+	appgo.Conf.Jwt.Enable = true
+	appgo.Conf.Jwt.Keys = nil
+	appgo.Conf.Jwt.Keys = append(appgo.Conf.Jwt.Keys, struct {
+		Id      string
+		Secret  string
+		KeyFile string
+	}{Id: "k1", Secret: "secret"})
+	s := NewServer(JwtTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&meApi{}})
+	s.AddTokenRefresh("/refresh")
+
+	token := newTestToken(42)
+	r := httptest.NewRequest("GET", "/api/me", nil)
+	r.Header.Set("Authorization", "Bearer "+string(token))
+	appgo.Conf.Auth.TokenHeaders = []string{"Authorization"}
+	defer func() { appgo.Conf.Auth.TokenHeaders = nil }()
+	w := serveTest(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"42"`, w.Body.String())
+
+	r = httptest.NewRequest("POST", "/refresh", nil)
+	r.Header.Set("Authorization", "Bearer "+string(token))
+	w = serveTest(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reply map[string]auth.Token
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &reply))
+	user, _ := reply["token"].Validate()
+	assert.Equal(t, appgo.Id(42), user)
+}
+
+func TestRefreshTokensApi(t *testing.T) {
+	defer withTestTokens()()
+	auth.SetRefreshTokenStore(auth.NewMemRefreshTokenStore())
+	defer auth.SetRefreshTokenStore(nil)
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRefreshTokens("/tokens")
+	send := func(method, body string) *httptest.ResponseRecorder {
+		return serveTest(s, httptest.NewRequest(method, "/tokens", strings.NewReader(body)))
+	}
+	pair, err := auth.IssueTokens(42, appgo.RoleAppUser)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	w := send("POST", `{"refresh_token":"`+pair.RefreshToken+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	var next auth.TokenPair
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &next))
+	user, _ := next.AccessToken.Validate()
+	assert.Equal(t, appgo.Id(42), user)
+	assert.Equal(t, 3600, next.ExpiresIn)
+	assert.Equal(t, http.StatusUnauthorized,
+		send("POST", `{"refresh_token":"`+pair.RefreshToken+`"}`).Code)
+
+	assert.Equal(t, http.StatusBadRequest, send("POST", `{}`).Code)
+	pair, _ = auth.IssueTokens(42, appgo.RoleAppUser)
+	assert.Equal(t, http.StatusNoContent,
+		send("DELETE", `{"refresh_token":"`+pair.RefreshToken+`"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized,
+		send("POST", `{"refresh_token":"`+pair.RefreshToken+`"}`).Code)
+
+	// Errors of the store are not sent
+	auth.SetRefreshTokenStore(failingRefreshTokenStore{})
+	for _, method := range []string{"POST", "DELETE"} {
+		w = send(method, `{"refresh_token":"x"}`)
+		assert.Equal(t, http.StatusInternalServerError, w.Code, method)
+		assert.Contains(t, w.Body.String(), "Internal error", method)
+		assert.NotContains(t, w.Body.String(), "connection refused", method)
+	}
+}
+
+type failingRefreshTokenStore struct{}
+
+func (failingRefreshTokenStore) Save(rt *auth.RefreshToken) error {
+	return errors.New("dial tcp: connection refused")
+}
+
+func (failingRefreshTokenStore) Use(id string) (*auth.RefreshToken, error) {
+	return nil, errors.New("dial tcp: connection refused")
+}
+
+func (failingRefreshTokenStore) RevokeFamily(family string) error {
+	return errors.New("dial tcp: connection refused")
+}
+
+func TestSessions(t *testing.T) {
+	defer withTestTokens()()
+	now := time.Now()
+	ts := NewMemTokenStore(time.Hour)
+	ts.now = func() time.Time { return now }
+	s := NewServer(ts, nil, nil)
+	s.AddRest("/api", []interface{}{&meApi{}})
+	s.AddSessions("/sessions")
+	send := func(method, path string, token auth.Token) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set(appgo.CustomTokenHeaderName, string(token))
+		return serveTest(s, r)
+	}
+	phone, _ := ts.IssueForDevice(42, appgo.RoleAppUser, "phone")
+	now = now.Add(time.Minute)
+	laptop, _ := ts.IssueForDevice(42, appgo.RoleAppUser, "laptop")
+	other := ts.Issue(43, appgo.RoleAppUser)
+
+	w := send("GET", "/sessions", laptop)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reply map[string][]*Session
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &reply))
+	if sessions := reply["sessions"]; assert.Len(t, sessions, 2) {
+		assert.Equal(t, "phone", sessions[0].Device)
+		assert.False(t, sessions[0].Current)
+		assert.Equal(t, "laptop", sessions[1].Device)
+		assert.True(t, sessions[1].Current)
+
+		// Logged out of the phone from the laptop
+		assert.Equal(t, http.StatusNotFound,
+			send("DELETE", "/sessions/"+sessions[0].Id, other).Code)
+		assert.Equal(t, http.StatusNoContent,
+			send("DELETE", "/sessions/"+sessions[0].Id, laptop).Code)
+	}
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/me", phone).Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/api/me", laptop).Code)
+
+	assert.Equal(t, http.StatusNoContent, send("DELETE", "/sessions", laptop).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/me", laptop).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/sessions", laptop).Code)
+
+	// Everywhere
+	a := ts.Issue(42, appgo.RoleAppUser)
+	b := ts.Issue(42, appgo.RoleAppUser)
+	assert.Equal(t, http.StatusNoContent, send("DELETE", "/sessions?all=true", a).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/api/me", b).Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/api/me", other).Code)
+
+	assert.Panics(t, func() {
+		NewServer(testTokenStore{}, nil, nil).AddSessions("/sessions")
+	})
+}
+
+func TestConfTokenStore(t *testing.T) {
+	defer withTestTokens()()
+	c := appgo.Conf.TokenStore
+	defer func() { appgo.Conf.TokenStore = c }()
+	appgo.Conf.TokenStore.MaxTokens = 2
+	s, ok := NewConfTokenStore(nil).(*MemTokenStore)
+	if !assert.True(t, ok) {
+		return
+	}
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	first := s.Issue(42, appgo.RoleAppUser)
+	now = now.Add(time.Second)
+	second := s.Issue(43, appgo.RoleAppUser)
+	now = now.Add(time.Second)
+	third := s.Issue(44, appgo.RoleAppUser)
+	assert.False(t, s.Validate(first), "evicted")
+	assert.True(t, s.Validate(second))
+	assert.True(t, s.Validate(third))
+
+	appgo.Conf.TokenStore.Backend = "redis"
+	assert.IsType(t, &RedisTokenStore{}, NewConfTokenStore(nil))
+	appgo.Conf.TokenStore.Backend = "sql"
+	assert.Panics(t, func() { NewConfTokenStore(nil) })
+	appgo.Conf.TokenStore.Backend = "mongo"
+	assert.Panics(t, func() { NewConfTokenStore(nil) })
+}
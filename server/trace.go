@@ -0,0 +1,100 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// withTrace extracts the trace context from headers of the format set
+// by Conf.Trace.Format, "w3c"(default), "b3" or "custom".
+func withTrace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var tc *appgo.TraceContext
+		switch appgo.Conf.Trace.Format {
+		case "b3":
+			tc = traceFromB3(r)
+		case "custom":
+			tc = traceFromCustom(r)
+		default:
+			tc = traceFromW3C(r)
+		}
+		if tc != nil {
+			r = r.WithContext(appgo.WithTrace(r.Context(), tc))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// traceFromW3C parses "traceparent: 00-{trace-id}-{span-id}-{flags}"
+func traceFromW3C(r *http.Request) *appgo.TraceContext {
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return nil
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil
+	}
+	return newTrace(parts[1], parts[2], flags&1 == 1, 32)
+}
+
+// traceFromB3 supports both the single "b3" header and the X-B3-* ones.
+func traceFromB3(r *http.Request) *appgo.TraceContext {
+	if b3 := r.Header.Get("b3"); b3 != "" {
+		parts := strings.Split(b3, "-")
+		if len(parts) < 2 {
+			return nil
+		}
+		sampled := len(parts) > 2 && (parts[2] == "1" || parts[2] == "d")
+		return newTrace(parts[0], parts[1], sampled, 16, 32)
+	}
+	sampled := r.Header.Get("X-B3-Sampled") == "1" || r.Header.Get("X-B3-Flags") == "1"
+	return newTrace(r.Header.Get("X-B3-TraceId"), r.Header.Get("X-B3-SpanId"),
+		sampled, 16, 32)
+}
+
+// traceFromCustom reads ids from headers named in Conf.Trace.
+func traceFromCustom(r *http.Request) *appgo.TraceContext {
+	c := &appgo.Conf.Trace
+	tc := &appgo.TraceContext{
+		TraceId: r.Header.Get(c.TraceIdHeader),
+		SpanId:  r.Header.Get(c.SpanIdHeader),
+		Sampled: c.SampledHeader != "" && r.Header.Get(c.SampledHeader) == "1",
+	}
+	if tc.TraceId == "" {
+		return nil
+	}
+	return tc
+}
+
+// newTrace checks the ids are non-zero hex of the expected lengths,
+// span ids are always 16 digits.
+func newTrace(traceId, spanId string, sampled bool, traceIdLens ...int) *appgo.TraceContext {
+	okLen := false
+	for _, l := range traceIdLens {
+		okLen = okLen || len(traceId) == l
+	}
+	if !okLen || len(spanId) != 16 || !isNonZeroHex(traceId) || !isNonZeroHex(spanId) {
+		return nil
+	}
+	return &appgo.TraceContext{
+		TraceId: strings.ToLower(traceId),
+		SpanId:  strings.ToLower(spanId),
+		Sampled: sampled,
+	}
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func isNonZeroHex(s string) bool {
+	return isHex(s) && strings.Trim(s, "0") != ""
+}
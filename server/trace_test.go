@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func traceOf(headers map[string]string) *appgo.TraceContext {
+	var tc *appgo.TraceContext
+	h := withTrace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc = appgo.TraceFromContext(r.Context())
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	serveTest(h, r)
+	return tc
+}
+
+func TestTraceHeaders(t *testing.T) {
+	defer func() { appgo.Conf.Trace.Format = "" }()
+
+	tc := traceOf(map[string]string{
+		"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	})
+	assert.Equal(t, &appgo.TraceContext{
+		TraceId: "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanId:  "00f067aa0ba902b7",
+		Sampled: true,
+	}, tc)
+	assert.Nil(t, traceOf(map[string]string{
+		"traceparent": "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+	}))
+	assert.Nil(t, traceOf(map[string]string{"X-B3-TraceId": "463ac35c9f6413ad"}))
+
+	appgo.Conf.Trace.Format = "b3"
+	tc = traceOf(map[string]string{
+		"X-B3-TraceId": "463ac35c9f6413ad",
+		"X-B3-SpanId":  "a2fb4a1d1a96d312",
+		"X-B3-Sampled": "1",
+	})
+	assert.Equal(t, &appgo.TraceContext{
+		TraceId: "463ac35c9f6413ad",
+		SpanId:  "a2fb4a1d1a96d312",
+		Sampled: true,
+	}, tc)
+	tc = traceOf(map[string]string{
+		"b3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-0",
+	})
+	assert.Equal(t, "80f198ee56343ba864fe8b2a57d3eff7", tc.TraceId)
+	assert.False(t, tc.Sampled)
+
+	appgo.Conf.Trace.Format = "custom"
+	appgo.Conf.Trace.TraceIdHeader = "X-Legacy-Trace"
+	defer func() { appgo.Conf.Trace.TraceIdHeader = "" }()
+	tc = traceOf(map[string]string{"X-Legacy-Trace": "t-1"})
+	assert.Equal(t, "t-1", tc.TraceId)
+}
+
+type spanInput struct {
+	Fail      bool
+	UserId__  int64
+	Context__ context.Context
+}
+
+type spanApi struct {
+	META struct{} `path:"/items/{id}/spans"`
+}
+
+func (spanApi) GET(in *spanInput) (*appgo.TraceContext, error) {
+	if in.Fail {
+		return nil, appgo.NewApiErr(appgo.ECodeInternal, "broken")
+	}
+	out := httptest.NewRequest("GET", "http://downstream/", nil)
+	ForwardTrace(in.Context__, out)
+	tc := appgo.TraceFromContext(in.Context__)
+	if out.Header.Get("traceparent") != "00-"+tc.TraceId+"-"+tc.SpanId+"-01" {
+		return nil, appgo.NewApiErr(appgo.ECodeInternal, "not forwarded")
+	}
+	return tc, nil
+}
+
+// keptExporter keeps the spans on shutdown
+type keptExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keptExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func TestOtelSpans(t *testing.T) {
+	defer withTestTokens()()
+	appgo.Conf.Trace.Otel.Enable = true
+	appgo.Conf.Trace.Otel.ServiceName = "items"
+	defer func() { appgo.Conf.Trace.Otel.Enable = false }()
+	exporter := keptExporter{tracetest.NewInMemoryExporter()}
+	shutdown := SetupTracing(exporter)
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddRest("/api", []interface{}{&spanApi{}})
+
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest("GET", "/api/items/3/spans", nil)
+	r.Header.Set("traceparent", parent)
+	r.Header.Set(appgo.CustomTokenHeaderName, string(newTestToken(42)))
+	w := serveTest(s, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	r = httptest.NewRequest("GET", "/api/items/3/spans?Fail=true", nil)
+	r.Header.Set(appgo.CustomTokenHeaderName, string(newTestToken(42)))
+	serveTest(s, r)
+
+	assert.NoError(t, shutdown(context.Background()))
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	span := spans[0]
+	assert.Equal(t, "GET /api/items/{id}/spans", span.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", span.Parent.SpanID().String())
+	// The trace of the request is the span's
+	var tc appgo.TraceContext
+	json.Unmarshal(w.Body.Bytes(), &tc)
+	assert.Equal(t, span.SpanContext.SpanID().String(), tc.SpanId)
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, "/api/items/{id}/spans", attrs["http.route"].AsString())
+	assert.Equal(t, int64(200), attrs["http.status_code"].AsInt64())
+	assert.Equal(t, "42", attrs["enduser.id"].AsString())
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+	assert.False(t, spans[1].Parent.IsValid())
+	assert.Contains(t, span.Resource.Attributes(), attribute.String("service.name", "items"))
+}
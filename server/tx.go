@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"reflect"
+)
+
+// TxManager opens a transaction for each API call, which is read-only
+// for GET/HEAD/OPTIONS requests. The transaction is committed if the API
+// func returns no error, and rolled back otherwise.
+type TxManager interface {
+	Begin(ctx context.Context, readOnly bool) (appgo.Tx, error)
+}
+
+var txManager TxManager
+
+func SetTxManager(m TxManager) {
+	txManager = m
+}
+
+// beginTx opens the transaction and puts it in the request context,
+// the returned tx is nil if there is no TxManager.
+func beginTx(r *http.Request) (appgo.Tx, *http.Request, *appgo.ApiError) {
+	if txManager == nil {
+		return nil, r, nil
+	}
+	readOnly := r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS"
+	tx, err := txManager.Begin(r.Context(), readOnly)
+	if err != nil {
+		logEntry(r).WithField("error", err).Error("Failed to begin transaction")
+		return nil, r, appgo.NewApiErr(appgo.ECodeInternal, "Failed to begin transaction")
+	}
+	return tx, r.WithContext(appgo.WithTx(r.Context(), tx)), nil
+}
+
+// endTx commits or rolls back the transaction, the error of a failed
+// commit is returned to be replied in place of the result.
+func endTx(r *http.Request, tx appgo.Tx, commit bool) *appgo.ApiError {
+	if !commit {
+		if err := tx.Rollback(); err != nil {
+			logEntry(r).WithField("error", err).Error("Failed to rollback transaction")
+		}
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		logEntry(r).WithField("error", err).Error("Failed to commit transaction")
+		return appgo.NewApiErr(appgo.ECodeInternal, "Failed to commit transaction")
+	}
+	return nil
+}
+
+// succeeded tells if an API func returned no error.
+func succeeded(returns []reflect.Value) bool {
+	if len(returns) == 0 {
+		return false
+	}
+	last := returns[len(returns)-1]
+	return last.Kind() == reflect.Interface && last.IsNil()
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeTx struct {
+	readOnly bool
+	ended    string
+	failed   bool
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.ended = "commit"
+	if tx.failed {
+		return errors.New("deadlock")
+	}
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.ended = "rollback"
+	return nil
+}
+
+type fakeTxManager struct {
+	txs        []*fakeTx
+	failBegin  bool
+	failCommit bool
+}
+
+func (m *fakeTxManager) Begin(ctx context.Context, readOnly bool) (appgo.Tx, error) {
+	if m.failBegin {
+		return nil, errors.New("no connection")
+	}
+	tx := &fakeTx{readOnly: readOnly, failed: m.failCommit}
+	m.txs = append(m.txs, tx)
+	return tx, nil
+}
+
+type txInput struct {
+	Fail      bool
+	Context__ context.Context
+}
+
+type txApi struct {
+	META struct{} `path:"/tx"`
+}
+
+func (txApi) GET(in *txInput) (bool, error) {
+	return appgo.TxFromContext(in.Context__) != nil, nil
+}
+
+func (txApi) POST(in *txInput) error {
+	if in.Fail {
+		return appgo.NewApiErr(appgo.ECodeBadRequest, "failed")
+	}
+	return nil
+}
+
+func TestTxManager(t *testing.T) {
+	m := &fakeTxManager{}
+	SetTxManager(m)
+	defer SetTxManager(nil)
+	h := newTestHandler(&txApi{})
+
+	w := serveTest(h, httptest.NewRequest("GET", "/tx", nil))
+	assert.Equal(t, "true", w.Body.String())
+	serveTest(h, httptest.NewRequest("POST", "/tx", nil))
+	serveTest(h, httptest.NewRequest("POST", "/tx?Fail=true", nil))
+	assert.Equal(t, []*fakeTx{
+		{readOnly: true, ended: "commit"},
+		{readOnly: false, ended: "commit"},
+		{readOnly: false, ended: "rollback"},
+	}, m.txs)
+
+	m.failCommit = true
+	w = serveTest(h, httptest.NewRequest("POST", "/tx", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "Failed to commit transaction")
+
+	m.failBegin = true
+	w = serveTest(h, httptest.NewRequest("POST", "/tx", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+// Ends are sent as the API func may be left running
+type boundaryTx struct {
+	ended       chan string
+	commitDelay time.Duration
+}
+
+func (tx *boundaryTx) Commit() error {
+	time.Sleep(tx.commitDelay)
+	tx.ended <- "commit"
+	return nil
+}
+
+func (tx *boundaryTx) Rollback() error {
+	tx.ended <- "rollback"
+	return nil
+}
+
+type boundaryTxManager struct {
+	tx          *boundaryTx
+	commitDelay time.Duration
+}
+
+func (m *boundaryTxManager) Begin(ctx context.Context, readOnly bool) (appgo.Tx, error) {
+	m.tx = &boundaryTx{ended: make(chan string, 1), commitDelay: m.commitDelay}
+	return m.tx, nil
+}
+
+type boundaryInput struct {
+	// Returns right at the deadline, around when the context is done
+	Late      bool
+	Context__ context.Context
+}
+
+type boundaryApi struct {
+	META struct{} `path:"/boundary" timeout:"5ms"`
+}
+
+func (boundaryApi) POST(in *boundaryInput) error {
+	if in.Late {
+		deadline, _ := in.Context__.Deadline()
+		time.Sleep(time.Until(deadline))
+	}
+	return nil
+}
+
+func TestTxTimeoutBoundary(t *testing.T) {
+	m := &boundaryTxManager{}
+	SetTxManager(m)
+	defer SetTxManager(nil)
+	h := newTestHandler(&boundaryApi{})
+
+	// Committed past the deadline, yet decided in time
+	m.commitDelay = 20 * time.Millisecond
+	w := serveTest(h, httptest.NewRequest("POST", "/boundary", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "commit", <-m.tx.ended)
+
+	m.commitDelay = 0
+	for i := 0; i < 100; i++ {
+		w := serveTest(h, httptest.NewRequest("POST", "/boundary?Late=true", nil))
+		ended := <-m.tx.ended
+		if w.Code == http.StatusOK {
+			assert.Equal(t, "commit", ended)
+		} else {
+			assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+			assert.Equal(t, "rollback", ended)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/oxfeeefeee/appgo/toolkit/strutil"
+	"reflect"
+	"strings"
+)
+
+type typedHandler struct {
+	h *handler
+	// Index of its info in Server.apis
+	api    int
+	routed map[string]bool
+}
+
+// RegisterJSON adds fn as the JSON API func of method at path, which is
+// like "GET" or "GET2" for version 2. The signature of fn is checked at
+// compile time, and fn is called directly rather than by reflection. In
+// has the fields of API func inputs, e.g.
+//
+//	server.RegisterJSON(s, "GET", "/api/users/{id}", func(in *struct {
+//		ResourceId__ int64
+//	}) (*User, error) {
+//		...
+//	})
+//
+// Funcs of other methods can be registered at the same path, but not
+// at a path added by AddRest. Handlers of typed funcs use no META tags.
+func RegisterJSON[In, Out any](s *Server, method, path string, fn func(*In) (*Out, error)) {
+	method = strings.ToUpper(method)
+	if !typedMethod(method) {
+		log.Panicf("Bad method of %s: %s", path, method)
+	}
+	f, err := httpFuncOf(reflect.ValueOf(fn))
+	if err != nil {
+		log.Panicf("Bad API func of %s %s: %s", method, path, err)
+	}
+	f.direct = func(input reflect.Value) []reflect.Value {
+		out, err := fn(input.Interface().(*In))
+		return []reflect.Value{reflect.ValueOf(&out).Elem(), reflect.ValueOf(&err).Elem()}
+	}
+	s.addRoutes(path, []string{method}, fn)
+	t, ok := s.typed[path]
+	if !ok {
+		h := &handler{
+			htype:    HandlerTypeJson,
+			path:     path,
+			funcs:    make(map[string]*httpFunc),
+			ts:       s.ts,
+			renderer: jsonRenderer(),
+		}
+		h.setMeta(reflect.StructTag(""))
+		t = &typedHandler{h: h, api: len(s.apis), routed: make(map[string]bool)}
+		s.typed[path] = t
+		s.apis = append(s.apis, ApiInfo{})
+	}
+	t.h.funcs[method] = f
+	t.h.supports = append(t.h.supports, method)
+	// Routes to h of the methods not routed yet
+	var methods []string
+	for _, m := range t.h.routeMethods() {
+		// Versions are resolved by h
+		m = strings.TrimRight(m, "0123456789")
+		if !t.routed[m] {
+			t.routed[m] = true
+			methods = append(methods, m)
+		}
+	}
+	if len(methods) > 0 {
+		s.Handle(path, s.wrap(t.h)).Methods(methods...)
+	}
+	s.apis[t.api] = t.h.info(path)
+}
+
+func typedMethod(method string) bool {
+	base := strings.TrimRight(method, "0123456789")
+	switch base {
+	case "GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS":
+	default:
+		return false
+	}
+	if base == method {
+		return true
+	}
+	ver := strutil.ToInt(method[len(base):])
+	return ver > 1 && ver <= maxVersion
+}
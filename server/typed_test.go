@@ -0,0 +1,65 @@
+package server
+
+import (
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type typedUser struct {
+	Id   appgo.Id `json:"id"`
+	Name string   `json:"name"`
+}
+
+type typedUserInput struct {
+	ResourceId__ int64
+	Content__    *typedUser
+}
+
+func TestRegisterJSON(t *testing.T) {
+	s := NewServer(testTokenStore{}, nil, nil)
+	RegisterJSON(s, "GET", "/users/{id}", func(in *struct{ ResourceId__ int64 }) (*typedUser, error) {
+		if in.ResourceId__ > 10 {
+			return nil, appgo.NewApiErr(appgo.ECodeNotFound, "no such user")
+		}
+		return &typedUser{Id: appgo.Id(in.ResourceId__), Name: "bob"}, nil
+	})
+	RegisterJSON(s, "put", "/users/{id}", func(in *typedUserInput) (*typedUser, error) {
+		in.Content__.Id = appgo.Id(in.ResourceId__)
+		return in.Content__, nil
+	})
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	w := serve("GET", "/users/1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"id":"1","name":"bob"}`, w.Body.String())
+	w = serve("GET", "/users/11", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve("PUT", "/users/2", `{"name":"amy"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"id":"2","name":"amy"}`, w.Body.String())
+	w = serve("OPTIONS", "/users/2", "")
+	assert.Equal(t, "GET, PUT, HEAD, OPTIONS", w.Header().Get("Allow"))
+	w = serve("DELETE", "/users/2", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	assert.Len(t, s.Apis(), 1)
+	assert.Equal(t, []string{"GET", "PUT"}, s.Apis()[0].Methods)
+
+	assert.Panics(t, func() {
+		RegisterJSON(s, "GET", "/users/{id}", func(in *appgo.DummyInput) (*typedUser, error) {
+			return nil, nil
+		})
+	})
+	assert.Panics(t, func() {
+		RegisterJSON(s, "FETCH", "/users", func(in *appgo.DummyInput) (*typedUser, error) {
+			return nil, nil
+		})
+	})
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"gopkg.in/go-playground/validator.v9"
+	"reflect"
+	"strings"
+)
+
+var validate = validator.New()
+
+// RegisterValidation adds a custom validator usable in `validate` tags,
+// it's not safe to call once the server is serving.
+func RegisterValidation(tag string, fn validator.Func) error {
+	return validate.RegisterValidation(tag, fn)
+}
+
+// hasValidateTags reports whether t or the structs it embeds by
+// pointer (e.g. Content__) carry any `validate` tags.
+func hasValidateTags(t reflect.Type) bool {
+	return hasValidateTagsIn(t, map[reflect.Type]bool{})
+}
+
+func hasValidateTagsIn(t reflect.Type, seen map[reflect.Type]bool) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return false
+	}
+	seen[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Tag.Get("validate") != "" || hasValidateTagsIn(sf.Type, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateInput turns validation failures into one ApiError listing
+// fields like "Content__.Email(email)", its Fields are like
+// {"Age": "min=18"}.
+func validateInput(input reflect.Value) *appgo.ApiError {
+	err := validate.Struct(input.Interface())
+	if err == nil {
+		return nil
+	}
+	verrs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return appgo.NewApiErr(appgo.ECodeBadRequest, err.Error())
+	}
+	fields := make([]string, 0, len(verrs))
+	details := make(map[string]string, len(verrs))
+	for _, fe := range verrs {
+		fields = append(fields, fmt.Sprintf("%s(%s)", fieldPath(fe), fe.Tag()))
+		details[fieldPath(fe)] = fe.Tag()
+		if fe.Param() != "" {
+			details[fieldPath(fe)] += "=" + fe.Param()
+		}
+	}
+	return appgo.NewApiErrWithFields(appgo.ECodeBadRequest,
+		"invalid fields: "+strings.Join(fields, ", "), details)
+}
+
+// fieldPath strips the input struct's name off the namespace.
+func fieldPath(fe validator.FieldError) string {
+	ns := fe.StructNamespace()
+	if i := strings.IndexByte(ns, '.'); i >= 0 {
+		return ns[i+1:]
+	}
+	return ns
+}
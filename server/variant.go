@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type templateVariant struct {
+	template string
+	// Percentage of clients getting it
+	weight int
+}
+
+// setVariants reads META tag `variants:"home_a:70,home_b:30"` of HTML
+// APIs, the weights need to add up to 100.
+func (h *handler) setVariants(tag string) error {
+	if tag == "" {
+		return nil
+	}
+	total := 0
+	for _, s := range strings.Split(tag, ",") {
+		parts := strings.Split(strings.TrimSpace(s), ":")
+		if len(parts) != 2 {
+			return fmt.Errorf("Bad variants of %s: %s", h.path, tag)
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 0 {
+			return fmt.Errorf("Bad variants of %s: %s", h.path, tag)
+		}
+		h.variants = append(h.variants, templateVariant{parts[0], weight})
+		total += weight
+	}
+	if total != 100 {
+		return fmt.Errorf("Weights of variants of %s add up to %d", h.path, total)
+	}
+	return nil
+}
+
+// pickTemplate picks the template variant of the client, which sticks
+// to the same client. The pick is sent in a header and counted.
+func (h *handler) pickTemplate(w http.ResponseWriter, r *http.Request) string {
+	if len(h.variants) == 0 {
+		return h.template
+	}
+	bucket := bucketOf("variant:" + h.path + ":" + h.clientKey(r, 0))
+	v := h.variants[len(h.variants)-1]
+	for _, cand := range h.variants {
+		if bucket < cand.weight {
+			v = cand
+			break
+		}
+		bucket -= cand.weight
+	}
+	w.Header().Set(appgo.CustomVariantHeaderName, v.template)
+	if appgo.Conf.Prometheus.Enable {
+		metrics_variant_count.With("path", h.path, "variant", v.template).Add(1)
+	}
+	return v.template
+}
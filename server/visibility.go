@@ -0,0 +1,341 @@
+package server
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	// Type => if it may have fields with visibility tags
+	visibilityTypes sync.Map
+)
+
+// filterVisible drops the fields of v tagged like `visibility:"webAdmin"`,
+// unless the role of r is one of the listed ones. Names of roles are
+// registered with appgo.RegisterRole.
+func (h *handler) filterVisible(r *http.Request, v interface{}) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || !hasVisibility(rv.Type()) {
+		return v, nil
+	}
+	vm := &visibilityMarshaler{role: func() appgo.Role {
+		_, role := h.authByRequest(r)
+		return role
+	}}
+	var buf bytes.Buffer
+	if err := vm.marshal(&buf, rv); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(buf.Bytes()), nil
+}
+
+// blankInvisible returns a copy of v with the fields the role of r can't
+// see zeroed, for encoders other than JSON.
+func (h *handler) blankInvisible(r *http.Request, v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || !hasVisibility(rv.Type()) {
+		return v
+	}
+	vm := &visibilityMarshaler{role: func() appgo.Role {
+		_, role := h.authByRequest(r)
+		return role
+	}}
+	return vm.blank(rv).Interface()
+}
+
+func hasVisibility(t reflect.Type) bool {
+	if has, ok := visibilityTypes.Load(t); ok {
+		return has.(bool)
+	}
+	// Assumed false while being checked, for recursive types
+	visibilityTypes.Store(t, false)
+	has := false
+	switch t.Kind() {
+	case reflect.Interface:
+		has = true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		has = hasVisibility(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField() && !has; i++ {
+			f := t.Field(i)
+			has = f.Tag.Get("visibility") != "" || hasVisibility(f.Type)
+		}
+	}
+	if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+		has = false
+	}
+	visibilityTypes.Store(t, has)
+	return has
+}
+
+// visibilityMarshaler marshals values as encoding/json does, leaving out
+// fields the role can't see.
+type visibilityMarshaler struct {
+	role     func() appgo.Role
+	resolved bool
+	cached   appgo.Role
+}
+
+func (vm *visibilityMarshaler) visible(tag string) bool {
+	if tag == "" {
+		return true
+	}
+	if !vm.resolved {
+		vm.cached, vm.resolved = vm.role(), true
+	}
+	for _, name := range strings.Split(tag, ",") {
+		if role, ok := appgo.RoleByName(strings.TrimSpace(name)); ok && role == vm.cached {
+			return true
+		}
+	}
+	return false
+}
+
+func (vm *visibilityMarshaler) marshal(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteString("null")
+		return nil
+	}
+	if !hasVisibility(v.Type()) {
+		return encodeJSON(buf, v.Interface())
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		return vm.marshal(buf, v.Elem())
+	case reflect.Struct:
+		buf.WriteByte('{')
+		_, err := vm.marshalFields(buf, v, true)
+		buf.WriteByte('}')
+		return err
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := vm.marshal(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	case reflect.Map:
+		return vm.marshalMap(buf, v)
+	}
+	return encodeJSON(buf, v.Interface())
+}
+
+func (vm *visibilityMarshaler) blank(v reflect.Value) reflect.Value {
+	if !hasVisibility(v.Type()) {
+		return v
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(vm.blank(v.Elem()))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(vm.blank(v.Elem()))
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" && !f.Anonymous {
+				continue
+			}
+			cf := c.Field(i)
+			if !cf.CanSet() {
+				// Embedded struct of an unexported type
+				cf = reflect.NewAt(f.Type, unsafe.Pointer(cf.UnsafeAddr())).Elem()
+			}
+			if !vm.visible(f.Tag.Get("visibility")) {
+				cf.Set(reflect.Zero(f.Type))
+			} else {
+				cf.Set(vm.blank(cf))
+			}
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(vm.blank(v.Index(i)))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(vm.blank(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			c.SetMapIndex(k, vm.blank(v.MapIndex(k)))
+		}
+		return c
+	}
+	return v
+}
+
+// marshalFields writes the fields of struct v, embedded structs are
+// inlined. It returns if no field has been written.
+func (vm *visibilityMarshaler) marshalFields(buf *bytes.Buffer, v reflect.Value,
+	first bool) (bool, error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts := f.Name, ""
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			if i := strings.Index(tag, ","); i >= 0 {
+				tag, opts = tag[:i], tag[i:]
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		if !vm.visible(f.Tag.Get("visibility")) {
+			continue
+		}
+		fv := v.Field(i)
+		if f.Anonymous && name == f.Name {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if fv.Kind() == reflect.Ptr {
+					if fv.IsNil() {
+						continue
+					}
+					fv = fv.Elem()
+				}
+				var err error
+				if first, err = vm.marshalFields(buf, fv, first); err != nil {
+					return first, err
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if strings.Contains(opts, ",omitempty") && isEmptyValue(fv) {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		encodeJSON(buf, name)
+		buf.WriteByte(':')
+		if err := vm.marshal(buf, fv); err != nil {
+			return first, err
+		}
+	}
+	return first, nil
+}
+
+func (vm *visibilityMarshaler) marshalMap(buf *bytes.Buffer, v reflect.Value) error {
+	if v.IsNil() {
+		buf.WriteString("null")
+		return nil
+	}
+	keys := make([]string, 0, v.Len())
+	values := make(map[string]reflect.Value, v.Len())
+	for _, k := range v.MapKeys() {
+		var key string
+		switch k.Kind() {
+		case reflect.String:
+			key = k.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			key = strconv.FormatInt(k.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			key = strconv.FormatUint(k.Uint(), 10)
+		default:
+			return fmt.Errorf("unsupported map key type: %s", k.Type())
+		}
+		keys = append(keys, key)
+		values[key] = v.MapIndex(k)
+	}
+	sort.Strings(keys)
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		encodeJSON(buf, key)
+		buf.WriteByte(':')
+		if err := vm.marshal(buf, values[key]); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func encodeJSON(buf *bytes.Buffer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	return nil
+}
+
+// isEmptyValue is as the one of encoding/json, for omitempty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
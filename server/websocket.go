@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/oxfeeefeee/appgo"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPingInterval   = 30
+	defaultMaxMessageSize = 64 << 10
+	// Of messages queued by Send
+	socketQueueSize = 16
+	socketWriteWait = 10 * time.Second
+	// Max bytes of a close reason
+	maxCloseReason = 123
+)
+
+var (
+	errSocketClosed = errors.New("websocket closed")
+	// Replaced in tests
+	pingUnit = time.Second
+)
+
+type socketMessage struct {
+	typ  int
+	data []byte
+}
+
+// socket is a managed connection, whose write pump sends the queued
+// messages and pings, and read pump receives messages and pongs.
+type socket struct {
+	conn *websocket.Conn
+	send chan socketMessage
+	recv chan []byte
+	// Why recv is closed, set before closing it
+	recvErr error
+	// Closed once shutting down
+	done     chan struct{}
+	doneOnce sync.Once
+	// Closed once the write pump has closed conn
+	stopped chan struct{}
+	cancel  context.CancelFunc
+}
+
+// upgradeSocket upgrades the connection, the context of the returned
+// request is canceled once the connection is closed. It returns a nil
+// socket if failed, which Upgrade has replied.
+func upgradeSocket(w http.ResponseWriter, r *http.Request) (*socket, *http.Request) {
+	u := websocket.Upgrader{CheckOrigin: checkSocketOrigin}
+	conn, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, r
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	s := &socket{
+		conn:    conn,
+		send:    make(chan socketMessage, socketQueueSize),
+		recv:    make(chan []byte),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		cancel:  cancel,
+	}
+	go s.readPump()
+	go s.writePump(drainOf(r))
+	return s, r.WithContext(ctx)
+}
+
+// checkSocketOrigin allows browsers of the host itself or of
+// Conf.WebSocket.AllowedOrigins, against cross-site hijacking.
+func checkSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range appgo.Conf.WebSocket.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func pingInterval() time.Duration {
+	n := appgo.Conf.WebSocket.PingInterval
+	if n <= 0 {
+		n = defaultPingInterval
+	}
+	return time.Duration(n) * pingUnit
+}
+
+func (s *socket) Receive() ([]byte, error) {
+	data, ok := <-s.recv
+	if !ok {
+		return nil, s.recvErr
+	}
+	return data, nil
+}
+
+func (s *socket) ReceiveJSON(v interface{}) error {
+	data, err := s.Receive()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *socket) Send(data interface{}) error {
+	var m socketMessage
+	switch v := data.(type) {
+	case string:
+		m = socketMessage{typ: websocket.TextMessage, data: []byte(v)}
+	case []byte:
+		m = socketMessage{typ: websocket.BinaryMessage, data: v}
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		m = socketMessage{typ: websocket.TextMessage, data: b}
+	}
+	select {
+	case <-s.done:
+		return errSocketClosed
+	default:
+	}
+	select {
+	case s.send <- m:
+		return nil
+	case <-s.done:
+		return errSocketClosed
+	}
+}
+
+func (s *socket) Close(code int, reason string) error {
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	m := socketMessage{
+		typ:  websocket.CloseMessage,
+		data: websocket.FormatCloseMessage(code, reason),
+	}
+	select {
+	case s.send <- m:
+		<-s.stopped
+		return nil
+	case <-s.done:
+		<-s.stopped
+		return errSocketClosed
+	}
+}
+
+// shut stops the pumps and cancels the context of the request.
+func (s *socket) shut() {
+	s.doneOnce.Do(func() {
+		close(s.done)
+		s.cancel()
+	})
+}
+
+func (s *socket) readPump() {
+	defer close(s.recv)
+	wait := 2 * pingInterval()
+	limit := appgo.Conf.WebSocket.MaxMessageSize
+	if limit <= 0 {
+		limit = defaultMaxMessageSize
+	}
+	s.conn.SetReadLimit(limit)
+	s.conn.SetReadDeadline(time.Now().Add(wait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wait))
+	})
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			s.recvErr = err
+			s.shut()
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(wait))
+		select {
+		case s.recv <- data:
+		case <-s.done:
+			s.recvErr = errSocketClosed
+			return
+		}
+	}
+}
+
+// writePump closes the connection with 1001 once drain is closed.
+func (s *socket) writePump(drain <-chan struct{}) {
+	t := time.NewTicker(pingInterval())
+	defer func() {
+		t.Stop()
+		s.shut()
+		s.conn.Close()
+		close(s.stopped)
+	}()
+	for {
+		select {
+		case m := <-s.send:
+			deadline := time.Now().Add(socketWriteWait)
+			if m.typ == websocket.CloseMessage {
+				s.conn.WriteControl(m.typ, m.data, deadline)
+				return
+			}
+			s.conn.SetWriteDeadline(deadline)
+			if err := s.conn.WriteMessage(m.typ, m.data); err != nil {
+				return
+			}
+		case <-t.C:
+			deadline := time.Now().Add(socketWriteWait)
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		case <-drain:
+			m := websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down")
+			s.conn.WriteControl(websocket.CloseMessage, m, time.Now().Add(socketWriteWait))
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// endSocket closes the connection once the WebSocket func has returned,
+// normally or with code 4000 plus the HTTP status of the error, e.g. 4403,
+// and the error message as the reason.
+func (h *handler) endSocket(s *socket, returns []reflect.Value, aerr *appgo.ApiError) {
+	if aerr == nil {
+		if err := returns[0]; !err.IsNil() {
+			var ok bool
+			if aerr, ok = err.Interface().(*appgo.ApiError); !ok {
+				aerr = appgo.NewApiErr(appgo.ECodeInternal, "Bad api-func format")
+			}
+		}
+	}
+	if aerr == nil {
+		s.Close(websocket.CloseNormalClosure, "")
+	} else {
+		s.Close(4000+aerr.HttpStatus(), aerr.Msg)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/oxfeeefeee/appgo"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type echoInput struct {
+	UserId__     int64
+	ResourceId__ int64
+	Socket__     appgo.Socket
+}
+
+type echoApi struct {
+	META struct{} `path:"/rooms/{id}/echo"`
+}
+
+func (echoApi) WS(in *echoInput) error {
+	for {
+		var m map[string]string
+		if err := in.Socket__.ReceiveJSON(&m); err != nil {
+			return nil
+		}
+		if m["say"] == "bye" {
+			return appgo.NewApiErr(appgo.ECodeForbidden, "left")
+		}
+		in.Socket__.Send(map[string]interface{}{
+			"user": in.UserId__,
+			"room": in.ResourceId__,
+			"echo": m["say"],
+		})
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	defer withTestTokens()()
+	appgo.Conf.WebSocket.PingInterval = 1
+	pingUnit = 10 * time.Millisecond
+	defer func() {
+		appgo.Conf.WebSocket.PingInterval = 0
+		pingUnit = time.Second
+	}()
+	// Hijacked connections are not waited for by ts.Close
+	logged := make(chan AccessLogEntry, 10)
+	SetAccessLogger(func(e AccessLogEntry) { logged <- e })
+	defer SetAccessLogger(nil)
+	s := NewServer(testTokenStore{}, nil, nil)
+	s.AddWebSocket("/api", []interface{}{&echoApi{}})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/rooms/7/echo"
+
+	// Authenticated before upgrading
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Equal(t, websocket.ErrBadHandshake, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+	header := http.Header{}
+	header.Set("Origin", "http://evil.example.com")
+	header.Set(appgo.CustomTokenHeaderName, string(newTestToken(42)))
+	_, resp, err = websocket.DefaultDialer.Dial(url, header)
+	if assert.Error(t, err) && assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	header.Del("Origin")
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	pings := make(chan struct{}, 100)
+	conn.SetPingHandler(func(data string) error {
+		pings <- struct{}{}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	msgs := make(chan map[string]interface{})
+	var closeErr error
+	go func() {
+		defer close(msgs)
+		for {
+			var m map[string]interface{}
+			if closeErr = conn.ReadJSON(&m); closeErr != nil {
+				return
+			}
+			msgs <- m
+		}
+	}()
+	// Kept alive across pings
+	time.Sleep(50 * time.Millisecond)
+	assert.NotEmpty(t, pings)
+	assert.NoError(t, conn.WriteJSON(map[string]string{"say": "hi"}))
+	assert.Equal(t, map[string]interface{}{
+		"user": float64(42), "room": float64(7), "echo": "hi",
+	}, <-msgs)
+
+	// An error closes the connection
+	assert.NoError(t, conn.WriteJSON(map[string]string{"say": "bye"}))
+	_, ok := <-msgs
+	assert.False(t, ok)
+	if ce, ok := closeErr.(*websocket.CloseError); assert.True(t, ok) {
+		assert.Equal(t, 4403, ce.Code)
+		assert.Equal(t, "left", ce.Text)
+	}
+	var statuses []int
+	for len(statuses) < 3 {
+		statuses = append(statuses, (<-logged).Status)
+	}
+	assert.Equal(t, []int{401, 403, 101}, statuses)
+
+	assert.Panics(t, func() { s.AddWebSocket("/bad", []interface{}{&progressApi{}}) })
+}
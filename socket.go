@@ -0,0 +1,17 @@
+package appgo
+
+// Socket is the connection of a WebSocket API, kept alive with pings by
+// the server and closed once the API func returns.
+type Socket interface {
+	// Receive returns the next message, text or binary. It fails once
+	// the connection is closed.
+	Receive() ([]byte, error)
+	// ReceiveJSON decodes the next message into v.
+	ReceiveJSON(v interface{}) error
+	// Send sends a message, strings as text, []byte as binary and others
+	// as JSON text. It fails once the connection is closed.
+	Send(data interface{}) error
+	// Close closes the connection with the close code and reason after
+	// the messages sent before, e.g. 1000 and "bye".
+	Close(code int, reason string) error
+}